@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+// parseFlags separates the flags found in args from the positional arguments.
+// The accepted flags are the keys of known, mapped to whether they take a
+// value, which can be given either as the next argument or after an `=`. One
+// letter flags also accept their value right after them, as in `-Ilib`.
+//
+// When interspersed is false, parsing stops at the first positional argument,
+// so that arguments meant for the program being run are never taken as flags.
+// In any case, everything after a `--` is taken as positional.
+func parseFlags(args []string, known map[string]bool, interspersed bool) ([]string, map[string][]string) {
+	positional := make([]string, 0, len(args))
+	flags := make(map[string][]string)
+
+	for idx := 0; idx < len(args); idx++ {
+		arg := args[idx]
+
+		if arg == "--" {
+			positional = append(positional, args[idx+1:]...)
+			break
+		}
+
+		if len(arg) < 2 || arg[0] != '-' {
+			if !interspersed {
+				positional = append(positional, args[idx:]...)
+				break
+			}
+			positional = append(positional, arg)
+			continue
+		}
+
+		name, value, hasValue := arg, "", false
+		if eqIdx := strings.IndexByte(arg, '='); eqIdx >= 0 {
+			name, value, hasValue = arg[:eqIdx], arg[eqIdx+1:], true
+		}
+
+		takesValue, ok := known[name]
+		if !ok && !hasValue && len(name) > 2 && name[1] != '-' {
+			if takesValue, ok = known[name[:2]]; ok && takesValue {
+				name, value, hasValue = name[:2], name[2:], true
+			} else {
+				ok = false
+			}
+		}
+		if !ok {
+			appLogger.Criticalf("Unknown flag '%s'.\n", name)
+			os.Exit(1)
+		}
+
+		switch {
+		case takesValue && !hasValue:
+			if idx+1 == len(args) {
+				appLogger.Criticalf("Flag '%s' expects a value.\n", name)
+				os.Exit(1)
+			}
+			idx++
+			value = args[idx]
+		case !takesValue && hasValue:
+			appLogger.Criticalf("Flag '%s' does not expect a value.\n", name)
+			os.Exit(1)
+		}
+
+		flags[name] = append(flags[name], value)
+	}
+
+	return positional, flags
+}
@@ -1,6 +1,7 @@
 package gvm
 
 import (
+	"fmt"
 	"github.com/juju/loggo"
 	"github.com/juju/loggo/loggocolor"
 	"os"
@@ -11,6 +12,31 @@ type Code int64
 type Context struct {
 	FileName string
 	LineNum  int
+	// Expansion is set for lines produced by expanding a macro.
+	Expansion *Expansion
+}
+
+// Expansion records which macro produced a line and where it was used.
+type Expansion struct {
+	Macro string
+	Site  Context
+}
+
+func (ctxt Context) String() string {
+	if ctxt.Expansion == nil {
+		return fmt.Sprintf("%s.%d", ctxt.FileName, ctxt.LineNum)
+	}
+	return fmt.Sprintf("%s: in macro '%s' at %s.%d",
+		ctxt.Expansion.Site, ctxt.Expansion.Macro, ctxt.FileName, ctxt.LineNum)
+}
+
+// Origin returns the context of the line as written by the user, which for
+// lines produced by macros is the site of the outermost expansion.
+func (ctxt Context) Origin() Context {
+	for ctxt.Expansion != nil {
+		ctxt = ctxt.Expansion.Site
+	}
+	return ctxt
 }
 
 var Logger loggo.Logger
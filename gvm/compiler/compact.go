@@ -0,0 +1,171 @@
+package compiler
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/vsartor/gvm/gvm"
+	"github.com/vsartor/gvm/gvm/lang"
+	"io"
+	"os"
+)
+
+// In the compact encoding each instruction takes one byte for its opcode,
+// followed by its register operands packed two per byte, four bits each, and
+// then by its other operands as zigzag varints. Code positions still count the
+// words of the code once decoded, both in jumps and in the debug information.
+
+// Registers must fit in the four bits they are packed into
+const maxCompactRegister = 15
+
+// encodeCompact encodes code in the compact encoding, failing if some
+// instruction can't be decoded or uses a register that doesn't fit.
+func encodeCompact(code []gvm.Code) ([]byte, error) {
+	data := make([]byte, 0, len(code)*2)
+	varint := make([]byte, binary.MaxVarintLen64)
+
+	for position := int64(0); position < int64(len(code)); {
+		kinds, ok := lang.Operands(code[position])
+		if !ok || code[position] > 0xff {
+			return nil, fmt.Errorf("unknown instruction %d at %d", code[position], position)
+		}
+		if position+int64(len(kinds)) >= int64(len(code)) {
+			return nil, fmt.Errorf("missing operands at %d", position)
+		}
+		operands := code[position+1 : position+1+int64(len(kinds))]
+
+		data = append(data, byte(code[position]))
+
+		registers := 0
+		for idx, kind := range kinds {
+			if kind != lang.RegisterOperand {
+				continue
+			}
+			register := operands[idx]
+			if register < 0 || register > maxCompactRegister {
+				return nil, fmt.Errorf("register index %d at %d doesn't fit", register, position)
+			}
+			if registers%2 == 0 {
+				data = append(data, byte(register)<<4)
+			} else {
+				data[len(data)-1] |= byte(register)
+			}
+			registers++
+		}
+
+		for idx, kind := range kinds {
+			if kind != lang.RegisterOperand {
+				n := binary.PutVarint(varint, int64(operands[idx]))
+				data = append(data, varint[:n]...)
+			}
+		}
+
+		position += 1 + int64(len(kinds))
+	}
+
+	return data, nil
+}
+
+// decodeCompact decodes code in the compact encoding, also returning the byte
+// offset of each instruction keyed by its position in the decoded code.
+func decodeCompact(data []byte) ([]gvm.Code, map[int64]int64, error) {
+	code := make([]gvm.Code, 0, len(data))
+	offsets := make(map[int64]int64)
+
+	for offset := 0; offset < len(data); {
+		offsets[int64(len(code))] = int64(offset)
+
+		instruction := gvm.Code(data[offset])
+		kinds, ok := lang.Operands(instruction)
+		if !ok {
+			return nil, nil, fmt.Errorf("unknown instruction %d at byte %d", instruction, offset)
+		}
+		start := offset
+		offset++
+
+		operands := make([]gvm.Code, len(kinds))
+		registers := 0
+		for idx, kind := range kinds {
+			if kind != lang.RegisterOperand {
+				continue
+			}
+			if registers%2 == 0 {
+				if offset == len(data) {
+					return nil, nil, fmt.Errorf("missing operands at byte %d", start)
+				}
+				operands[idx] = gvm.Code(data[offset] >> 4)
+				offset++
+			} else {
+				operands[idx] = gvm.Code(data[offset-1] & 0xf)
+			}
+			registers++
+		}
+
+		for idx, kind := range kinds {
+			if kind == lang.RegisterOperand {
+				continue
+			}
+			value, n := binary.Varint(data[offset:])
+			if n <= 0 {
+				return nil, nil, fmt.Errorf("missing operands at byte %d", start)
+			}
+			operands[idx] = gvm.Code(value)
+			offset += n
+		}
+
+		code = append(code, instruction)
+		code = append(code, operands...)
+	}
+	offsets[int64(len(code))] = int64(len(data))
+
+	return code, offsets, nil
+}
+
+// writeCompactCode writes the header of compact binary files followed by the
+// size of the encoded code in bytes and the code itself.
+func writeCompactCode(data []byte, output *os.File) {
+	err := binary.Write(output, binary.LittleEndian, gvm.CompactFileHeader)
+	if err != nil {
+		gvm.Logger.Criticalf("Failed writting header: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	err = binary.Write(output, binary.LittleEndian, int64(len(data)))
+	if err != nil {
+		gvm.Logger.Criticalf("Failed writting size of code: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	if _, err = output.Write(data); err != nil {
+		gvm.Logger.Criticalf("Failed writting code: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+// readCompactCode reads the code of a compact binary file, following its
+// header.
+func readCompactCode(file *os.File) ([]gvm.Code, map[int64]int64) {
+	var size int64
+	err := binary.Read(file, binary.LittleEndian, &size)
+	if err == nil && size < 0 {
+		err = errors.New("negative size")
+	}
+	if err != nil {
+		gvm.Logger.Criticalf("Failed reading code size: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	data := make([]byte, size)
+	if _, err = io.ReadFull(file, data); err != nil {
+		gvm.Logger.Criticalf("Failed reading code: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	code, offsets, err := decodeCompact(data)
+	if err != nil {
+		gvm.Logger.Criticalf("Failed decoding code: %s.\n", err.Error())
+		os.Exit(1)
+	}
+
+	return code, offsets
+}
@@ -0,0 +1,124 @@
+package compiler
+
+import (
+	"github.com/vsartor/gvm/gvm"
+	"github.com/vsartor/gvm/gvm/lang"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// everyInstruction returns code holding every instruction, with operands
+// cycling through the registers and through constants of every size.
+func everyInstruction() []gvm.Code {
+	constants := []gvm.Code{0, 1, -1, 63, -64, 64, 1 << 20, math.MaxInt64, math.MinInt64}
+	code := make([]gvm.Code, 0)
+	register, constant := 0, 0
+	for ins := gvm.Code(0); ins <= 0xff; ins++ {
+		kinds, ok := lang.Operands(ins)
+		if !ok {
+			continue
+		}
+		code = append(code, ins)
+		for _, kind := range kinds {
+			if kind == lang.RegisterOperand {
+				code = append(code, gvm.Code(register%gvm.RegisterCount))
+				register++
+			} else {
+				code = append(code, constants[constant%len(constants)])
+				constant++
+			}
+		}
+	}
+	return code
+}
+
+func TestCompactRoundTrip(t *testing.T) {
+	cases := []struct {
+		name string
+		code []gvm.Code
+		// Size of the encoded code in bytes, or 0 not to check it
+		size int
+	}{
+		{"empty", []gvm.Code{}, 0},
+		{"inc", []gvm.Code{lang.Inc, 1}, 2},
+		{"two registers", []gvm.Code{lang.Add, 15, 0}, 2},
+		{"constant and register", []gvm.Code{lang.Const, -1, 3}, 3},
+		{"large constant", []gvm.Code{lang.Const, math.MinInt64, 3}, 12},
+		{"label and register", []gvm.Code{lang.Try, 3, 15, lang.Endtry}, 4},
+		{"every instruction", everyInstruction(), 0},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			data, err := encodeCompact(c.code)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.size > 0 && len(data) != c.size {
+				t.Errorf("encoded into %d bytes, expected %d", len(data), c.size)
+			}
+
+			code, offsets, err := decodeCompact(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(code, c.code) {
+				t.Errorf("decoded %v, expected %v", code, c.code)
+			}
+
+			// Offsets are given for the start of every instruction and the end
+			position := int64(0)
+			for position < int64(len(code)) {
+				if _, ok := offsets[position]; !ok {
+					t.Errorf("no offset for the instruction at %d", position)
+				}
+				kinds, _ := lang.Operands(code[position])
+				position += 1 + int64(len(kinds))
+			}
+			if offsets[position] != int64(len(data)) {
+				t.Errorf("offset of the end is %d, expected %d", offsets[position], len(data))
+			}
+		})
+	}
+}
+
+func TestEncodeCompactErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		code []gvm.Code
+		err  string
+	}{
+		{"unknown instruction", []gvm.Code{lang.Noop, 9999}, "unknown instruction 9999 at 1"},
+		{"missing operands", []gvm.Code{lang.Mov, 1}, "missing operands at 0"},
+		{"register too large", []gvm.Code{lang.Inc, 16}, "register index 16 at 0"},
+		{"negative register", []gvm.Code{lang.Mov, 1, -1}, "register index -1 at 0"},
+	}
+
+	for _, c := range cases {
+		if _, err := encodeCompact(c.code); err == nil || !strings.HasPrefix(err.Error(), c.err) {
+			t.Errorf("%s: got %v, expected %q", c.name, err, c.err)
+		}
+	}
+}
+
+func TestDecodeCompactErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{"unknown instruction", []byte{0xff}, "unknown instruction 255 at byte 0"},
+		{"missing register", []byte{byte(lang.Noop), byte(lang.Inc)}, "missing operands at byte 1"},
+		{"missing constant", []byte{byte(lang.Const), 0x10}, "missing operands at byte 0"},
+		{"truncated constant", []byte{byte(lang.Const), 0x10, 0x80}, "missing operands at byte 0"},
+	}
+
+	for _, c := range cases {
+		if _, _, err := decodeCompact(c.data); err == nil || err.Error() != c.err {
+			t.Errorf("%s: got %v, expected %q", c.name, err, c.err)
+		}
+	}
+}
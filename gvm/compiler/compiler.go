@@ -6,14 +6,12 @@ import (
 	"github.com/vsartor/gvm/gvm"
 	"github.com/vsartor/gvm/gvm/lang"
 	"os"
-	"path"
-	"strings"
 )
 
 func assertArgCount(instruction gvm.Code, expectedCount, argCount int, ctxt gvm.Context) {
 	if expectedCount != argCount {
-		gvm.Logger.Criticalf("%s.%d: Token `%s` expected %d arguments, got %d.\n",
-			ctxt.FileName, ctxt.LineNum, lang.ToString(instruction), expectedCount, argCount)
+		gvm.Logger.Criticalf("%s: Token `%s` expected %d arguments, got %d.\n",
+			ctxt, lang.ToString(instruction), expectedCount, argCount)
 		os.Exit(1)
 	}
 }
@@ -22,76 +20,336 @@ func expandSublabel(sublabel, lastLabel string) string {
 	return lastLabel + sublabel
 }
 
-func compile(src *os.File, ctxt gvm.Context) []gvm.Code {
-	gvm.Logger.Infof("Parsing file '%s'.\n", src.Name())
-
-	code := make([]gvm.Code, 0, gvm.CodeArrayInitialSize)
-
-	// Because we may need to add the `jmp main` tokens in case a
-	// `main` label is present, let's save the space for this instruction
-	// by adding in two `noop`'s.
-	code = append(code, lang.Noop)
-	code = append(code, lang.Noop)
-
-	labelToPosition := make(map[string]int64)
-	positionToLabel := make(map[int64]string)
+// sourceLine is a statement read from a line of source, split into the
+// instruction or directive and its operands, or holding a single label.
+type sourceLine struct {
+	operands []operand
+	ctxt     gvm.Context
+}
 
-	lastLabel := ""
-	currCodePosition := int64(2)
+func readLines(src *os.File, ctxt gvm.Context) []sourceLine {
+	lines := make([]sourceLine, 0)
 	ctxt.LineNum = 0
 
-	gvm.Logger.Infof("Parser pass starting.\n")
-
 	scanner := bufio.NewScanner(src)
 	for scanner.Scan() {
 		ctxt.LineNum++
 
-		line := scanner.Text()
-		tokens := strings.Fields(line)
+		statements, err := splitLine(scanner.Text())
+		if err != nil {
+			gvm.Logger.Criticalf("%s: Syntax error: %s.\n", ctxt, err.Error())
+			os.Exit(1)
+		}
 
-		// Skip empty lines straight away
-		if len(tokens) == 0 {
-			continue
+		for _, operands := range statements {
+			lines = append(lines, sourceLine{operands, ctxt})
 		}
+	}
 
-		// Remove comments if there are any
-		for idx, token := range tokens {
-			if token[0] == ';' {
-				tokens = tokens[:idx]
-			}
+	if err := scanner.Err(); err != nil {
+		gvm.Logger.Criticalf("Error while reading the file: %s.\n", err.Error())
+		os.Exit(1)
+	}
+
+	return lines
+}
+
+// fixup is an operand whose value depends on the positions of labels, which
+// is filled in once all labels of the object are known.
+type fixup struct {
+	position int64
+	value    linear
+	ctxt     gvm.Context
+}
+
+// resolveLocal replaces the labels defined by the object by their positions,
+// returning the resulting constant, the total weight of the replaced labels
+// and the labels left unresolved.
+func resolveLocal(obj *object, value linear) (int64, int64, map[string]int64) {
+	constant, degree := value.constant, int64(0)
+	remaining := make(map[string]int64)
+
+	for name, weight := range value.labels {
+		if position, ok := obj.symbols[name]; ok {
+			constant += weight * position
+			degree += weight
+		} else {
+			remaining[name] = weight
+		}
+	}
+
+	return constant, degree, remaining
+}
+
+// resolveFixup writes the value of an operand into the code if it is already
+// known, or adds a relocation so that the linker can complete it. Only values
+// relative to the position of a single label can be relocated, which covers
+// plain references to labels as well as differences between labels.
+func resolveFixup(obj *object, fix fixup) {
+	constant, degree, remaining := resolveLocal(obj, fix.value)
+
+	for _, name := range sortedWeights(remaining) {
+		if !obj.externs[name] {
+			gvm.Logger.Criticalf("%s: Reference to unknown label '%s'.\n", fix.ctxt, name)
+			os.Exit(1)
+		}
+	}
+
+	switch {
+	case len(remaining) == 0 && degree == 0:
+		obj.code[fix.position] = gvm.Code(constant)
+	case len(remaining) == 0 && degree == 1:
+		// Relocate relative to any of the labels, the linker moves them all
+		// by the same amount
+		anchor := sortedWeights(fix.value.labels)[0]
+		rel := relocation{fix.position, anchor, constant - obj.symbols[anchor], &fix.ctxt}
+		obj.relocations = append(obj.relocations, rel)
+	case len(remaining) == 1 && degree == 0:
+		external := sortedWeights(remaining)[0]
+		if remaining[external] == 1 {
+			rel := relocation{fix.position, external, constant, &fix.ctxt}
+			obj.relocations = append(obj.relocations, rel)
+			break
+		}
+		fallthrough
+	default:
+		gvm.Logger.Criticalf("%s: Value depends on label positions in a way that can't be relocated.\n",
+			fix.ctxt)
+		os.Exit(1)
+	}
+}
+
+func sortedWeights(weights map[string]int64) []string {
+	set := make(map[string]bool)
+	for name := range weights {
+		set[name] = true
+	}
+	return sortedNames(set)
+}
+
+// registerAliases tracks the aliases given to registers, which are valid from
+// their definition until they are removed or a new label starts a new scope.
+type registerAliases struct {
+	registers map[string]gvm.Code
+	starts    map[string]int64
+}
+
+func newRegisterAliases() *registerAliases {
+	return &registerAliases{make(map[string]gvm.Code), make(map[string]int64)}
+}
+
+// remove drops an alias, recording the range of code it was valid for.
+func (aliases *registerAliases) remove(name string, position int64, debug *gvm.DebugInfo) {
+	if start := aliases.starts[name]; start < position {
+		debug.Aliases = append(debug.Aliases, gvm.AliasEntry{
+			Name: name, Register: int64(aliases.registers[name]), Start: start, End: position,
+		})
+	}
+	delete(aliases.registers, name)
+	delete(aliases.starts, name)
+}
+
+func (aliases *registerAliases) removeAll(position int64, debug *gvm.DebugInfo) {
+	for _, name := range sortedWeights(aliases.starts) {
+		aliases.remove(name, position, debug)
+	}
+}
+
+// defineAlias handles the `.alias` and `.unalias` directives.
+func defineAlias(aliases *registerAliases, operands []operand, position int64, debug *gvm.DebugInfo,
+	ctxt gvm.Context) {
+	if operands[0].String() == ".unalias" {
+		if len(operands) != 2 {
+			gvm.Logger.Criticalf("%s: `.unalias` expects a name.\n", ctxt)
+			os.Exit(1)
+		}
+		name := operands[1].String()
+		if _, ok := aliases.registers[name]; !ok {
+			gvm.Logger.Criticalf("%s: Unknown alias '%s' at column %d.\n", ctxt, name, operands[1][0].column)
+			os.Exit(1)
+		}
+		aliases.remove(name, position, debug)
+		return
+	}
+
+	if len(operands) != 3 {
+		gvm.Logger.Criticalf("%s: `.alias` expects a name and a register.\n", ctxt)
+		os.Exit(1)
+	}
+
+	name := operands[1].String()
+	if !isIdentifier(name) || isRegisterName(name) {
+		gvm.Logger.Criticalf("%s: Invalid alias name '%s' at column %d.\n", ctxt, name, operands[1][0].column)
+		os.Exit(1)
+	}
+	if _, ok := aliases.registers[name]; ok {
+		gvm.Logger.Criticalf("%s: Attempt to overwrite alias '%s', use `.unalias` first.\n", ctxt, name)
+		os.Exit(1)
+	}
+
+	// Aliases can't be defined in terms of other aliases
+	reg := parseRegister(operands[2], nil, ctxt)
+	gvm.Logger.Debugf("%s: Read alias %s for r%d.", ctxt, name, reg)
+	aliases.registers[name] = reg
+	aliases.starts[name] = position
+}
+
+// defineConstant handles the `.equ` and `.set` directives. Constants defined
+// with `.equ` can't be changed, while those defined with `.set` can be set
+// again further down.
+func defineConstant(obj *object, constants map[string]int64, mutable map[string]bool,
+	operands []operand, resolve func(name string) (linear, error), ctxt gvm.Context) {
+	directive := operands[0].String()
+	if len(operands) != 3 {
+		gvm.Logger.Criticalf("%s: `%s` expects a name and a value.\n", ctxt, directive)
+		os.Exit(1)
+	}
+
+	name := operands[1].String()
+	if !isIdentifier(name) || isRegisterName(name) {
+		gvm.Logger.Criticalf("%s: Invalid constant name '%s' at column %d.\n", ctxt, name, operands[1][0].column)
+		os.Exit(1)
+	}
+	if _, ok := obj.symbols[name]; ok {
+		gvm.Logger.Criticalf("%s: Constant '%s' clashes with a label.\n", ctxt, name)
+		os.Exit(1)
+	}
+	if _, ok := constants[name]; ok && (directive == ".equ" || !mutable[name]) {
+		gvm.Logger.Criticalf("%s: Attempt to overwrite constant '%s'.\n", ctxt, name)
+		os.Exit(1)
+	}
+
+	// Labels already defined can be used as long as the result doesn't depend
+	// on where the object ends up, e.g. the difference between two labels
+	value := parseValue(operands[2], resolve, ctxt)
+	constant, degree, remaining := resolveLocal(obj, value)
+	if len(remaining) != 0 || degree != 0 {
+		gvm.Logger.Criticalf("%s: Value of constant '%s' is not known at this point.\n", ctxt, name)
+		os.Exit(1)
+	}
+
+	gvm.Logger.Debugf("%s: Read constant %s = %d.", ctxt, name, constant)
+	constants[name] = constant
+	mutable[name] = directive == ".set"
+}
+
+// declareSymbols handles the `.global` and `.extern` directives.
+func declareSymbols(obj *object, operands []operand, lastLabel string, ctxt gvm.Context) {
+	directive := operands[0].String()
+	if len(operands) < 2 {
+		gvm.Logger.Criticalf("%s: `%s` expects at least one label.\n", ctxt, directive)
+		os.Exit(1)
+	}
+
+	for _, op := range operands[1:] {
+		labelName := op.String()
+		if labelName[0] == '.' {
+			labelName = expandSublabel(labelName, lastLabel)
+		}
+		if directive == ".global" {
+			obj.globals[labelName] = true
+		} else {
+			obj.externs[labelName] = true
+		}
+	}
+}
+
+func compile(lines []sourceLine, name string) *object {
+	obj := newObject(name)
+	code := obj.code
+	labelToPosition := obj.symbols
+	debug := obj.debug
+
+	lastLabel := ""
+	currCodePosition := int64(0)
+	constants := make(map[string]int64)
+	mutable := make(map[string]bool)
+	aliases := newRegisterAliases()
+	fixups := make([]fixup, 0)
+
+	// Names within expressions refer to constants if one is defined with the
+	// name, and to labels otherwise
+	resolve := func(name string) (linear, error) {
+		if value, ok := constants[name]; ok {
+			return constantValue(value), nil
+		}
+		if name[0] == '.' {
+			name = expandSublabel(name, lastLabel)
+		}
+		return labelValue(name), nil
+	}
+
+	// Adds the value of an operand to the code, leaving a placeholder to be
+	// filled in later on if it depends on the position of labels
+	appendValue := func(op operand, ctxt gvm.Context) {
+		value := parseValue(op, resolve, ctxt)
+		if value.isConstant() {
+			code = append(code, gvm.Code(value.constant))
+		} else {
+			fixups = append(fixups, fixup{int64(len(code)), value, ctxt})
+			code = append(code, 0)
 		}
+	}
+
+	gvm.Logger.Infof("Macro pass starting.\n")
+
+	lines = expandMacros(lines)
+
+	gvm.Logger.Infof("Parser pass starting.\n")
 
-		// Remove lines which became empty after removing comments
-		if len(tokens) == 0 {
+	for _, line := range lines {
+		operands, ctxt := line.operands, line.ctxt
+
+		// Check if line contains a directive
+		switch operands[0].String() {
+		case ".global", ".extern":
+			declareSymbols(obj, operands, lastLabel, ctxt)
+			continue
+		case ".equ", ".set":
+			defineConstant(obj, constants, mutable, operands, resolve, ctxt)
+			continue
+		case ".alias", ".unalias":
+			defineAlias(aliases, operands, currCodePosition, debug, ctxt)
 			continue
 		}
 
 		// Check if line contains a label
-		if tok := tokens[0]; tok[len(tok)-1] == ':' {
-			labelName := tok[:len(tok)-1]
-
-			if labelName[0] == '.' {
+		if labelName, ok := operands[0].label(); ok {
+			if labelName[0] == '@' {
+				// Labels local to a macro expansion are already unique and do
+				// not start a new scope for sublabels
+				gvm.Logger.Debugf("%s: Read macro label %s at %d.",
+					ctxt, labelName, currCodePosition)
+			} else if labelName[0] == '.' {
 				//  If it's a sublabel, expand its name to include the labelName
 				if len(lastLabel) == 0 {
-					gvm.Logger.Criticalf("%s.%d: Orphan sublabel '%s' found.",
-						ctxt.FileName, ctxt.LineNum, labelName)
+					gvm.Logger.Criticalf("%s: Orphan sublabel '%s' found.",
+						ctxt, labelName)
 					os.Exit(1)
 				}
 				labelName = expandSublabel(labelName, lastLabel)
 
-				gvm.Logger.Debugf("%s.%d: Read sublabel %s at %d.",
-					ctxt.FileName, ctxt.LineNum, labelName, currCodePosition)
+				gvm.Logger.Debugf("%s: Read sublabel %s at %d.",
+					ctxt, labelName, currCodePosition)
 			} else {
 				// Remember the last labelName
-				gvm.Logger.Debugf("%s.%d: Read label %s at %d.",
-					ctxt.FileName, ctxt.LineNum, labelName, currCodePosition)
+				gvm.Logger.Debugf("%s: Read label %s at %d.",
+					ctxt, labelName, currCodePosition)
 				lastLabel = labelName
+
+				// Aliases are scoped to a label and its sublabels
+				aliases.removeAll(currCodePosition, debug)
 			}
 
 			// Do not allow multiple instances of the same labelName
 			if _, ok := labelToPosition[labelName]; ok {
-				gvm.Logger.Criticalf("%s.%d: Attempt to overwrite label '%s'.",
-					ctxt.FileName, ctxt.LineNum, labelName)
+				gvm.Logger.Criticalf("%s: Attempt to overwrite label '%s'.",
+					ctxt, labelName)
+				os.Exit(1)
+			}
+			if _, ok := constants[labelName]; ok {
+				gvm.Logger.Criticalf("%s: Label '%s' clashes with a constant.",
+					ctxt, labelName)
 				os.Exit(1)
 			}
 
@@ -99,88 +357,109 @@ func compile(src *os.File, ctxt gvm.Context) []gvm.Code {
 			continue
 		}
 
+		// Remember where the instruction came from, as written by the user
+		debug.AddLine(currCodePosition, ctxt.Origin())
+
 		// Parse the instruction
-		switch instruction := parseInstruction(tokens[0], ctxt); instruction {
-		case lang.Halt, lang.Ret, lang.Noop:
-			assertArgCount(instruction, 1, len(tokens), ctxt)
+		switch instruction := parseInstruction(operands[0].String(), ctxt); instruction {
+		case lang.Halt, lang.Ret, lang.Noop, lang.Endtry:
+			assertArgCount(instruction, 1, len(operands), ctxt)
 			code = append(code, instruction)
 			currCodePosition++
 		case lang.Const:
-			assertArgCount(instruction, 3, len(tokens), ctxt)
+			assertArgCount(instruction, 3, len(operands), ctxt)
 			code = append(code, instruction)
-			code = append(code, parseInt(tokens[1], ctxt))
-			code = append(code, parseRegister(tokens[2], ctxt))
+			appendValue(operands[1], ctxt)
+			code = append(code, parseRegister(operands[2], aliases.registers, ctxt))
 			currCodePosition += 3
-		case lang.Mov, lang.Add, lang.Sub, lang.Mul, lang.Div, lang.Rem, lang.Cmp:
-			assertArgCount(instruction, 3, len(tokens), ctxt)
+		case lang.Mov, lang.Add, lang.Sub, lang.Mul, lang.Div, lang.Rem, lang.Cmp,
+			lang.Cmoveq, lang.Cmovne, lang.Cmovgt, lang.Cmovlt, lang.Cmovge, lang.Cmovle,
+			lang.Cmovb, lang.Cmova, lang.Cmovbe, lang.Cmovae:
+			assertArgCount(instruction, 3, len(operands), ctxt)
 			code = append(code, instruction)
-			code = append(code, parseRegister(tokens[1], ctxt))
-			code = append(code, parseRegister(tokens[2], ctxt))
+			code = append(code, parseRegister(operands[1], aliases.registers, ctxt))
+			code = append(code, parseRegister(operands[2], aliases.registers, ctxt))
 			currCodePosition += 3
-		case lang.Jmp, lang.Jeq, lang.Jne, lang.Jgt, lang.Jlt, lang.Jge, lang.Jle, lang.Jerr, lang.Call:
-			assertArgCount(instruction, 2, len(tokens), ctxt)
+		case lang.Jmp, lang.Jeq, lang.Jne, lang.Jgt, lang.Jlt, lang.Jge, lang.Jle, lang.Jerr, lang.Call,
+			lang.Jb, lang.Ja, lang.Jbe, lang.Jae:
+			assertArgCount(instruction, 2, len(operands), ctxt)
 			code = append(code, instruction)
-			// Add a placeholder for the code srcPosition
-			// There will be a pass later to fill it in
-			code = append(code, 0)
-
-			// Save information for latter pass so that we can fill in the
-			// correct code srcPosition later on, making sure we expand the
-			labelName := tokens[1]
-			if labelName[0] == '.' {
-				positionToLabel[currCodePosition+1] = expandSublabel(labelName, lastLabel)
-			} else {
-				positionToLabel[currCodePosition+1] = labelName
+			// The target is usually a label, in which case a placeholder is
+			// added and filled in later on
+			appendValue(operands[1], ctxt)
+			currCodePosition += 2
+		case lang.Try:
+			assertArgCount(instruction, 3, len(operands), ctxt)
+			code = append(code, instruction)
+			// Same as for jumps, the handler position is filled in later
+			appendValue(operands[1], ctxt)
+			code = append(code, parseRegister(operands[2], aliases.registers, ctxt))
+			currCodePosition += 3
+		case lang.Trap:
+			assertArgCount(instruction, 2, len(operands), ctxt)
+			// Negative codes are left for the faults raised by the GVM itself
+			if value := parseValue(operands[1], resolve, ctxt); value.isConstant() && value.constant < 0 {
+				gvm.Logger.Criticalf("%s: Trap code %d is negative, which is reserved for the GVM's own faults.\n",
+					ctxt, value.constant)
+				os.Exit(1)
 			}
+			code = append(code, instruction)
+			appendValue(operands[1], ctxt)
 			currCodePosition += 2
-		case lang.Show, lang.Inc, lang.Dec, lang.Push, lang.Pop, lang.Iarg:
-			assertArgCount(instruction, 2, len(tokens), ctxt)
+		case lang.Show, lang.Inc, lang.Dec, lang.Push, lang.Pop, lang.Iarg, lang.Assert, lang.Throw,
+			lang.Seteq, lang.Setne, lang.Setgt, lang.Setlt, lang.Setge, lang.Setle,
+			lang.Setb, lang.Seta, lang.Setbe, lang.Setae:
+			assertArgCount(instruction, 2, len(operands), ctxt)
 			code = append(code, instruction)
-			code = append(code, parseRegister(tokens[1], ctxt))
+			code = append(code, parseRegister(operands[1], aliases.registers, ctxt))
 			currCodePosition += 2
 		default:
-			gvm.Logger.Criticalf("%s.%d: Unknown instruction code %d.",
-				ctxt.FileName, ctxt.LineNum, instruction)
+			gvm.Logger.Criticalf("%s: Unknown instruction code %d.",
+				ctxt, instruction)
 			os.Exit(1)
 		}
 	}
 
-	if err := scanner.Err(); err != nil {
-		gvm.Logger.Criticalf("Error while reading the file: %s.\n", err.Error())
-		os.Exit(1)
-	}
+	aliases.removeAll(currCodePosition, debug)
 
 	gvm.Logger.Infof("Label pass starting.\n")
 
-	// Check if `main` was defined. If it has, change the `noop`s into the correct
-	// instruction.
-	if mainPosition, ok := labelToPosition["main"]; ok {
-		code[0] = lang.Jmp
-		code[1] = gvm.Code(mainPosition)
-	} else {
-		gvm.Logger.Infof("The label `main` was not defined.\n")
+	obj.code = code
+
+	// The entry point is always visible to the linker
+	if _, ok := labelToPosition[entryLabel]; ok {
+		obj.globals[entryLabel] = true
 	}
 
-	// Fill in code positions based on the labels
-	for srcPosition, label := range positionToLabel {
-		dstPosition, ok := labelToPosition[label]
-		if !ok {
-			gvm.Logger.Criticalf("At position %d reference to unknown label '%s'.", srcPosition, label)
+	for _, labelName := range sortedNames(obj.globals) {
+		if _, ok := labelToPosition[labelName]; !ok {
+			gvm.Logger.Criticalf("Label '%s' declared as global but never defined.\n", labelName)
+			os.Exit(1)
+		}
+	}
+	for _, labelName := range sortedNames(obj.externs) {
+		if _, ok := labelToPosition[labelName]; ok {
+			gvm.Logger.Criticalf("Label '%s' declared as extern but defined.\n", labelName)
 			os.Exit(1)
 		}
-		code[srcPosition] = gvm.Code(dstPosition)
+	}
+
+	// References to labels must be resolvable either within the object or,
+	// for those declared as extern, by the linker
+	for _, fix := range fixups {
+		resolveFixup(obj, fix)
 	}
 
 	gvm.Logger.Infof("Finished parsing.\n")
 
-	return code
+	return obj
 }
 
-func writeCode(code []gvm.Code, output *os.File) {
-	gvm.Logger.Infof("Writing binary file.\n")
-
+// writeCodeArray writes the header identifying the kind of file followed by
+// the code array.
+func writeCodeArray(header int64, code []gvm.Code, output *os.File) {
 	// Header
-	err := binary.Write(output, binary.LittleEndian, gvm.BinaryFileHeader)
+	err := binary.Write(output, binary.LittleEndian, header)
 	if err != nil {
 		gvm.Logger.Criticalf("Failed writting header: %s\n", err.Error())
 		os.Exit(1)
@@ -201,28 +480,59 @@ func writeCode(code []gvm.Code, output *os.File) {
 			os.Exit(1)
 		}
 	}
+}
+
+func writeCode(program gvm.Program, output *os.File) {
+	gvm.Logger.Infof("Writing binary file.\n")
+
+	// Fall back to a code array for code the compact encoding can't express
+	data, err := encodeCompact(program.Code)
+	if err != nil {
+		gvm.Logger.Warningf("Not using the compact encoding: %s.\n", err.Error())
+		writeCodeArray(gvm.BinaryFileHeader, program.Code, output)
+	} else {
+		writeCompactCode(data, output)
+	}
+
+	// Debug information, if any
+	if program.Debug != nil {
+		err = writeDebugInfo(program.Debug, output)
+		if err != nil {
+			gvm.Logger.Criticalf("Failed writting debug information: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
 
 	gvm.Logger.Infof("Finished writting binary file.\n")
 }
 
-func ReadCode(file *os.File) []gvm.Code {
-	gvm.Logger.Infof("Reading binary file.\n")
-
-	// Read and validate header
+func readHeader(file *os.File) int64 {
 	var header int64
 	err := binary.Read(file, binary.LittleEndian, &header)
 	if err != nil {
 		gvm.Logger.Criticalf("Failed reading header: %s\n", err.Error())
 		os.Exit(1)
 	}
-	if header != gvm.BinaryFileHeader {
-		gvm.Logger.Criticalf("Expected header %d but got %d.\n", gvm.BinaryFileHeader, header)
+	return header
+}
+
+// readCodeArray validates the header identifying the kind of file and reads
+// the code array following it.
+func readCodeArray(expectedHeader int64, file *os.File) []gvm.Code {
+	header := readHeader(file)
+	if header != expectedHeader {
+		gvm.Logger.Criticalf("Expected header %d but got %d.\n", expectedHeader, header)
 		os.Exit(1)
 	}
 
+	return readCodeWords(file)
+}
+
+// readCodeWords reads a code array, following the header of the file.
+func readCodeWords(file *os.File) []gvm.Code {
 	// Read code size and allocate slice
 	var codeSize int64
-	err = binary.Read(file, binary.LittleEndian, &codeSize)
+	err := binary.Read(file, binary.LittleEndian, &codeSize)
 	if err != nil {
 		gvm.Logger.Criticalf("Failed reading code size: %s\n", err.Error())
 		os.Exit(1)
@@ -238,24 +548,93 @@ func ReadCode(file *os.File) []gvm.Code {
 		}
 	}
 
-	gvm.Logger.Infof("Finished reading binary file.\n")
-
 	return code
 }
 
-func Compile(srcPath, dstPath string) {
-	// Open source file
-	gvm.Logger.Infof("Opening '%s'.\n", srcPath)
-	input, err := os.Open(srcPath)
+func ReadCode(file *os.File) gvm.Program {
+	gvm.Logger.Infof("Reading binary file.\n")
+
+	// Binary files may either use the compact encoding or hold a code array
+	var program gvm.Program
+	switch header := readHeader(file); header {
+	case gvm.CompactFileHeader:
+		program.Code, program.Offsets = readCompactCode(file)
+	case gvm.BinaryFileHeader:
+		program.Code = readCodeWords(file)
+	default:
+		gvm.Logger.Criticalf("Expected header %d or %d but got %d.\n",
+			gvm.CompactFileHeader, gvm.BinaryFileHeader, header)
+		os.Exit(1)
+	}
+
+	// Read the debug information, if any
+	debug, err := readDebugInfo(file)
 	if err != nil {
-		gvm.Logger.Criticalf("Failed opening '%s': %s\n", srcPath, err.Error())
+		gvm.Logger.Criticalf("Failed reading debug information: %s\n", err.Error())
 		os.Exit(1)
 	}
-	defer input.Close()
+	program.Debug = debug
 
-	// Parse the file
-	ctxt := gvm.Context{FileName: path.Base(srcPath)}
-	code := compile(input, ctxt)
+	gvm.Logger.Infof("Finished reading binary file.\n")
+
+	return program
+}
+
+// Options holds the settings of a compilation.
+type Options struct {
+	// Directories searched for files included with `.include`
+	IncludeDirs []string
+	// Whether to produce an object file to be linked later instead of a
+	// binary file
+	Object bool
+	// Whether to apply peephole optimizations to the code
+	Optimize bool
+}
+
+// compileSources compiles the source files into a single object, as if each
+// of them was included in order.
+func compileSources(srcPaths []string, options Options) *object {
+	// Read the source files
+	reader := newSourceReader(options.IncludeDirs)
+	lines := make([]sourceLine, 0)
+	for _, srcPath := range srcPaths {
+		gvm.Logger.Infof("Parsing file '%s'.\n", srcPath)
+		lines = append(lines, reader.readFile(srcPath)...)
+	}
+
+	// Parse the lines
+	obj := compile(lines, srcPaths[0])
+	if options.Optimize {
+		optimize(obj)
+	}
+
+	return obj
+}
+
+// Build compiles the source files into a program without writing it to a
+// file, for tools which work on the compiled code.
+func Build(srcPaths []string, options Options) gvm.Program {
+	return link([]*object{compileSources(srcPaths, options)}, options.Optimize)
+}
+
+// IsBinaryFile reports whether the file at filePath is a GVM binary file, as
+// opposed to, for instance, a source file.
+func IsBinaryFile(filePath string) bool {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	var header int64
+	err = binary.Read(file, binary.LittleEndian, &header)
+	return err == nil && (header == gvm.BinaryFileHeader || header == gvm.CompactFileHeader)
+}
+
+// Compile compiles the source files into a single binary file, as if each of
+// them was included in order.
+func Compile(srcPaths []string, dstPath string, options Options) {
+	obj := compileSources(srcPaths, options)
 
 	// Create object file
 	gvm.Logger.Infof("Opening '%s'.\n", dstPath)
@@ -266,6 +645,11 @@ func Compile(srcPath, dstPath string) {
 	}
 	defer output.Close()
 
-	// Write it in binary form into output
-	writeCode(code, output)
+	// Write it in binary form into output, linking it by itself if a binary
+	// file is expected
+	if options.Object {
+		writeObject(obj, output)
+	} else {
+		writeCode(link([]*object{obj}, options.Optimize), output)
+	}
 }
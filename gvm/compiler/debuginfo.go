@@ -0,0 +1,334 @@
+package compiler
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/vsartor/gvm/gvm"
+	"io"
+	"io/ioutil"
+	"math"
+	"sort"
+)
+
+// The debug information is written after the code array as a sequence of
+// sections, each made of a tag, the size of its payload in bytes and the
+// payload itself. Readers skip sections with tags they don't know about, and
+// older readers simply ignore everything after the code array.
+const (
+	filesSectionTag int64 = iota + 1
+	linesSectionTag
+	symbolsSectionTag
+	aliasesSectionTag
+	// The same sections with their counts, sizes and positions written as
+	// varints, line entries being written relative to the previous one. These
+	// are the ones written, while the ones above are still read.
+	compactFilesSectionTag
+	compactLinesSectionTag
+	compactSymbolsSectionTag
+	compactAliasesSectionTag
+)
+
+func writeUvarint(buf *bytes.Buffer, value uint64) {
+	varint := make([]byte, binary.MaxVarintLen64)
+	buf.Write(varint[:binary.PutUvarint(varint, value)])
+}
+
+func writeVarint(buf *bytes.Buffer, value int64) {
+	varint := make([]byte, binary.MaxVarintLen64)
+	buf.Write(varint[:binary.PutVarint(varint, value)])
+}
+
+func writeCompactString(buf *bytes.Buffer, str string) {
+	writeUvarint(buf, uint64(len(str)))
+	buf.WriteString(str)
+}
+
+// readCount reads a varint which counts something, and so can't be negative
+// or larger than what int64 holds.
+func readCount(r io.ByteReader) (int64, error) {
+	value, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, err
+	}
+	if value > math.MaxInt64 {
+		return 0, errors.New("count out of range")
+	}
+	return int64(value), nil
+}
+
+func readCompactString(r *bufio.Reader) (string, error) {
+	size, err := readCount(r)
+	if err != nil {
+		return "", err
+	}
+
+	str := make([]byte, size)
+	if _, err := io.ReadFull(r, str); err != nil {
+		return "", err
+	}
+	return string(str), nil
+}
+
+func writeString(buf *bytes.Buffer, str string) {
+	_ = binary.Write(buf, binary.LittleEndian, int64(len(str)))
+	buf.WriteString(str)
+}
+
+func readString(r io.Reader) (string, error) {
+	var size int64
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return "", err
+	}
+	if size < 0 {
+		return "", errors.New("negative string length")
+	}
+
+	str := make([]byte, size)
+	if _, err := io.ReadFull(r, str); err != nil {
+		return "", err
+	}
+	return string(str), nil
+}
+
+func writeSection(output io.Writer, tag int64, payload *bytes.Buffer) error {
+	if err := binary.Write(output, binary.LittleEndian, tag); err != nil {
+		return err
+	}
+	if err := binary.Write(output, binary.LittleEndian, int64(payload.Len())); err != nil {
+		return err
+	}
+	_, err := output.Write(payload.Bytes())
+	return err
+}
+
+func writeDebugInfo(debug *gvm.DebugInfo, output io.Writer) error {
+	files := new(bytes.Buffer)
+	writeUvarint(files, uint64(len(debug.Files)))
+	for _, fileName := range debug.Files {
+		writeCompactString(files, fileName)
+	}
+	if err := writeSection(output, compactFilesSectionTag, files); err != nil {
+		return err
+	}
+
+	lines := new(bytes.Buffer)
+	writeUvarint(lines, uint64(len(debug.Lines)))
+	var previous gvm.LineEntry
+	for _, entry := range debug.Lines {
+		writeVarint(lines, entry.Position-previous.Position)
+		writeVarint(lines, entry.File)
+		writeVarint(lines, entry.Line-previous.Line)
+		previous = entry
+	}
+	if err := writeSection(output, compactLinesSectionTag, lines); err != nil {
+		return err
+	}
+
+	// Sort symbols by name so that compiling the same source always produces
+	// the same binary file.
+	names := make([]string, 0, len(debug.Symbols))
+	for name := range debug.Symbols {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	symbols := new(bytes.Buffer)
+	writeUvarint(symbols, uint64(len(names)))
+	for _, name := range names {
+		writeCompactString(symbols, name)
+		writeVarint(symbols, debug.Symbols[name])
+	}
+	if err := writeSection(output, compactSymbolsSectionTag, symbols); err != nil {
+		return err
+	}
+
+	aliases := new(bytes.Buffer)
+	writeUvarint(aliases, uint64(len(debug.Aliases)))
+	for _, alias := range debug.Aliases {
+		writeCompactString(aliases, alias.Name)
+		writeVarint(aliases, alias.Register)
+		writeVarint(aliases, alias.Start)
+		writeVarint(aliases, alias.End)
+	}
+	return writeSection(output, compactAliasesSectionTag, aliases)
+}
+
+func readDebugSection(tag int64, payload io.Reader, debug *gvm.DebugInfo) error {
+	if tag >= compactFilesSectionTag {
+		return readCompactDebugSection(tag, bufio.NewReader(payload), debug)
+	}
+
+	var count int64
+	if err := binary.Read(payload, binary.LittleEndian, &count); err != nil {
+		return err
+	}
+
+	for i := int64(0); i < count; i++ {
+		switch tag {
+		case filesSectionTag:
+			fileName, err := readString(payload)
+			if err != nil {
+				return err
+			}
+			debug.Files = append(debug.Files, fileName)
+		case linesSectionTag:
+			var entry gvm.LineEntry
+			if err := binary.Read(payload, binary.LittleEndian, &entry); err != nil {
+				return err
+			}
+			if entry.File < 0 || entry.File >= int64(len(debug.Files)) {
+				return fmt.Errorf("line entry references unknown file %d", entry.File)
+			}
+			debug.Lines = append(debug.Lines, entry)
+		case symbolsSectionTag:
+			name, err := readString(payload)
+			if err != nil {
+				return err
+			}
+			var position int64
+			if err := binary.Read(payload, binary.LittleEndian, &position); err != nil {
+				return err
+			}
+			debug.Symbols[name] = position
+		case aliasesSectionTag:
+			name, err := readString(payload)
+			if err != nil {
+				return err
+			}
+			values := make([]int64, 3)
+			if err := binary.Read(payload, binary.LittleEndian, values); err != nil {
+				return err
+			}
+			debug.Aliases = append(debug.Aliases, gvm.AliasEntry{
+				Name: name, Register: values[0], Start: values[1], End: values[2],
+			})
+		}
+	}
+
+	return nil
+}
+
+func readCompactDebugSection(tag int64, payload *bufio.Reader, debug *gvm.DebugInfo) error {
+	count, err := readCount(payload)
+	if err != nil {
+		return err
+	}
+
+	var previous gvm.LineEntry
+	for i := int64(0); i < count; i++ {
+		switch tag {
+		case compactFilesSectionTag:
+			fileName, err := readCompactString(payload)
+			if err != nil {
+				return err
+			}
+			debug.Files = append(debug.Files, fileName)
+		case compactLinesSectionTag:
+			values, err := readVarints(payload, 3)
+			if err != nil {
+				return err
+			}
+			entry := gvm.LineEntry{
+				Position: previous.Position + values[0], File: values[1], Line: previous.Line + values[2],
+			}
+			if entry.File < 0 || entry.File >= int64(len(debug.Files)) {
+				return fmt.Errorf("line entry references unknown file %d", entry.File)
+			}
+			debug.Lines = append(debug.Lines, entry)
+			previous = entry
+		case compactSymbolsSectionTag:
+			name, err := readCompactString(payload)
+			if err != nil {
+				return err
+			}
+			position, err := binary.ReadVarint(payload)
+			if err != nil {
+				return err
+			}
+			debug.Symbols[name] = position
+		case compactAliasesSectionTag:
+			name, err := readCompactString(payload)
+			if err != nil {
+				return err
+			}
+			values, err := readVarints(payload, 3)
+			if err != nil {
+				return err
+			}
+			debug.Aliases = append(debug.Aliases, gvm.AliasEntry{
+				Name: name, Register: values[0], Start: values[1], End: values[2],
+			})
+		}
+	}
+
+	return nil
+}
+
+func readVarints(r io.ByteReader, count int) ([]int64, error) {
+	values := make([]int64, count)
+	for idx := range values {
+		value, err := binary.ReadVarint(r)
+		if err != nil {
+			return nil, err
+		}
+		values[idx] = value
+	}
+	return values, nil
+}
+
+// readSections reads the sections following the code array until the end of
+// input, calling handle with the payload of each of them. Whatever is left of
+// the payload once handle returns is skipped.
+func readSections(input io.Reader, handle func(tag int64, payload io.Reader) error) error {
+	for {
+		var tag, size int64
+		err := binary.Read(input, binary.LittleEndian, &tag)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err = binary.Read(input, binary.LittleEndian, &size); err != nil {
+			return err
+		}
+		if size < 0 {
+			return fmt.Errorf("section %d has negative size", tag)
+		}
+
+		payload := io.LimitReader(input, size)
+		if err = handle(tag, payload); err != nil {
+			return fmt.Errorf("section %d: %s", tag, err.Error())
+		}
+		if _, err = io.Copy(ioutil.Discard, payload); err != nil {
+			return err
+		}
+	}
+}
+
+func isDebugSection(tag int64) bool {
+	return filesSectionTag <= tag && tag <= compactAliasesSectionTag
+}
+
+// readDebugInfo reads the sections following the code array, returning nil
+// if the file has none.
+func readDebugInfo(input io.Reader) (*gvm.DebugInfo, error) {
+	var debug *gvm.DebugInfo
+
+	err := readSections(input, func(tag int64, payload io.Reader) error {
+		if !isDebugSection(tag) {
+			return nil
+		}
+		if debug == nil {
+			debug = gvm.NewDebugInfo()
+		}
+		return readDebugSection(tag, payload, debug)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return debug, nil
+}
@@ -0,0 +1,34 @@
+package compiler
+
+import (
+	"bytes"
+	"github.com/vsartor/gvm/gvm"
+	"reflect"
+	"testing"
+)
+
+func TestDebugInfoRoundTrip(t *testing.T) {
+	debug := &gvm.DebugInfo{
+		Files: []string{"main.gsm", "lib/io.gsm"},
+		Lines: []gvm.LineEntry{
+			{Position: 0, File: 0, Line: 3},
+			{Position: 3, File: 0, Line: 4},
+			{Position: 5, File: 1, Line: 120},
+			{Position: 300, File: 0, Line: 1},
+		},
+		Symbols: map[string]int64{"main": 0, "main.loop": 3, "print": 5},
+		Aliases: []gvm.AliasEntry{{Name: "count", Register: 15, Start: 3, End: 300}},
+	}
+
+	var buf bytes.Buffer
+	if err := writeDebugInfo(debug, &buf); err != nil {
+		t.Fatal(err)
+	}
+	read, err := readDebugInfo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, debug) {
+		t.Errorf("read %+v, expected %+v", read, debug)
+	}
+}
@@ -0,0 +1,275 @@
+package compiler
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// linear is the value of an expression as a constant plus a weighted sum of
+// label positions, which are only known once the code is laid out.
+type linear struct {
+	constant int64
+	labels   map[string]int64
+}
+
+func constantValue(value int64) linear {
+	return linear{constant: value}
+}
+
+func labelValue(name string) linear {
+	return linear{labels: map[string]int64{name: 1}}
+}
+
+func (value linear) isConstant() bool {
+	return len(value.labels) == 0
+}
+
+// combine returns lhs + factor * rhs, dropping labels whose weights cancel out.
+func combine(lhs linear, factor int64, rhs linear) linear {
+	result := linear{constant: lhs.constant + factor*rhs.constant, labels: make(map[string]int64)}
+	for name, weight := range lhs.labels {
+		result.labels[name] += weight
+	}
+	for name, weight := range rhs.labels {
+		result.labels[name] += factor * weight
+	}
+	for name, weight := range result.labels {
+		if weight == 0 {
+			delete(result.labels, name)
+		}
+	}
+	return result
+}
+
+// isSymbol reports whether a name token refers to a constant or label, rather
+// than to a macro parameter left unexpanded.
+func isSymbol(repr string) bool {
+	return !strings.ContainsRune(repr, '\\')
+}
+
+// parseNumber parses decimal, hexadecimal (0x), binary (0b) and octal (0o)
+// literals, which may use underscores as separators. Literals that only fit
+// in 64 bits as unsigned integers wrap around.
+func parseNumber(repr string) (int64, error) {
+	if len(repr) > 1 && repr[0] == '0' && '0' <= repr[1] && repr[1] <= '9' {
+		// Avoid C-style octal literals silently changing the value
+		return 0, fmt.Errorf("invalid number '%s' (octal literals use the prefix 0o)", repr)
+	}
+
+	value, err := strconv.ParseInt(repr, 0, 64)
+	if err == nil {
+		return value, nil
+	}
+
+	unsigned, uerr := strconv.ParseUint(repr, 0, 64)
+	if uerr == nil {
+		return int64(unsigned), nil
+	}
+
+	return 0, fmt.Errorf("invalid number '%s'", repr)
+}
+
+func parseChar(repr string) (int64, error) {
+	value, _, tail, err := strconv.UnquoteChar(repr[1:len(repr)-1], '\'')
+	if err != nil || len(tail) != 0 {
+		return 0, fmt.Errorf("invalid character literal %s", repr)
+	}
+	return int64(value), nil
+}
+
+// exprParser is a recursive descent parser which evaluates the expression as
+// it goes. Operators follow the precedence of C, from lowest to highest:
+// `|`, `^`, `&`, shifts, additive, multiplicative and unary operators.
+type exprParser struct {
+	tokens  []token
+	pos     int
+	resolve func(name string) (linear, error)
+}
+
+func (parser *exprParser) peekOperator(ops ...string) string {
+	if parser.pos == len(parser.tokens) || parser.tokens[parser.pos].kind != operatorToken {
+		return ""
+	}
+	for _, op := range ops {
+		if parser.tokens[parser.pos].text == op {
+			return op
+		}
+	}
+	return ""
+}
+
+// binaryLevels lists the binary operators of each precedence level, from the
+// lowest to the highest.
+var binaryLevels = [][]string{
+	{"|"},
+	{"^"},
+	{"&"},
+	{"<<", ">>"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (parser *exprParser) parseBinary(level int) (linear, error) {
+	if level == len(binaryLevels) {
+		return parser.parseUnary()
+	}
+
+	lhs, err := parser.parseBinary(level + 1)
+	if err != nil {
+		return linear{}, err
+	}
+
+	for {
+		op := parser.peekOperator(binaryLevels[level]...)
+		if op == "" {
+			return lhs, nil
+		}
+		column := parser.tokens[parser.pos].column
+		parser.pos++
+
+		rhs, err := parser.parseBinary(level + 1)
+		if err != nil {
+			return linear{}, err
+		}
+		if lhs, err = applyBinary(op, lhs, rhs); err != nil {
+			return linear{}, fmt.Errorf("%s at column %d", err.Error(), column)
+		}
+	}
+}
+
+func applyBinary(op string, lhs, rhs linear) (linear, error) {
+	switch op {
+	case "+":
+		return combine(lhs, 1, rhs), nil
+	case "-":
+		return combine(lhs, -1, rhs), nil
+	case "*":
+		// Scaling label positions is fine as long as one side is a constant
+		if lhs.isConstant() {
+			return combine(constantValue(0), lhs.constant, rhs), nil
+		} else if rhs.isConstant() {
+			return combine(constantValue(0), rhs.constant, lhs), nil
+		}
+	}
+
+	if !lhs.isConstant() || !rhs.isConstant() {
+		return linear{}, fmt.Errorf("operator '%s' can't be applied to label positions", op)
+	}
+
+	a, b := lhs.constant, rhs.constant
+	switch op {
+	case "*":
+		return constantValue(a * b), nil
+	case "/", "%":
+		if b == 0 {
+			return linear{}, errors.New("division by zero")
+		}
+		if op == "/" {
+			return constantValue(a / b), nil
+		}
+		return constantValue(a % b), nil
+	case "<<", ">>":
+		if b < 0 || b > 63 {
+			return linear{}, fmt.Errorf("shift count %d out of range", b)
+		}
+		if op == "<<" {
+			return constantValue(a << uint(b)), nil
+		}
+		return constantValue(a >> uint(b)), nil
+	case "&":
+		return constantValue(a & b), nil
+	case "^":
+		return constantValue(a ^ b), nil
+	case "|":
+		return constantValue(a | b), nil
+	}
+
+	panic("This path should be impossible.")
+}
+
+func (parser *exprParser) parseUnary() (linear, error) {
+	if op := parser.peekOperator("-", "+", "~"); op != "" {
+		column := parser.tokens[parser.pos].column
+		parser.pos++
+		operand, err := parser.parseUnary()
+		if err != nil {
+			return linear{}, err
+		}
+
+		switch op {
+		case "-":
+			return combine(constantValue(0), -1, operand), nil
+		case "+":
+			return operand, nil
+		default:
+			if !operand.isConstant() {
+				return linear{}, fmt.Errorf("operator '~' can't be applied to label positions at column %d", column)
+			}
+			return constantValue(^operand.constant), nil
+		}
+	}
+
+	return parser.parsePrimary()
+}
+
+func (parser *exprParser) parsePrimary() (linear, error) {
+	if parser.pos == len(parser.tokens) {
+		last := parser.tokens[len(parser.tokens)-1]
+		return linear{}, fmt.Errorf("unexpected end of expression after '%s' at column %d", last.text, last.column)
+	}
+
+	token := parser.tokens[parser.pos]
+	parser.pos++
+
+	switch token.kind {
+	case numberToken:
+		value, err := parseNumber(token.text)
+		if err != nil {
+			return linear{}, fmt.Errorf("%s at column %d", err.Error(), token.column)
+		}
+		return constantValue(value), nil
+	case charToken:
+		value, err := parseChar(token.text)
+		if err != nil {
+			return linear{}, fmt.Errorf("%s at column %d", err.Error(), token.column)
+		}
+		return constantValue(value), nil
+	case nameToken:
+		if !isSymbol(token.text) {
+			return linear{}, fmt.Errorf("invalid name '%s' at column %d", token.text, token.column)
+		}
+		return parser.resolve(token.text)
+	}
+
+	if token.kind != operatorToken || token.text != "(" {
+		return linear{}, fmt.Errorf("unexpected '%s' at column %d", token.text, token.column)
+	}
+
+	value, err := parser.parseBinary(0)
+	if err != nil {
+		return linear{}, err
+	}
+	if parser.peekOperator(")") == "" {
+		return linear{}, fmt.Errorf("missing ')' for the '(' at column %d", token.column)
+	}
+	parser.pos++
+	return value, nil
+}
+
+// evalExpression evaluates the expression held by an operand, calling resolve
+// to find the value of each name it refers to.
+func evalExpression(op operand, resolve func(name string) (linear, error)) (linear, error) {
+	parser := exprParser{tokens: op, resolve: resolve}
+	value, err := parser.parseBinary(0)
+	if err != nil {
+		return linear{}, err
+	}
+	if parser.pos != len(op) {
+		tok := op[parser.pos]
+		return linear{}, fmt.Errorf("unexpected '%s' at column %d", tok.text, tok.column)
+	}
+
+	return value, nil
+}
@@ -0,0 +1,110 @@
+package compiler
+
+import (
+	"github.com/vsartor/gvm/gvm"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// sourceReader reads source files, replacing `.include` directives by the
+// lines of the included file.
+type sourceReader struct {
+	includeDirs []string
+	// Absolute paths of the files currently being read, outermost first
+	including []string
+	// Absolute paths of the files marked with `.once` that were already read
+	once map[string]bool
+}
+
+func newSourceReader(includeDirs []string) *sourceReader {
+	return &sourceReader{includeDirs: includeDirs, once: make(map[string]bool)}
+}
+
+// resolveInclude finds the file referred to by an `.include` directive, first
+// relative to the including file and then within each include directory.
+func (reader *sourceReader) resolveInclude(includePath string, ctxt gvm.Context) string {
+	if filepath.IsAbs(includePath) {
+		return includePath
+	}
+
+	candidates := []string{filepath.Join(filepath.Dir(ctxt.FileName), includePath)}
+	for _, dir := range reader.includeDirs {
+		candidates = append(candidates, filepath.Join(dir, includePath))
+	}
+
+	for _, candidate := range candidates {
+		if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+			return candidate
+		}
+	}
+
+	gvm.Logger.Criticalf("%s: Could not find included file '%s'.\n", ctxt, includePath)
+	os.Exit(1)
+	return ""
+}
+
+func (reader *sourceReader) readFile(srcPath string) []sourceLine {
+	absPath, err := filepath.Abs(srcPath)
+	if err != nil {
+		gvm.Logger.Criticalf("Failed resolving '%s': %s\n", srcPath, err.Error())
+		os.Exit(1)
+	}
+
+	if reader.once[absPath] {
+		gvm.Logger.Debugf("Skipping '%s', which was already included.\n", srcPath)
+		return nil
+	}
+
+	for idx, including := range reader.including {
+		if including == absPath {
+			cycle := append(reader.including[idx:], absPath)
+			gvm.Logger.Criticalf("Include cycle found: %s.\n", strings.Join(cycle, " -> "))
+			os.Exit(1)
+		}
+	}
+
+	gvm.Logger.Infof("Opening '%s'.\n", srcPath)
+	input, err := os.Open(srcPath)
+	if err != nil {
+		gvm.Logger.Criticalf("Failed opening '%s': %s\n", srcPath, err.Error())
+		os.Exit(1)
+	}
+	defer input.Close()
+
+	reader.including = append(reader.including, absPath)
+	defer func() { reader.including = reader.including[:len(reader.including)-1] }()
+
+	lines := make([]sourceLine, 0)
+	for _, line := range readLines(input, gvm.Context{FileName: filepath.Clean(srcPath)}) {
+		operands, ctxt := line.operands, line.ctxt
+
+		switch operands[0].String() {
+		case ".include":
+			if len(operands) != 2 || len(operands[1]) != 1 || operands[1][0].kind != stringToken {
+				gvm.Logger.Criticalf("%s: Expected a quoted path after `.include`.\n", ctxt)
+				os.Exit(1)
+			}
+			includePath, err := strconv.Unquote(operands[1][0].text)
+			if err != nil {
+				gvm.Logger.Criticalf("%s: Invalid path %s after `.include`.\n", ctxt, operands[1][0].text)
+				os.Exit(1)
+			}
+			includePath = reader.resolveInclude(includePath, ctxt)
+			lines = append(lines, reader.readFile(includePath)...)
+
+		case ".once":
+			if len(operands) != 1 {
+				gvm.Logger.Criticalf("%s: `.once` expects no arguments.\n", ctxt)
+				os.Exit(1)
+			}
+			reader.once[absPath] = true
+
+		default:
+			lines = append(lines, line)
+		}
+	}
+
+	return lines
+}
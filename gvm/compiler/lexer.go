@@ -0,0 +1,243 @@
+package compiler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Identifiers, registers, labels, directives and references to macro
+	// parameters
+	nameToken = iota
+	numberToken
+	charToken
+	stringToken
+	operatorToken
+	commaToken
+	colonToken
+)
+
+// token is the smallest meaningful piece of a line of source.
+type token struct {
+	kind int
+	text string
+	// Column of the first character of the token, counting from 1
+	column int
+	// Whether the token is preceded by whitespace
+	spaced bool
+}
+
+func isNameChar(c byte) bool {
+	return isIdentifierChar(c) || c == '.' || c == '@' || c == '\\'
+}
+
+// Operators sorted so that the longest ones are matched first
+var operators = []string{"<<", ">>", "+", "-", "*", "/", "%", "&", "|", "^", "~", "(", ")"}
+
+// scanQuoted returns the end of the character or string literal starting at
+// start, skipping over escaped quotes.
+func scanQuoted(line string, start int) (int, bool) {
+	quote := line[start]
+	for end := start + 1; end < len(line); end++ {
+		switch line[end] {
+		case '\\':
+			end++
+		case quote:
+			return end + 1, true
+		}
+	}
+	return len(line), false
+}
+
+// lex splits a line of source into tokens, dropping the comment, if any.
+// Comments start with `;` anywhere outside of a character or string literal.
+func lex(line string) ([]token, error) {
+	tokens := make([]token, 0)
+	spaced := true
+
+	for idx := 0; idx < len(line); {
+		c := line[idx]
+		start := idx
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\r':
+			spaced = true
+			idx++
+			continue
+
+		case c == ';':
+			return tokens, nil
+
+		case isNameChar(c):
+			kind := nameToken
+			if '0' <= c && c <= '9' {
+				kind = numberToken
+			}
+			for idx < len(line) && isNameChar(line[idx]) {
+				idx++
+			}
+			tokens = append(tokens, token{kind, line[start:idx], start + 1, spaced})
+
+		case c == '\'' || c == '"':
+			end, ok := scanQuoted(line, start)
+			if !ok {
+				return nil, fmt.Errorf("unterminated literal at column %d", start+1)
+			}
+			kind := charToken
+			if c == '"' {
+				kind = stringToken
+				if _, err := strconv.Unquote(line[start:end]); err != nil {
+					return nil, fmt.Errorf("invalid string literal at column %d", start+1)
+				}
+			}
+			tokens = append(tokens, token{kind, line[start:end], start + 1, spaced})
+			idx = end
+
+		case c == ',':
+			tokens = append(tokens, token{commaToken, ",", start + 1, spaced})
+			idx++
+
+		case c == ':':
+			tokens = append(tokens, token{colonToken, ":", start + 1, spaced})
+			idx++
+
+		default:
+			for _, op := range operators {
+				if strings.HasPrefix(line[idx:], op) {
+					tokens = append(tokens, token{operatorToken, op, start + 1, spaced})
+					idx += len(op)
+					break
+				}
+			}
+			if idx == start {
+				return nil, fmt.Errorf("unexpected character '%c' at column %d", c, start+1)
+			}
+		}
+
+		spaced = false
+	}
+
+	return tokens, nil
+}
+
+// operand is a part of a statement, i.e. its instruction or directive, one of
+// its operands or a label, along with the tokens it's made of.
+type operand []token
+
+// String writes the operand back as text, keeping the spaces between tokens.
+func (op operand) String() string {
+	var result strings.Builder
+	for idx, tok := range op {
+		if idx > 0 && tok.spaced {
+			result.WriteByte(' ')
+		}
+		result.WriteString(tok.text)
+	}
+	return result.String()
+}
+
+// label returns the name of the label the operand defines, if it does.
+func (op operand) label() (string, bool) {
+	if len(op) == 2 && op[0].kind == nameToken && op[1].kind == colonToken {
+		return op[0].text, true
+	}
+	return "", false
+}
+
+// endsValue reports whether an expression can end with the token, in which
+// case it's only continued by a binary operator.
+func endsValue(tok token) bool {
+	return tok.kind != operatorToken || tok.text == ")"
+}
+
+func isBinaryOperator(tok token) bool {
+	return tok.kind == operatorToken && tok.text != "(" && tok.text != ")" && tok.text != "~"
+}
+
+// isUnarySign reports whether the token at idx is a `+` or `-` standing for the
+// sign of what follows rather than for a binary operator, which is the case
+// when it's preceded by whitespace but not followed by it, as in `5 -3`.
+func isUnarySign(tokens []token, idx int) bool {
+	tok := tokens[idx]
+	if tok.kind != operatorToken || (tok.text != "-" && tok.text != "+") {
+		return false
+	}
+	return tok.spaced && idx+1 < len(tokens) && !tokens[idx+1].spaced
+}
+
+// splitOperands groups the tokens following an instruction or directive into
+// operands. Each operand extends as far as the expression it holds, so they
+// are separated by commas or by a token which can't continue the expression,
+// e.g. `end - start r1` and `end-start, r1` both hold `end - start` and `r1`.
+// Outside of parentheses a sign written against its value starts a new
+// operand, so `5 -3` are two operands while `5 - 3` and `5-3` are one.
+func splitOperands(tokens []token) ([]operand, error) {
+	operands := make([]operand, 0)
+	start, depth := 0, 0
+
+	for idx, tok := range tokens {
+		switch {
+		case tok.kind == colonToken:
+			return nil, fmt.Errorf("unexpected ':' at column %d", tok.column)
+
+		case tok.kind == commaToken && depth == 0:
+			if idx == start {
+				return nil, fmt.Errorf("missing operand before ',' at column %d", tok.column)
+			}
+			operands = append(operands, operand(tokens[start:idx:idx]))
+			start = idx + 1
+			if start == len(tokens) {
+				return nil, fmt.Errorf("missing operand after ',' at column %d", tok.column)
+			}
+			continue
+
+		case idx > start && depth == 0 && endsValue(tokens[idx-1]) &&
+			(!isBinaryOperator(tok) || isUnarySign(tokens, idx)):
+			operands = append(operands, operand(tokens[start:idx:idx]))
+			start = idx
+		}
+
+		if tok.kind == operatorToken && tok.text == "(" {
+			depth++
+		} else if tok.kind == operatorToken && tok.text == ")" && depth > 0 {
+			depth--
+		}
+	}
+
+	if start < len(tokens) {
+		operands = append(operands, operand(tokens[start:]))
+	}
+
+	return operands, nil
+}
+
+// splitLine turns a line of source into its statements, each being its
+// instruction or directive followed by its operands. Labels at the start of
+// the line are statements of their own, so `loop: inc r1` results in the
+// statements `loop:` and `inc r1`.
+func splitLine(line string) ([][]operand, error) {
+	tokens, err := lex(line)
+	if err != nil {
+		return nil, err
+	}
+
+	statements := make([][]operand, 0)
+	for len(tokens) >= 2 && tokens[0].kind == nameToken && tokens[1].kind == colonToken {
+		statements = append(statements, []operand{operand(tokens[:2:2])})
+		tokens = tokens[2:]
+	}
+
+	if len(tokens) == 0 {
+		return statements, nil
+	}
+	if tokens[0].kind != nameToken {
+		return nil, fmt.Errorf("unexpected '%s' at column %d", tokens[0].text, tokens[0].column)
+	}
+
+	operands, err := splitOperands(tokens[1:])
+	if err != nil {
+		return nil, err
+	}
+	return append(statements, append([]operand{operand(tokens[:1:1])}, operands...)), nil
+}
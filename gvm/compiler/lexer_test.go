@@ -0,0 +1,99 @@
+package compiler
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLex(t *testing.T) {
+	cases := []struct {
+		line  string
+		texts []string
+		err   bool
+	}{
+		{"add r1 r2", []string{"add", "r1", "r2"}, false},
+		{"const 0x1f r1 ; comment", []string{"const", "0x1f", "r1"}, false},
+		{"const ';' r1", []string{"const", "';'", "r1"}, false},
+		{`.string "a b;c"`, []string{".string", `"a b;c"`}, false},
+		{"const (a<<2)-1, r1", []string{"const", "(", "a", "<<", "2", ")", "-", "1", ",", "r1"}, false},
+		{"loop: inc r1", []string{"loop", ":", "inc", "r1"}, false},
+		{"const 'a r1", nil, true},
+		{`.string "\q"`, nil, true},
+		{"const $ r1", nil, true},
+	}
+
+	for _, c := range cases {
+		tokens, err := lex(c.line)
+		if c.err {
+			if err == nil {
+				t.Errorf("lex(%q) succeeded, expected an error", c.line)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("lex(%q) failed: %s", c.line, err)
+			continue
+		}
+		texts := make([]string, len(tokens))
+		for idx, tok := range tokens {
+			texts[idx] = tok.text
+		}
+		if !reflect.DeepEqual(texts, c.texts) {
+			t.Errorf("lex(%q) = %q, expected %q", c.line, texts, c.texts)
+		}
+	}
+}
+
+func TestSplitLine(t *testing.T) {
+	cases := []struct {
+		line       string
+		statements [][]string
+		err        bool
+	}{
+		{"add r1 r2", [][]string{{"add", "r1", "r2"}}, false},
+		{"add r1, r2", [][]string{{"add", "r1", "r2"}}, false},
+		{"const end - start r1", [][]string{{"const", "end - start", "r1"}}, false},
+		{"const end-start, r1", [][]string{{"const", "end-start", "r1"}}, false},
+		{"const 5 - 1 r2", [][]string{{"const", "5 - 1", "r2"}}, false},
+		{"const 5-1 r2", [][]string{{"const", "5-1", "r2"}}, false},
+		{"const 5- 1 r2", [][]string{{"const", "5- 1", "r2"}}, false},
+		{"const 5 -1 r2", [][]string{{"const", "5", "-1", "r2"}}, false},
+		{"const 5 +1 r2", [][]string{{"const", "5", "+1", "r2"}}, false},
+		{"const -1 r2", [][]string{{"const", "-1", "r2"}}, false},
+		{"const (5 -1) r2", [][]string{{"const", "(5 -1)", "r2"}}, false},
+		{"const ~1 r2", [][]string{{"const", "~1", "r2"}}, false},
+		{"const 5 ~1 r2", [][]string{{"const", "5", "~1", "r2"}}, false},
+		{"const (1 + 2) * 3 r2", [][]string{{"const", "(1 + 2) * 3", "r2"}}, false},
+		{"loop: .inner: inc r1", [][]string{{"loop:"}, {".inner:"}, {"inc", "r1"}}, false},
+		{"loop:", [][]string{{"loop:"}}, false},
+		{"", [][]string{}, false},
+		{"add r1,, r2", nil, true},
+		{"add r1 r2,", nil, true},
+		{"add r1 : r2", nil, true},
+		{"5 r1", nil, true},
+	}
+
+	for _, c := range cases {
+		statements, err := splitLine(c.line)
+		if c.err {
+			if err == nil {
+				t.Errorf("splitLine(%q) succeeded, expected an error", c.line)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("splitLine(%q) failed: %s", c.line, err)
+			continue
+		}
+		texts := make([][]string, len(statements))
+		for idx, statement := range statements {
+			texts[idx] = make([]string, len(statement))
+			for opIdx, op := range statement {
+				texts[idx][opIdx] = op.String()
+			}
+		}
+		if !reflect.DeepEqual(texts, c.statements) {
+			t.Errorf("splitLine(%q) = %q, expected %q", c.line, texts, c.statements)
+		}
+	}
+}
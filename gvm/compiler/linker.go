@@ -0,0 +1,167 @@
+package compiler
+
+import (
+	"github.com/vsartor/gvm/gvm"
+	"github.com/vsartor/gvm/gvm/lang"
+	"os"
+)
+
+// entryLabel is the label jumped to when the program starts, if defined.
+const entryLabel = "main"
+
+// hasEntry reports whether the program needs the sequence jumping to the entry
+// label, which optimized programs can do without if the entry label is missing
+// or is already where execution starts.
+func hasEntry(objects []*object, optimize bool) bool {
+	if !optimize {
+		return true
+	}
+	for idx, obj := range objects {
+		if obj.globals[entryLabel] {
+			return idx != 0 || obj.symbols[entryLabel] != 0
+		}
+	}
+	return false
+}
+
+// relocationSource finds where a reference was written, which for objects read
+// from files is the source of the instruction holding it.
+func relocationSource(obj *object, rel relocation) (gvm.Context, bool) {
+	if rel.ctxt != nil {
+		return *rel.ctxt, true
+	}
+
+	found := false
+	var entry gvm.LineEntry
+	for _, line := range obj.debug.Lines {
+		if line.Position <= rel.position && (!found || line.Position >= entry.Position) {
+			entry, found = line, true
+		}
+	}
+	if !found {
+		return gvm.Context{}, false
+	}
+	return gvm.Context{FileName: obj.debug.Files[entry.File], LineNum: int(entry.Line)}, true
+}
+
+// link lays out the objects one after the other and resolves the references
+// to labels between them, producing an executable program.
+func link(objects []*object, optimize bool) gvm.Program {
+	gvm.Logger.Infof("Linking %d objects.\n", len(objects))
+
+	// Because we may need to add the `jmp main` tokens in case a
+	// `main` label is present, let's save the space for this instruction
+	// by adding in two `noop`'s.
+	code := make([]gvm.Code, 0, gvm.CodeArrayInitialSize)
+	entry := hasEntry(objects, optimize)
+	if entry {
+		code = append(code, lang.Noop, lang.Noop)
+	}
+
+	debug := gvm.NewDebugInfo()
+	globalToPosition := make(map[string]int64)
+	globalToObject := make(map[string]*object)
+	bases := make([]int64, len(objects))
+	failed := false
+
+	// Lay out the code and collect the exported symbols
+	for idx, obj := range objects {
+		base := int64(len(code))
+		bases[idx] = base
+		code = append(code, obj.code...)
+
+		for _, name := range sortedNames(obj.globals) {
+			if other, ok := globalToObject[name]; ok {
+				gvm.Logger.Errorf("Duplicate symbol '%s' defined in '%s' and '%s'.\n",
+					name, other.name, obj.name)
+				failed = true
+				continue
+			}
+			globalToPosition[name] = base + obj.symbols[name]
+			globalToObject[name] = obj
+		}
+
+		for _, entry := range obj.debug.Lines {
+			ctxt := gvm.Context{FileName: obj.debug.Files[entry.File], LineNum: int(entry.Line)}
+			debug.AddLine(base+entry.Position, ctxt)
+		}
+		for _, alias := range obj.debug.Aliases {
+			alias.Start += base
+			alias.End += base
+			debug.Aliases = append(debug.Aliases, alias)
+		}
+	}
+
+	// Debug symbols use plain names whenever they are unambiguous, prefixing
+	// local labels clashing with others by the name of their object.
+	for idx, obj := range objects {
+		for name, position := range obj.symbols {
+			owner, isGlobal := globalToObject[name]
+			if _, isTaken := debug.Symbols[name]; (isGlobal && owner != obj) || (!isGlobal && isTaken) {
+				name = obj.name + ":" + name
+			}
+			debug.Symbols[name] = bases[idx] + position
+		}
+	}
+
+	// Fill in code positions, preferring labels defined by the object itself
+	for idx, obj := range objects {
+		for _, rel := range obj.relocations {
+			position, ok := obj.symbols[rel.symbol]
+			if ok {
+				position += bases[idx]
+			} else if position, ok = globalToPosition[rel.symbol]; !ok {
+				if ctxt, ok := relocationSource(obj, rel); ok {
+					gvm.Logger.Errorf("%s: Reference to undefined symbol '%s'.\n", ctxt, rel.symbol)
+				} else {
+					gvm.Logger.Errorf("%s: Reference to undefined symbol '%s'.\n", obj.name, rel.symbol)
+				}
+				failed = true
+				continue
+			}
+			code[bases[idx]+rel.position] = gvm.Code(position + rel.addend)
+		}
+	}
+
+	if failed {
+		gvm.Logger.Criticalf("Linking failed.\n")
+		os.Exit(1)
+	}
+
+	// Check if `main` was defined. If it has, change the `noop`s into the correct
+	// instruction.
+	if mainPosition, ok := globalToPosition[entryLabel]; !ok {
+		gvm.Logger.Infof("The label `main` was not defined.\n")
+	} else if entry {
+		code[0] = lang.Jmp
+		code[1] = gvm.Code(mainPosition)
+	}
+
+	gvm.Logger.Infof("Finished linking.\n")
+
+	return gvm.Program{Code: code, Debug: debug}
+}
+
+// Link links the object files into a single binary file.
+func Link(objPaths []string, dstPath string, options Options) {
+	objects := make([]*object, 0, len(objPaths))
+	for _, objPath := range objPaths {
+		obj := readObject(objPath)
+		if options.Optimize {
+			optimize(obj)
+		}
+		objects = append(objects, obj)
+	}
+
+	program := link(objects, options.Optimize)
+
+	gvm.Logger.Infof("Opening '%s'.\n", dstPath)
+	output, err := os.Create(dstPath)
+	if err != nil {
+		gvm.Logger.Criticalf("Failed opening '%s': %s\n", dstPath, err.Error())
+		os.Exit(1)
+	}
+	defer output.Close()
+
+	writeCode(program, output)
+}
@@ -0,0 +1,35 @@
+package compiler
+
+import (
+	"github.com/vsartor/gvm/gvm"
+	"testing"
+)
+
+func TestRelocationSource(t *testing.T) {
+	obj := newObject("lib.o")
+	obj.debug.AddLine(0, gvm.Context{FileName: "lib.gsm", LineNum: 3})
+	obj.debug.AddLine(3, gvm.Context{FileName: "lib.gsm", LineNum: 4})
+	obj.debug.AddLine(5, gvm.Context{FileName: "other.gsm", LineNum: 9})
+	known := gvm.Context{FileName: "main.gsm", LineNum: 1}
+
+	cases := []struct {
+		name string
+		rel  relocation
+		ctxt gvm.Context
+	}{
+		{"context read from the source", relocation{position: 4, ctxt: &known}, known},
+		{"operand of an instruction", relocation{position: 4}, gvm.Context{FileName: "lib.gsm", LineNum: 4}},
+		{"another file", relocation{position: 6}, gvm.Context{FileName: "other.gsm", LineNum: 9}},
+		{"first instruction", relocation{position: 1}, gvm.Context{FileName: "lib.gsm", LineNum: 3}},
+	}
+
+	for _, c := range cases {
+		if ctxt, ok := relocationSource(obj, c.rel); !ok || ctxt != c.ctxt {
+			t.Errorf("%s: got %v, expected %v", c.name, ctxt, c.ctxt)
+		}
+	}
+
+	if _, ok := relocationSource(newObject("bare.o"), relocation{position: 1}); ok {
+		t.Errorf("found a source for an object without debug lines")
+	}
+}
@@ -0,0 +1,261 @@
+package compiler
+
+import (
+	"fmt"
+	"github.com/vsartor/gvm/gvm"
+	"github.com/vsartor/gvm/gvm/lang"
+	"os"
+	"strings"
+)
+
+// Nested expansions deeper than this are assumed to come from a recursive macro
+const maxMacroDepth = 64
+
+type macro struct {
+	name   string
+	params []string
+	body   []sourceLine
+	ctxt   gvm.Context
+}
+
+type macroExpander struct {
+	macros     map[string]*macro
+	expansions int
+}
+
+func isIdentifierChar(c byte) bool {
+	return c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
+
+func isIdentifier(repr string) bool {
+	if len(repr) == 0 || ('0' <= repr[0] && repr[0] <= '9') {
+		return false
+	}
+	for idx := 0; idx < len(repr); idx++ {
+		if !isIdentifierChar(repr[idx]) {
+			return false
+		}
+	}
+	return true
+}
+
+// collectMacros removes the macro definitions from lines, returning them
+// along with the remaining lines.
+func collectMacros(lines []sourceLine) (map[string]*macro, []sourceLine) {
+	macros := make(map[string]*macro)
+	remaining := make([]sourceLine, 0, len(lines))
+
+	var current *macro
+	for _, line := range lines {
+		operands, ctxt := line.operands, line.ctxt
+
+		switch operands[0].String() {
+		case ".macro":
+			if current != nil {
+				gvm.Logger.Criticalf("%s: Macro definitions can't be nested.\n", ctxt)
+				os.Exit(1)
+			}
+			if len(operands) < 2 || !isIdentifier(operands[1].String()) {
+				gvm.Logger.Criticalf("%s: Expected a macro name after `.macro`.\n", ctxt)
+				os.Exit(1)
+			}
+
+			name := operands[1].String()
+			if _, err := lang.ParseInstruction(name); err == nil {
+				gvm.Logger.Criticalf("%s: Macro '%s' would shadow an instruction.\n", ctxt, name)
+				os.Exit(1)
+			}
+			if previous, ok := macros[name]; ok {
+				gvm.Logger.Criticalf("%s: Attempt to overwrite macro '%s' defined at %s.\n",
+					ctxt, name, previous.ctxt)
+				os.Exit(1)
+			}
+
+			params := make([]string, 0, len(operands)-2)
+			for _, op := range operands[2:] {
+				param := op.String()
+				if !isIdentifier(param) {
+					gvm.Logger.Criticalf("%s: Invalid macro parameter name '%s' at column %d.\n",
+						ctxt, param, op[0].column)
+					os.Exit(1)
+				}
+				for _, other := range params {
+					if other == param {
+						gvm.Logger.Criticalf("%s: Repeated macro parameter '%s' at column %d.\n",
+							ctxt, param, op[0].column)
+						os.Exit(1)
+					}
+				}
+				params = append(params, param)
+			}
+
+			gvm.Logger.Debugf("%s: Read macro %s.", ctxt, name)
+			current = &macro{name: name, params: params, ctxt: ctxt}
+			macros[name] = current
+
+		case ".endm":
+			if current == nil {
+				gvm.Logger.Criticalf("%s: `.endm` without a matching `.macro`.\n", ctxt)
+				os.Exit(1)
+			}
+			if len(operands) != 1 {
+				gvm.Logger.Criticalf("%s: `.endm` expects no arguments.\n", ctxt)
+				os.Exit(1)
+			}
+			current = nil
+
+		default:
+			if current != nil {
+				current.body = append(current.body, line)
+			} else {
+				remaining = append(remaining, line)
+			}
+		}
+	}
+
+	if current != nil {
+		gvm.Logger.Criticalf("%s: Macro '%s' is missing its `.endm`.\n", current.ctxt, current.name)
+		os.Exit(1)
+	}
+
+	return macros, remaining
+}
+
+// substitute replaces the references to parameters, written as `\param`, by
+// the arguments of the expansion and makes the macro's labels, written as
+// `@label`, unique to the expansion numbered by id. A token made of a single
+// reference is replaced by the tokens of the argument, which take its column
+// so errors point to where they show up in the macro.
+func (expander *macroExpander) substitute(tok token, m *macro, args []operand, id int, ctxt gvm.Context) []token {
+	if tok.kind != nameToken {
+		return []token{tok}
+	}
+
+	var result strings.Builder
+	// Parameter referred to by the whole token, if it's a single reference
+	whole := -1
+	for idx := 0; idx < len(tok.text); idx++ {
+		if tok.text[idx] != '\\' {
+			result.WriteByte(tok.text[idx])
+			continue
+		}
+
+		end := idx + 1
+		for end < len(tok.text) && isIdentifierChar(tok.text[end]) {
+			end++
+		}
+
+		name, found := tok.text[idx+1:end], false
+		for paramIdx, param := range m.params {
+			if param == name {
+				result.WriteString(args[paramIdx].String())
+				if idx == 0 && end == len(tok.text) {
+					whole = paramIdx
+				}
+				found = true
+				break
+			}
+		}
+		if !found {
+			gvm.Logger.Criticalf("%s: Unknown macro parameter '\\%s' at column %d.\n", ctxt, name, tok.column)
+			os.Exit(1)
+		}
+		idx = end - 1
+	}
+
+	if whole >= 0 {
+		tokens := append([]token(nil), args[whole]...)
+		for idx := range tokens {
+			tokens[idx].column = tok.column
+		}
+		tokens[0].spaced = tok.spaced
+		return tokens
+	}
+
+	// Only labels written in the macro are renamed, those in its arguments
+	// belong to where it's used
+	text := result.String()
+	if tok.text[0] == '@' {
+		text += fmt.Sprintf(".%d", id)
+	}
+	if text == tok.text {
+		return []token{tok}
+	}
+
+	// Arguments pasted within a name, as in `r\idx`, must still make a token
+	tokens, err := lex(text)
+	if err != nil || len(tokens) != 1 {
+		gvm.Logger.Criticalf("%s: Substituting '%s' at column %d results in '%s', which isn't a single token.\n",
+			ctxt, tok.text, tok.column, text)
+		os.Exit(1)
+	}
+	tokens[0].column, tokens[0].spaced = tok.column, tok.spaced
+	return tokens
+}
+
+func (expander *macroExpander) expand(m *macro, args []operand, site gvm.Context, depth int) []sourceLine {
+	if depth > maxMacroDepth {
+		gvm.Logger.Criticalf("%s: Too many nested expansions of macro '%s', is it recursive?\n",
+			site, m.name)
+		os.Exit(1)
+	}
+	if len(args) != len(m.params) {
+		gvm.Logger.Criticalf("%s: Macro '%s' expected %d arguments, got %d.\n",
+			site, m.name, len(m.params), len(args))
+		os.Exit(1)
+	}
+
+	expander.expansions++
+	// Nested expansions bump the count, so this one's number is kept aside
+	id := expander.expansions
+	gvm.Logger.Debugf("%s: Expanding macro %s.", site, m.name)
+
+	lines := make([]sourceLine, 0, len(m.body))
+	for _, line := range m.body {
+		ctxt := line.ctxt
+		ctxt.Expansion = &gvm.Expansion{Macro: m.name, Site: site}
+
+		operands := make([]operand, len(line.operands))
+		for idx, op := range line.operands {
+			for _, tok := range op {
+				operands[idx] = append(operands[idx], expander.substitute(tok, m, args, id, ctxt)...)
+			}
+		}
+
+		if inner, ok := expander.macros[operands[0].String()]; ok {
+			lines = append(lines, expander.expand(inner, operands[1:], ctxt, depth+1)...)
+		} else {
+			lines = append(lines, sourceLine{operands, ctxt})
+		}
+	}
+
+	return lines
+}
+
+// expandMacros collects the macros defined in lines and replaces each of their
+// uses by the body of the macro.
+func expandMacros(lines []sourceLine) []sourceLine {
+	macros, lines := collectMacros(lines)
+	expander := macroExpander{macros: macros}
+
+	expanded := make([]sourceLine, 0, len(lines))
+	for _, line := range lines {
+		for _, op := range line.operands {
+			for _, tok := range op {
+				if tok.kind == nameToken && tok.text[0] == '@' {
+					gvm.Logger.Criticalf("%s: Macro label '%s' used outside of a macro at column %d.\n",
+						line.ctxt, tok.text, tok.column)
+					os.Exit(1)
+				}
+			}
+		}
+
+		if m, ok := macros[line.operands[0].String()]; ok {
+			expanded = append(expanded, expander.expand(m, line.operands[1:], line.ctxt, 1)...)
+		} else {
+			expanded = append(expanded, line)
+		}
+	}
+
+	return expanded
+}
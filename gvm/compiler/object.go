@@ -0,0 +1,190 @@
+package compiler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/vsartor/gvm/gvm"
+	"io"
+	"os"
+	"sort"
+)
+
+// Sections specific to object files, which also carry the debug sections.
+const (
+	globalsSectionTag int64 = iota + 16
+	externsSectionTag
+	relocationsSectionTag
+)
+
+// relocation marks a code position which must hold the position of a label
+// plus an addend, known only once the object it belongs to is linked.
+type relocation struct {
+	position int64
+	symbol   string
+	addend   int64
+	// Where the reference was read from, unknown for objects read from files,
+	// whose debug lines tell it instead
+	ctxt *gvm.Context
+}
+
+// object is a compiled module whose code positions are relative to its own
+// start, ready to be laid out alongside other modules by the linker.
+type object struct {
+	// Name used to refer to the object in diagnostics
+	name string
+	code []gvm.Code
+	// Every label defined by the module, exported or not
+	symbols map[string]int64
+	// Labels defined by the module that other modules can refer to
+	globals map[string]bool
+	// Labels the module expects other modules to define
+	externs     map[string]bool
+	relocations []relocation
+	// Debug information, whose symbols are the same as the object's
+	debug *gvm.DebugInfo
+}
+
+func newObject(name string) *object {
+	obj := &object{
+		name:    name,
+		code:    make([]gvm.Code, 0, gvm.CodeArrayInitialSize),
+		symbols: make(map[string]int64),
+		globals: make(map[string]bool),
+		externs: make(map[string]bool),
+		debug:   gvm.NewDebugInfo(),
+	}
+	obj.debug.Symbols = obj.symbols
+	return obj
+}
+
+func sortedNames(set map[string]bool) []string {
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func writeNames(output io.Writer, tag int64, set map[string]bool) error {
+	names := sortedNames(set)
+
+	payload := new(bytes.Buffer)
+	_ = binary.Write(payload, binary.LittleEndian, int64(len(names)))
+	for _, name := range names {
+		writeString(payload, name)
+	}
+	return writeSection(output, tag, payload)
+}
+
+func readNames(payload io.Reader, set map[string]bool) error {
+	var count int64
+	if err := binary.Read(payload, binary.LittleEndian, &count); err != nil {
+		return err
+	}
+	for i := int64(0); i < count; i++ {
+		name, err := readString(payload)
+		if err != nil {
+			return err
+		}
+		set[name] = true
+	}
+	return nil
+}
+
+func writeObject(obj *object, output *os.File) {
+	gvm.Logger.Infof("Writing object file.\n")
+
+	writeCodeArray(gvm.ObjectFileHeader, obj.code, output)
+
+	err := writeDebugInfo(obj.debug, output)
+	if err == nil {
+		err = writeNames(output, globalsSectionTag, obj.globals)
+	}
+	if err == nil {
+		err = writeNames(output, externsSectionTag, obj.externs)
+	}
+	if err == nil {
+		relocations := new(bytes.Buffer)
+		_ = binary.Write(relocations, binary.LittleEndian, int64(len(obj.relocations)))
+		for _, rel := range obj.relocations {
+			_ = binary.Write(relocations, binary.LittleEndian, rel.position)
+			_ = binary.Write(relocations, binary.LittleEndian, rel.addend)
+			writeString(relocations, rel.symbol)
+		}
+		err = writeSection(output, relocationsSectionTag, relocations)
+	}
+	if err != nil {
+		gvm.Logger.Criticalf("Failed writting object sections: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	gvm.Logger.Infof("Finished writting object file.\n")
+}
+
+func readObjectSection(tag int64, payload io.Reader, obj *object) error {
+	switch tag {
+	case globalsSectionTag:
+		return readNames(payload, obj.globals)
+	case externsSectionTag:
+		return readNames(payload, obj.externs)
+	case relocationsSectionTag:
+		var count int64
+		if err := binary.Read(payload, binary.LittleEndian, &count); err != nil {
+			return err
+		}
+		for i := int64(0); i < count; i++ {
+			var rel relocation
+			if err := binary.Read(payload, binary.LittleEndian, &rel.position); err != nil {
+				return err
+			}
+			if err := binary.Read(payload, binary.LittleEndian, &rel.addend); err != nil {
+				return err
+			}
+			symbol, err := readString(payload)
+			if err != nil {
+				return err
+			}
+			rel.symbol = symbol
+			obj.relocations = append(obj.relocations, rel)
+		}
+	}
+	return nil
+}
+
+func readObject(filePath string) *object {
+	gvm.Logger.Infof("Opening '%s'.\n", filePath)
+	file, err := os.Open(filePath)
+	if err != nil {
+		gvm.Logger.Criticalf("Failed opening '%s': %s\n", filePath, err.Error())
+		os.Exit(1)
+	}
+	defer file.Close()
+
+	gvm.Logger.Infof("Reading object file.\n")
+
+	obj := newObject(filePath)
+	obj.code = readCodeArray(gvm.ObjectFileHeader, file)
+
+	err = readSections(file, func(tag int64, payload io.Reader) error {
+		if isDebugSection(tag) {
+			return readDebugSection(tag, payload, obj.debug)
+		}
+		return readObjectSection(tag, payload, obj)
+	})
+	if err != nil {
+		gvm.Logger.Criticalf("Failed reading object sections: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	for _, rel := range obj.relocations {
+		if rel.position < 0 || rel.position >= int64(len(obj.code)) {
+			gvm.Logger.Criticalf("%s: Relocation for '%s' is out of the code array.\n", obj.name, rel.symbol)
+			os.Exit(1)
+		}
+	}
+
+	gvm.Logger.Infof("Finished reading object file.\n")
+
+	return obj
+}
@@ -0,0 +1,369 @@
+package compiler
+
+import (
+	"github.com/vsartor/gvm/gvm"
+	"github.com/vsartor/gvm/gvm/lang"
+	"sort"
+)
+
+// instruction is an instruction of an object being optimized.
+type instruction struct {
+	// Position of the instruction before optimizing
+	position int64
+	code     []gvm.Code
+	kinds    []int
+	// Index of the relocation of each operand, or -1 if it has none
+	relocations []int
+	removed     bool
+}
+
+// optimizer rewrites the code of an object as a list of instructions, with the
+// code positions they refer to taken from the relocations of the object.
+type optimizer struct {
+	obj          *object
+	instructions []*instruction
+	// Index of the instruction starting at each position
+	indexOf map[int64]int
+}
+
+func newOptimizer(obj *object) (*optimizer, bool) {
+	opt := &optimizer{obj: obj, indexOf: make(map[int64]int)}
+
+	relocationAt := make(map[int64]int)
+	for idx, rel := range obj.relocations {
+		relocationAt[rel.position] = idx
+	}
+
+	for position := int64(0); position < int64(len(obj.code)); {
+		kinds, ok := lang.Operands(obj.code[position])
+		if !ok || position+int64(len(kinds)) >= int64(len(obj.code)) {
+			gvm.Logger.Warningf("%s: Can't decode the instruction at %d, not optimizing.\n",
+				obj.name, position)
+			return nil, false
+		}
+
+		ins := &instruction{
+			position:    position,
+			code:        obj.code[position : position+1+int64(len(kinds))],
+			kinds:       kinds,
+			relocations: make([]int, len(kinds)),
+		}
+		for operand, kind := range kinds {
+			relIdx, ok := relocationAt[position+1+int64(operand)]
+			if !ok {
+				relIdx = -1
+			}
+			// Jumps to fixed positions would break once code moves around
+			if kind == lang.LabelOperand && relIdx < 0 {
+				gvm.Logger.Warningf("%s: Jump to a fixed position at %d, not optimizing.\n",
+					obj.name, position)
+				return nil, false
+			}
+			ins.relocations[operand] = relIdx
+		}
+
+		opt.indexOf[position] = len(opt.instructions)
+		opt.instructions = append(opt.instructions, ins)
+		position += int64(len(ins.code))
+	}
+
+	// Every position code refers to must be the start of an instruction
+	for _, ins := range opt.instructions {
+		for operand, kind := range ins.kinds {
+			if kind != lang.LabelOperand {
+				continue
+			}
+			if _, isLocal := opt.target(ins, operand); isLocal {
+				if _, ok := opt.indexAt(opt.targetPosition(ins, operand)); !ok {
+					gvm.Logger.Warningf("%s: Jump into the middle of an instruction at %d, not optimizing.\n",
+						obj.name, ins.position)
+					return nil, false
+				}
+			}
+		}
+	}
+
+	return opt, true
+}
+
+// targetPosition returns the position referred to by a label operand, before
+// optimizing.
+func (opt *optimizer) targetPosition(ins *instruction, operand int) int64 {
+	rel := opt.obj.relocations[ins.relocations[operand]]
+	return opt.obj.symbols[rel.symbol] + rel.addend
+}
+
+// target returns the index of the instruction a label operand refers to,
+// skipping removed instructions, and false if it refers to another object.
+func (opt *optimizer) target(ins *instruction, operand int) (int, bool) {
+	rel := opt.obj.relocations[ins.relocations[operand]]
+	if _, ok := opt.obj.symbols[rel.symbol]; !ok {
+		return 0, false
+	}
+	idx, _ := opt.indexAt(opt.targetPosition(ins, operand))
+	return idx, true
+}
+
+// indexAt returns the index of the first instruction kept at or after
+// position, or the number of instructions if there is none. It also reports
+// whether position is the start of an instruction or the end of the code.
+func (opt *optimizer) indexAt(position int64) (int, bool) {
+	idx, ok := opt.indexOf[position]
+	if !ok {
+		if position != int64(len(opt.obj.code)) {
+			return 0, false
+		}
+		idx = len(opt.instructions)
+	}
+	for idx < len(opt.instructions) && opt.instructions[idx].removed {
+		idx++
+	}
+	return idx, true
+}
+
+// retarget makes a label operand refer to the instruction at idx.
+func (opt *optimizer) retarget(ins *instruction, operand int, idx int) {
+	rel := &opt.obj.relocations[ins.relocations[operand]]
+	position := int64(len(opt.obj.code))
+	if idx < len(opt.instructions) {
+		position = opt.instructions[idx].position
+	}
+	rel.addend = position - opt.obj.symbols[rel.symbol]
+}
+
+func (opt *optimizer) next(idx int) int {
+	for idx++; idx < len(opt.instructions) && opt.instructions[idx].removed; idx++ {
+	}
+	return idx
+}
+
+// dropNoops removes every `noop`, which labels pointing at them skip over.
+func (opt *optimizer) dropNoops() bool {
+	changed := false
+	for _, ins := range opt.instructions {
+		if !ins.removed && ins.code[0] == lang.Noop {
+			ins.removed = true
+			changed = true
+		}
+	}
+	return changed
+}
+
+// dropJumpsToNext removes jumps to the instruction right after them, which
+// lead there whether they are taken or not. A `jerr` is kept, since taking it
+// also clears the error flag.
+func (opt *optimizer) dropJumpsToNext() bool {
+	changed := false
+	for idx, ins := range opt.instructions {
+		if ins.removed || !lang.IsJump(ins.code[0]) || ins.code[0] == lang.Jerr {
+			continue
+		}
+		if target, isLocal := opt.target(ins, 0); isLocal && target == opt.next(idx) {
+			ins.removed = true
+			changed = true
+		}
+	}
+	return changed
+}
+
+// threadJumps makes jumps, calls and handlers whose target is a `jmp` refer
+// directly to where that `jmp` leads.
+func (opt *optimizer) threadJumps() bool {
+	changed := false
+	for _, ins := range opt.instructions {
+		if ins.removed || len(ins.kinds) == 0 || ins.kinds[0] != lang.LabelOperand {
+			continue
+		}
+
+		target, isLocal := opt.target(ins, 0)
+		if !isLocal {
+			continue
+		}
+
+		// Jumps looping forever are left alone
+		final, visited := target, map[int]bool{target: true}
+		for final < len(opt.instructions) && opt.instructions[final].code[0] == lang.Jmp {
+			next, nextIsLocal := opt.target(opt.instructions[final], 0)
+			if !nextIsLocal || visited[next] {
+				break
+			}
+			final = next
+			visited[final] = true
+		}
+
+		if final != target {
+			opt.retarget(ins, 0, final)
+			changed = true
+		}
+	}
+	return changed
+}
+
+// entries returns the indexes of the instructions execution may start
+// from, other than by falling through: those referred to by the code, either
+// as a jump target or as data, and those labeled with exported symbols.
+func (opt *optimizer) entries() map[int]bool {
+	entries := make(map[int]bool)
+
+	for _, ins := range opt.instructions {
+		if ins.removed {
+			continue
+		}
+		for operand, relIdx := range ins.relocations {
+			if relIdx < 0 {
+				continue
+			}
+			if ins.kinds[operand] == lang.LabelOperand {
+				if target, isLocal := opt.target(ins, operand); isLocal {
+					entries[target] = true
+				}
+				continue
+			}
+
+			// Positions used as data are assumed to be jumped to somehow
+			rel := opt.obj.relocations[relIdx]
+			if position, ok := opt.obj.symbols[rel.symbol]; ok {
+				if idx, ok := opt.indexAt(position + rel.addend); ok {
+					entries[idx] = true
+				}
+			}
+		}
+	}
+
+	for name := range opt.obj.globals {
+		if idx, ok := opt.indexAt(opt.obj.symbols[name]); ok {
+			entries[idx] = true
+		}
+	}
+	if idx, ok := opt.indexAt(0); ok {
+		entries[idx] = true
+	}
+
+	return entries
+}
+
+// dropUnreachable removes the instructions following one that never falls
+// through, such as `halt`, `jmp` or `ret`, up to the next one execution may
+// start from.
+func (opt *optimizer) dropUnreachable() bool {
+	entries := opt.entries()
+	changed := false
+	reachable := true
+
+	for idx, ins := range opt.instructions {
+		if ins.removed {
+			continue
+		}
+		if entries[idx] {
+			reachable = true
+		}
+		if !reachable {
+			ins.removed = true
+			changed = true
+			continue
+		}
+		reachable = lang.FallsThrough(ins.code[0])
+	}
+
+	return changed
+}
+
+// rewrite lays out the instructions which were kept, moving labels, relocations
+// and debug information along with them.
+func (opt *optimizer) rewrite() {
+	obj := opt.obj
+
+	newPositions := make([]int64, len(opt.instructions)+1)
+	code := make([]gvm.Code, 0, len(obj.code))
+	for idx, ins := range opt.instructions {
+		newPositions[idx] = int64(len(code))
+		if !ins.removed {
+			code = append(code, ins.code...)
+		}
+	}
+	newPositions[len(opt.instructions)] = int64(len(code))
+
+	newPosition := func(position int64) int64 {
+		idx, ok := opt.indexAt(position)
+		if !ok {
+			// Only positions used as data may not be instruction boundaries,
+			// keep them relative to the instruction they fall into
+			idx = sort.Search(len(opt.instructions), func(i int) bool {
+				return opt.instructions[i].position > position
+			}) - 1
+			return newPositions[idx] + position - opt.instructions[idx].position
+		}
+		return newPositions[idx]
+	}
+
+	// Relocations need the old symbol positions to find their targets
+	relocations := make([]relocation, 0, len(obj.relocations))
+	for _, ins := range opt.instructions {
+		if ins.removed {
+			continue
+		}
+		for operand, relIdx := range ins.relocations {
+			if relIdx < 0 {
+				continue
+			}
+			rel := obj.relocations[relIdx]
+			rel.position = newPosition(ins.position) + 1 + int64(operand)
+			if position, ok := obj.symbols[rel.symbol]; ok {
+				rel.addend = newPosition(position+rel.addend) - newPosition(position)
+			}
+			relocations = append(relocations, rel)
+		}
+	}
+	obj.relocations = relocations
+
+	for name, position := range obj.symbols {
+		obj.symbols[name] = newPosition(position)
+	}
+
+	lines := make([]gvm.LineEntry, 0, len(obj.debug.Lines))
+	for _, entry := range obj.debug.Lines {
+		if idx, ok := opt.indexOf[entry.Position]; ok && !opt.instructions[idx].removed {
+			entry.Position = newPositions[idx]
+			lines = append(lines, entry)
+		}
+	}
+	obj.debug.Lines = lines
+
+	aliases := make([]gvm.AliasEntry, 0, len(obj.debug.Aliases))
+	for _, alias := range obj.debug.Aliases {
+		alias.Start, alias.End = newPosition(alias.Start), newPosition(alias.End)
+		if alias.Start < alias.End {
+			aliases = append(aliases, alias)
+		}
+	}
+	obj.debug.Aliases = aliases
+
+	obj.code = code
+}
+
+// optimize applies peephole optimizations to the code of an object until none
+// of them changes it any further.
+//
+// A `const` followed by arithmetic on the register it loads is not folded: no
+// instruction takes an immediate operand, so the constant has to be in a
+// register anyway, and the register keeps the constant afterwards, which later
+// code may read.
+func optimize(obj *object) {
+	opt, ok := newOptimizer(obj)
+	if !ok {
+		return
+	}
+
+	gvm.Logger.Infof("Optimizer pass starting.\n")
+
+	for changed := true; changed; {
+		changed = opt.dropNoops()
+		changed = opt.threadJumps() || changed
+		changed = opt.dropJumpsToNext() || changed
+		changed = opt.dropUnreachable() || changed
+	}
+
+	before := len(obj.code)
+	opt.rewrite()
+	gvm.Logger.Infof("Optimized code from %d to %d words.\n", before, len(obj.code))
+}
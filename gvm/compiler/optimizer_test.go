@@ -0,0 +1,94 @@
+package compiler
+
+import (
+	"github.com/vsartor/gvm/gvm"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// compileLines compiles source given as a string into an object.
+func compileLines(t *testing.T, source string) *object {
+	lines := make([]sourceLine, 0)
+	for idx, text := range strings.Split(source, "\n") {
+		statements, err := splitLine(text)
+		if err != nil {
+			t.Fatalf("line %d: %s", idx+1, err)
+		}
+		for _, operands := range statements {
+			lines = append(lines, sourceLine{operands, gvm.Context{FileName: "test.gsm", LineNum: idx + 1}})
+		}
+	}
+	return compile(lines, "test.gsm")
+}
+
+func TestOptimizerPasses(t *testing.T) {
+	dropNoops := (*optimizer).dropNoops
+	threadJumps := (*optimizer).threadJumps
+	dropJumpsToNext := (*optimizer).dropJumpsToNext
+	dropUnreachable := (*optimizer).dropUnreachable
+
+	cases := []struct {
+		name   string
+		pass   func(*optimizer) bool
+		before string
+		after  string
+	}{
+		{"noops", dropNoops,
+			"main:\nnoop\nconst 3 r1\n.loop: noop\ndec r1\njne .loop\nhalt",
+			"main:\nconst 3 r1\n.loop: dec r1\njne .loop\nhalt"},
+		{"no noops", dropNoops, "main:\ninc r1\nhalt", ""},
+
+		{"jump to a jump", threadJumps,
+			"main:\njeq .a\nhalt\n.a: jmp .b\n.b: halt",
+			"main:\njeq .b\nhalt\n.a: jmp .b\n.b: halt"},
+		{"chain of jumps", threadJumps,
+			"main:\ncall f\nhalt\nf: jmp .a\n.a: jmp g\ng: ret",
+			"main:\ncall g\nhalt\nf: jmp g\n.a: jmp g\ng: ret"},
+		{"handler leading to a jump", threadJumps,
+			"main:\ntry .a r1\nhalt\n.a: jmp .b\n.b: halt",
+			"main:\ntry .b r1\nhalt\n.a: jmp .b\n.b: halt"},
+		{"jump looping forever", threadJumps, "main:\njmp .spin\n.spin: jmp .spin", ""},
+
+		{"jmp to the next instruction", dropJumpsToNext, "main:\njmp .next\n.next: halt", "main:\n.next: halt"},
+		{"conditional jump to the next instruction", dropJumpsToNext,
+			"main:\ncmp r1 r2\njeq .next\n.next: halt", "main:\ncmp r1 r2\n.next: halt"},
+		{"jerr to the next instruction", dropJumpsToNext, "main:\niarg r1\njerr .next\n.next: halt", ""},
+		{"jump further", dropJumpsToNext, "main:\njmp .end\ninc r1\n.end: halt", ""},
+
+		{"after halt", dropUnreachable,
+			"main:\njeq .used\nhalt\ninc r1\n.unused: dec r1\n.used: ret",
+			"main:\njeq .used\nhalt\n.used: ret"},
+		{"after jmp and ret", dropUnreachable,
+			"main:\ncall f\njmp end\ninc r1\nf: ret\ndec r1\nend: halt",
+			"main:\ncall f\njmp end\nf: ret\nend: halt"},
+		{"used as data", dropUnreachable, "main:\nconst .data r1\nhalt\n.data: inc r1\nhalt", ""},
+		{"exported", dropUnreachable, ".global helper\nmain:\nhalt\nhelper: ret", ""},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			obj := compileLines(t, c.before)
+			opt, ok := newOptimizer(obj)
+			if !ok {
+				t.Fatal("the code can't be optimized")
+			}
+			changed := c.pass(opt)
+			if changed != (c.after != "") {
+				t.Errorf("the pass reported a change: %v", changed)
+			}
+			opt.rewrite()
+
+			after := c.after
+			if after == "" {
+				after = c.before
+			}
+			got := link([]*object{obj}, true).Code
+			expected := link([]*object{compileLines(t, after)}, true).Code
+			if !reflect.DeepEqual(got, expected) {
+				t.Errorf("got %v, expected %v", got, expected)
+			}
+		})
+	}
+}
@@ -10,38 +10,59 @@ import (
 func parseInstruction(repr string, ctxt gvm.Context) gvm.Code {
 	instruction, err := lang.ParseInstruction(repr)
 	if err != nil {
-		gvm.Logger.Criticalf("%s.%d: Parsing instruction: %s\n",
-			ctxt.FileName, ctxt.LineNum, err.Error())
+		gvm.Logger.Criticalf("%s: Parsing instruction: %s\n",
+			ctxt, err.Error())
 		os.Exit(1)
 	}
 
 	return instruction
 }
 
-func parseRegister(repr string, ctxt gvm.Context) gvm.Code {
+// parseRegister parses a register, either by its number or by an alias.
+func parseRegister(op operand, aliases map[string]gvm.Code, ctxt gvm.Context) gvm.Code {
+	repr := op.String()
+	if reg, ok := aliases[repr]; ok {
+		return reg
+	}
+
 	if repr[0] != 'r' {
-		gvm.Logger.Criticalf("%s.%d: Parsing register: Expected 'r', got '%c'.\n",
-			ctxt.FileName, ctxt.LineNum, repr[0])
+		gvm.Logger.Criticalf("%s: Parsing register at column %d: Expected 'r', got '%c'.\n",
+			ctxt, op[0].column, repr[0])
 		os.Exit(1)
 	}
 
 	reg, err := strconv.ParseInt(repr[1:], 10, 64)
 	if err != nil {
-		gvm.Logger.Criticalf("%s.%d: Parsing register: Expected integer but got '%s'.\n",
-			ctxt.FileName, ctxt.LineNum, repr[1:])
+		gvm.Logger.Criticalf("%s: Parsing register at column %d: Expected integer but got '%s'.\n",
+			ctxt, op[0].column, repr[1:])
+		os.Exit(1)
+	}
+	if reg < 0 || reg >= int64(gvm.RegisterCount) {
+		gvm.Logger.Criticalf("%s: Parsing register at column %d: Expected r0 to r%d but got '%s'.\n",
+			ctxt, op[0].column, gvm.RegisterCount-1, repr)
 		os.Exit(1)
 	}
 
 	return gvm.Code(reg)
 }
 
-func parseInt(repr string, ctxt gvm.Context) gvm.Code {
-	val, err := strconv.ParseInt(repr, 10, 64)
+// parseValue evaluates an expression operand, whose value may still depend on
+// the positions of labels.
+func parseValue(op operand, resolve func(name string) (linear, error), ctxt gvm.Context) linear {
+	value, err := evalExpression(op, resolve)
 	if err != nil {
-		gvm.Logger.Criticalf("%s.%d: Parsing integer: Expected integer but got '%s'.\n",
-			ctxt.FileName, ctxt.LineNum, repr[1:])
+		gvm.Logger.Criticalf("%s: Parsing expression '%s': %s.\n", ctxt, op, err.Error())
 		os.Exit(1)
 	}
 
-	return gvm.Code(val)
+	return value
+}
+
+// isRegisterName reports whether repr would be parsed as a register.
+func isRegisterName(repr string) bool {
+	if len(repr) < 2 || repr[0] != 'r' {
+		return false
+	}
+	_, err := strconv.ParseInt(repr[1:], 10, 64)
+	return err == nil
 }
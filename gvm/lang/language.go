@@ -34,6 +34,35 @@ const (
 	Ret
 	Noop
 	Iarg
+	Jb
+	Ja
+	Jbe
+	Jae
+	Cmoveq
+	Cmovne
+	Cmovgt
+	Cmovlt
+	Cmovge
+	Cmovle
+	Cmovb
+	Cmova
+	Cmovbe
+	Cmovae
+	Seteq
+	Setne
+	Setgt
+	Setlt
+	Setge
+	Setle
+	Setb
+	Seta
+	Setbe
+	Setae
+	Assert
+	Trap
+	Try
+	Endtry
+	Throw
 )
 
 // Mappings between instructions and their string representations
@@ -73,6 +102,35 @@ func init() {
 	reprFromIns[Ret] = "ret"
 	reprFromIns[Noop] = "noop"
 	reprFromIns[Iarg] = "iarg"
+	reprFromIns[Jb] = "jb"
+	reprFromIns[Ja] = "ja"
+	reprFromIns[Jbe] = "jbe"
+	reprFromIns[Jae] = "jae"
+	reprFromIns[Cmoveq] = "cmoveq"
+	reprFromIns[Cmovne] = "cmovne"
+	reprFromIns[Cmovgt] = "cmovgt"
+	reprFromIns[Cmovlt] = "cmovlt"
+	reprFromIns[Cmovge] = "cmovge"
+	reprFromIns[Cmovle] = "cmovle"
+	reprFromIns[Cmovb] = "cmovb"
+	reprFromIns[Cmova] = "cmova"
+	reprFromIns[Cmovbe] = "cmovbe"
+	reprFromIns[Cmovae] = "cmovae"
+	reprFromIns[Seteq] = "seteq"
+	reprFromIns[Setne] = "setne"
+	reprFromIns[Setgt] = "setgt"
+	reprFromIns[Setlt] = "setlt"
+	reprFromIns[Setge] = "setge"
+	reprFromIns[Setle] = "setle"
+	reprFromIns[Setb] = "setb"
+	reprFromIns[Seta] = "seta"
+	reprFromIns[Setbe] = "setbe"
+	reprFromIns[Setae] = "setae"
+	reprFromIns[Assert] = "assert"
+	reprFromIns[Trap] = "trap"
+	reprFromIns[Try] = "try"
+	reprFromIns[Endtry] = "endtry"
+	reprFromIns[Throw] = "throw"
 
 	for instruction, repr := range reprFromIns {
 		instructionFromRepr[repr] = instruction
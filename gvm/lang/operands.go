@@ -0,0 +1,57 @@
+package lang
+
+import "github.com/vsartor/gvm/gvm"
+
+// Kinds of operands taken by instructions
+const (
+	// Index of a register
+	RegisterOperand = iota
+	// Integer constant
+	ConstantOperand
+	// Code position, written as a label in the source
+	LabelOperand
+)
+
+// Operands returns the kinds of the operands taken by an instruction, in the
+// order they follow it in the code, and false for unknown instructions.
+func Operands(ins gvm.Code) ([]int, bool) {
+	switch ins {
+	case Halt, Ret, Noop, Endtry:
+		return []int{}, true
+	case Const:
+		return []int{ConstantOperand, RegisterOperand}, true
+	case Mov, Add, Sub, Mul, Div, Rem, Cmp,
+		Cmoveq, Cmovne, Cmovgt, Cmovlt, Cmovge, Cmovle, Cmovb, Cmova, Cmovbe, Cmovae:
+		return []int{RegisterOperand, RegisterOperand}, true
+	case Jmp, Jeq, Jne, Jgt, Jlt, Jge, Jle, Jerr, Call, Jb, Ja, Jbe, Jae:
+		return []int{LabelOperand}, true
+	case Try:
+		return []int{LabelOperand, RegisterOperand}, true
+	case Trap:
+		return []int{ConstantOperand}, true
+	case Show, Inc, Dec, Push, Pop, Iarg, Assert, Throw,
+		Seteq, Setne, Setgt, Setlt, Setge, Setle, Setb, Seta, Setbe, Setae:
+		return []int{RegisterOperand}, true
+	}
+	return nil, false
+}
+
+// IsJump reports whether an instruction is a jump, conditional or not.
+func IsJump(ins gvm.Code) bool {
+	switch ins {
+	case Jmp, Jeq, Jne, Jgt, Jlt, Jge, Jle, Jerr, Jb, Ja, Jbe, Jae:
+		return true
+	}
+	return false
+}
+
+// FallsThrough reports whether execution may continue with the instruction
+// following ins. Traps and throws never do, even when the fault they raise is
+// handled, since the handler is elsewhere.
+func FallsThrough(ins gvm.Code) bool {
+	switch ins {
+	case Halt, Jmp, Ret, Trap, Throw:
+		return false
+	}
+	return true
+}
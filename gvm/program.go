@@ -0,0 +1,128 @@
+package gvm
+
+import (
+	"fmt"
+	"sort"
+)
+
+// LineEntry maps the instruction starting at Position to a line of source.
+type LineEntry struct {
+	Position int64
+	File     int64
+	Line     int64
+}
+
+// AliasEntry records that Name referred to Register for the instructions in the
+// positions from Start up to, but not including, End.
+type AliasEntry struct {
+	Name     string
+	Register int64
+	Start    int64
+	End      int64
+}
+
+// DebugInfo relates compiled code back to the source it was compiled from.
+type DebugInfo struct {
+	// Files holds the names of the source files, referenced by index from Lines.
+	Files []string
+	// Lines holds one entry per instruction, sorted by position.
+	Lines []LineEntry
+	// Symbols maps every label to its code position.
+	Symbols map[string]int64
+	// Aliases holds the names given to registers in the source.
+	Aliases []AliasEntry
+}
+
+type Program struct {
+	Code []Code
+	// Debug is nil when the binary file carries no debug information.
+	Debug *DebugInfo
+	// Offsets maps the position of each instruction to its byte offset in the
+	// compact encoding, and is nil unless the program was read from it.
+	Offsets map[int64]int64
+}
+
+func NewDebugInfo() *DebugInfo {
+	return &DebugInfo{Symbols: make(map[string]int64)}
+}
+
+// AddLine records that the instruction at position was read from ctxt,
+// registering its file name if it was not seen before.
+func (debug *DebugInfo) AddLine(position int64, ctxt Context) {
+	fileIdx := -1
+	for idx, fileName := range debug.Files {
+		if fileName == ctxt.FileName {
+			fileIdx = idx
+			break
+		}
+	}
+	if fileIdx < 0 {
+		fileIdx = len(debug.Files)
+		debug.Files = append(debug.Files, ctxt.FileName)
+	}
+
+	debug.Lines = append(debug.Lines, LineEntry{position, int64(fileIdx), int64(ctxt.LineNum)})
+}
+
+// SourceOf returns the source context of the instruction at position.
+func (debug *DebugInfo) SourceOf(position int64) (Context, bool) {
+	if debug == nil {
+		return Context{}, false
+	}
+
+	idx := sort.Search(len(debug.Lines), func(i int) bool {
+		return debug.Lines[i].Position >= position
+	})
+	if idx == len(debug.Lines) || debug.Lines[idx].Position != position {
+		return Context{}, false
+	}
+
+	entry := debug.Lines[idx]
+	return Context{FileName: debug.Files[entry.File], LineNum: int(entry.Line)}, true
+}
+
+// SymbolOf describes position relative to the closest label preceding it,
+// e.g. `main.loop+3`.
+func (debug *DebugInfo) SymbolOf(position int64) (string, bool) {
+	if debug == nil {
+		return "", false
+	}
+
+	bestName, bestPosition := "", int64(-1)
+	for name, labelPosition := range debug.Symbols {
+		if labelPosition > position || labelPosition < bestPosition {
+			continue
+		}
+		// Prefer the lexicographically smallest name for labels sharing a
+		// position so the output is deterministic.
+		if labelPosition == bestPosition && name > bestName {
+			continue
+		}
+		bestName, bestPosition = name, labelPosition
+	}
+
+	if bestPosition < 0 {
+		return "", false
+	}
+	if bestPosition == position {
+		return bestName, true
+	}
+	return fmt.Sprintf("%s+%d", bestName, position-bestPosition), true
+}
+
+// AliasOf returns the name given to a register by the instruction at position,
+// preferring the most recently defined one if there are many.
+func (debug *DebugInfo) AliasOf(position int64, register int64) (string, bool) {
+	if debug == nil {
+		return "", false
+	}
+
+	name, start := "", int64(-1)
+	for _, alias := range debug.Aliases {
+		if alias.Register == register && alias.Start <= position && position < alias.End && alias.Start >= start {
+			name, start = alias.Name, alias.Start
+		}
+	}
+
+	return name, start >= 0
+}
@@ -3,6 +3,12 @@ package gvm
 // Header file for GVM Binary File
 const BinaryFileHeader int64 = 20200111
 
+// Header file for GVM Binary File using the compact encoding
+const CompactFileHeader int64 = 20261020
+
+// Header file for GVM Object File
+const ObjectFileHeader int64 = 20261019
+
 // Initial capacity for the code array during compilation
 const CodeArrayInitialSize int = 128
 
@@ -10,3 +16,8 @@ const CodeArrayInitialSize int = 128
 const RegisterCount int = 16
 const StackSize int = 1024
 const CallStackSize = 128
+const HandlerStackSize = 128
+
+// Debugger history configuration, in steps
+const DebugHistorySize = 100000
+const DebugSnapshotInterval = 1000
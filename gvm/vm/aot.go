@@ -0,0 +1,311 @@
+package vm
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/vsartor/gvm/gvm"
+	"github.com/vsartor/gvm/gvm/compiler"
+	"github.com/vsartor/gvm/gvm/lang"
+	"go/format"
+	"go/token"
+	"os"
+	"strconv"
+)
+
+// goEmitter translates a program into a Go function where each instruction is
+// a few statements, registers are local variables and jumps are `goto`s. Calls
+// and handlers resume through a switch on the code position to go back to.
+type goEmitter struct {
+	*translation
+	buf bytes.Buffer
+	// Whether the code raises faults, and whether it resumes at a position
+	// decided at run time, which need the code after the `raise` and
+	// `dispatch` labels
+	raises     bool
+	dispatches bool
+	usesArgs   bool
+}
+
+func (e *goEmitter) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&e.buf, format, args...)
+}
+
+func goRegister(register gvm.Code) string {
+	return fmt.Sprintf("r%d", register)
+}
+
+func goLabel(position int64) string {
+	return fmt.Sprintf("p%04d", position)
+}
+
+// goJump continues execution at position, where the end of the code returns.
+func (e *goEmitter) goJump(position int64) string {
+	if position == e.end() {
+		return "return nil"
+	}
+	return "goto " + goLabel(position)
+}
+
+// goRaise raises a fault at the instruction at position.
+func (e *goEmitter) goRaise(position int64, code string) string {
+	e.raises = true
+	return fmt.Sprintf("fault, faultAt = %s, %s\ngoto raise", code, strconv.Quote(e.location(position)))
+}
+
+// goThrow raises a fault on behalf of the program, as `trap` and `throw` do.
+func (e *goEmitter) goThrow(position int64, code string) string {
+	return "thrown = true\n" + e.goRaise(position, code)
+}
+
+func (e *goEmitter) emitInstruction(ins decodedInstruction) {
+	op := func(idx int) string { return goRegister(ins.operands[idx]) }
+	target, _ := ins.target()
+
+	switch ins.instruction {
+	case lang.Halt:
+		e.printf("return nil\n")
+	case lang.Const:
+		e.printf("%s = %d\n", op(1), ins.operands[0])
+	case lang.Push:
+		e.printf("if sp == len(stack) {\n%s\n}\n", e.goRaise(ins.position, "faultStackOverflow"))
+		e.printf("stack[sp] = %s\nsp++\n", op(0))
+	case lang.Pop:
+		e.printf("if sp == 0 {\n%s\n}\n", e.goRaise(ins.position, "faultStackUnderflow"))
+		e.printf("sp--\n%s = stack[sp]\n", op(0))
+	case lang.Inc:
+		e.printf("%s++\n", op(0))
+	case lang.Dec:
+		e.printf("%s--\n", op(0))
+	case lang.Mov:
+		e.printf("%s = %s\n", op(1), op(0))
+	case lang.Add:
+		e.printf("%s += %s\n", op(1), op(0))
+	case lang.Sub:
+		e.printf("%s -= %s\n", op(1), op(0))
+	case lang.Mul:
+		e.printf("%s *= %s\n", op(1), op(0))
+	case lang.Div:
+		e.printf("if %s == 0 {\n%s\n}\n", op(0), e.goRaise(ins.position, "faultDivisionByZero"))
+		e.printf("%s /= %s\n", op(1), op(0))
+	case lang.Rem:
+		e.printf("if %s == 0 {\n%s\n}\n", op(0), e.goRaise(ins.position, "faultDivisionByZero"))
+		e.printf("%s %%= %s\n", op(1), op(0))
+	case lang.Cmp:
+		e.printf("cmpFlag = compareFlags(%s, %s)\n", op(1), op(0))
+	case lang.Cmoveq, lang.Cmovne, lang.Cmovgt, lang.Cmovlt, lang.Cmovge, lang.Cmovle,
+		lang.Cmovb, lang.Cmova, lang.Cmovbe, lang.Cmovae:
+		e.printf("if %s {\n%s = %s\n}\n", condition(ins.instruction), op(1), op(0))
+	case lang.Seteq, lang.Setne, lang.Setgt, lang.Setlt, lang.Setge, lang.Setle,
+		lang.Setb, lang.Seta, lang.Setbe, lang.Setae:
+		e.printf("if %s {\n%s = 1\n} else {\n%s = 0\n}\n", condition(ins.instruction), op(0), op(0))
+	case lang.Jmp:
+		e.printf("%s\n", e.goJump(target))
+	case lang.Jeq, lang.Jne, lang.Jgt, lang.Jlt, lang.Jge, lang.Jle, lang.Jb, lang.Ja, lang.Jbe, lang.Jae:
+		e.printf("if %s {\n%s\n}\n", condition(ins.instruction), e.goJump(target))
+	case lang.Jerr:
+		e.printf("if errFlag != 0 {\nerrFlag = 0\n%s\n}\n", e.goJump(target))
+	case lang.Show:
+		e.printf("fmt.Printf(\"%%d\\n\", %s)\n", op(0))
+	case lang.Call:
+		e.printf("if csp == len(callStack) {\n%s\n}\n", e.goRaise(ins.position, "faultCallStackOverflow"))
+		e.printf("callStack[csp] = %d\ncsp++\n%s\n", ins.next(), e.goJump(target))
+	case lang.Ret:
+		e.dispatches = true
+		e.printf("if csp == 0 {\n%s\n}\n", e.goRaise(ins.position, "faultCallStackUnderflow"))
+		e.printf("csp--\nresume = callStack[csp]\n")
+		e.printf("// Handlers installed by the returning routine go out of scope\n")
+		e.printf("for hp > 0 && handlers[hp-1].csp > csp {\nhp--\n}\n")
+		e.printf("goto dispatch\n")
+	case lang.Noop:
+	case lang.Iarg:
+		e.usesArgs = true
+		e.printf("if idx := %s; idx < 0 || idx >= int64(len(args)) {\nerrFlag = 1\n", op(0))
+		e.printf("} else if value, err := strconv.ParseInt(args[idx], 10, 64); err != nil {\nerrFlag = 1\n")
+		e.printf("} else if sp == len(stack) {\n%s\n", e.goRaise(ins.position, "faultStackOverflow"))
+		e.printf("} else {\nstack[sp] = value\nsp++\n}\n")
+	case lang.Assert:
+		e.printf("if %s == 0 {\n%s\n}\n", op(0), e.goRaise(ins.position, "faultAssertion"))
+	case lang.Trap:
+		e.printf("%s\n", e.goThrow(ins.position, strconv.FormatInt(int64(ins.operands[0]), 10)))
+	case lang.Try:
+		e.printf("if hp == len(handlers) {\n%s\n}\n", e.goRaise(ins.position, "faultHandlerStackOverflow"))
+		e.printf("handlers[hp] = handler{resume: %d, register: %d, csp: csp, sp: sp}\nhp++\n",
+			target, ins.operands[1])
+	case lang.Endtry:
+		e.printf("if hp == 0 || handlers[hp-1].csp != csp {\n%s\n}\n",
+			e.goRaise(ins.position, "faultUnmatchedEndtry"))
+		e.printf("hp--\n")
+	case lang.Throw:
+		e.printf("%s\n", e.goThrow(ins.position, op(0)))
+	default:
+		panic("This path should be impossible.")
+	}
+}
+
+// emitRun writes the function running the code.
+func (e *goEmitter) emitRun() {
+	e.printf("// Run runs the program with the given arguments, returning a *Fault if\n")
+	e.printf("// execution is stopped by a fault.\n")
+	e.printf("func Run(args []string) error {\n")
+	e.printf("var (\n")
+	for register := 0; register < gvm.RegisterCount; register++ {
+		e.printf("%s int64\n", goRegister(gvm.Code(register)))
+	}
+	e.printf("stack [%d]int64\nsp int\n", gvm.StackSize)
+	e.printf("callStack [%d]int64\ncsp int\n", gvm.CallStackSize)
+	e.printf("handlers [%d]handler\nhp int\n", gvm.HandlerStackSize)
+	e.printf("cmpFlag, errFlag int64\n")
+	e.printf("fault int64\nfaultAt string\nthrown bool\nresume int64\n")
+	e.printf(")\n")
+	e.printf("// Not every program uses all of the state of the GVM\n")
+	for register := 0; register < gvm.RegisterCount; register++ {
+		e.printf("_ = %s\n", goRegister(gvm.Code(register)))
+	}
+	for _, name := range []string{"stack", "sp", "callStack", "csp", "handlers", "hp",
+		"cmpFlag", "errFlag", "fault", "faultAt", "thrown", "resume"} {
+		e.printf("_ = %s\n", name)
+	}
+	e.printf("\n")
+
+	for idx, ins := range e.instructions {
+		if e.isLabeled(ins.position) {
+			e.printf("%s:\n", goLabel(ins.position))
+		}
+		e.printf("// %s: %s\n", e.location(ins.position), e.describe(ins))
+		e.emitInstruction(ins)
+
+		// Instructions that aren't reached by falling through are labeled
+		if lang.FallsThrough(ins.instruction) && (idx+1 == len(e.instructions) ||
+			e.instructions[idx+1].position != ins.next()) {
+			e.printf("%s\n", e.goJump(ins.next()))
+		}
+	}
+	if len(e.instructions) == 0 {
+		e.printf("return nil\n")
+	}
+
+	if e.raises {
+		e.dispatches = true
+		e.printf("\nraise:\n")
+		e.printf("if hp > 0 {\n")
+		e.printf("hp--\nh := handlers[hp]\ncsp, sp, thrown = h.csp, h.sp, false\n")
+		e.printf("switch h.register {\n")
+		for _, register := range e.faultRegisters {
+			e.printf("case %d:\n%s = fault\n", register, goRegister(register))
+		}
+		e.printf("}\nresume = h.resume\ngoto dispatch\n}\n")
+		e.printf("return &Fault{Code: fault, Location: faultAt, Thrown: thrown}\n")
+	}
+
+	if e.dispatches {
+		e.printf("\ndispatch:\n")
+		e.printf("switch resume {\n")
+		for _, position := range e.resumes {
+			e.printf("case %d:\n%s\n", position, e.goJump(position))
+		}
+		e.printf("}\n")
+		e.printf("panic(\"unexpected code position\")\n")
+	}
+
+	e.printf("}\n")
+}
+
+// emitGo writes a Go source file with the translated program, either as a
+// standalone program or as a package exporting Run.
+func emitGo(t *translation, pkg string) []byte {
+	e := &goEmitter{translation: t}
+	e.emitRun()
+	run := e.buf.Bytes()
+
+	e.buf = bytes.Buffer{}
+	e.printf("// Code generated by gvm aot. DO NOT EDIT.\n\n")
+	if pkg == "" {
+		e.printf("package main\n\n")
+	} else {
+		e.printf("package %s\n\n", pkg)
+	}
+	e.printf("import (\n\"fmt\"\n")
+	if pkg == "" {
+		e.printf("\"os\"\n")
+	}
+	if e.usesArgs {
+		e.printf("\"strconv\"\n")
+	}
+	e.printf(")\n\n")
+
+	e.printf("// Codes of the faults raised by the GVM itself\n")
+	e.printf("const (\n")
+	names := map[int64]string{
+		FaultUnknownInstruction:   "faultUnknownInstruction",
+		FaultStackUnderflow:       "faultStackUnderflow",
+		FaultCallStackOverflow:    "faultCallStackOverflow",
+		FaultCallStackUnderflow:   "faultCallStackUnderflow",
+		FaultAssertion:            "faultAssertion",
+		FaultStackOverflow:        "faultStackOverflow",
+		FaultDivisionByZero:       "faultDivisionByZero",
+		FaultHandlerStackOverflow: "faultHandlerStackOverflow",
+		FaultUnmatchedEndtry:      "faultUnmatchedEndtry",
+	}
+	for _, code := range sortedFaultCodes() {
+		e.printf("%s int64 = %d\n", names[code], code)
+	}
+	e.printf(")\n\n")
+
+	e.printf("var faultDescriptions = map[int64]string{\n")
+	for _, code := range sortedFaultCodes() {
+		e.printf("%s: %s,\n", names[code], strconv.Quote(faultDescriptions[code]))
+	}
+	e.printf("}\n\n")
+
+	e.printf("// Fault is the error returned by Run when execution is stopped by a fault.\n")
+	e.printf("type Fault struct {\nCode int64\nLocation string\nThrown bool\n}\n\n")
+	e.printf("func (fault *Fault) Error() string {\n")
+	e.printf("description, ok := faultDescriptions[fault.Code]\n")
+	e.printf("if fault.Thrown || !ok {\ndescription = fmt.Sprintf(\"trap %%d\", fault.Code)\n}\n")
+	e.printf("return fmt.Sprintf(\"%%s at %%s\", description, fault.Location)\n}\n\n")
+
+	e.printf("type handler struct {\nresume int64\nregister int\ncsp, sp int\n}\n\n")
+
+	e.printf("const (\nzeroFlag int64 = 1 << iota\nsignFlag\ncarryFlag\noverflowFlag\n)\n\n")
+	e.printf("func compareFlags(lhs, rhs int64) int64 {\n")
+	e.printf("diff := lhs - rhs\nflags := int64(0)\n")
+	e.printf("if diff == 0 {\nflags |= zeroFlag\n}\n")
+	e.printf("if diff < 0 {\nflags |= signFlag\n}\n")
+	e.printf("if uint64(lhs) < uint64(rhs) {\nflags |= carryFlag\n}\n")
+	e.printf("if (lhs^rhs)&(lhs^diff) < 0 {\nflags |= overflowFlag\n}\n")
+	e.printf("return flags\n}\n\n")
+	e.printf("func isEqual(flags int64) bool {\nreturn flags&zeroFlag != 0\n}\n\n")
+	e.printf("func isLess(flags int64) bool {\nreturn (flags&signFlag != 0) != (flags&overflowFlag != 0)\n}\n\n")
+	e.printf("func isBelow(flags int64) bool {\nreturn flags&carryFlag != 0\n}\n\n")
+
+	e.buf.Write(run)
+
+	if pkg == "" {
+		e.printf("\nfunc main() {\n")
+		e.printf("if err := Run(os.Args[1:]); err != nil {\n")
+		e.printf("fmt.Fprintf(os.Stderr, \"Execution stopped: %%s.\\n\", err.Error())\n")
+		e.printf("os.Exit(1)\n}\n}\n")
+	}
+
+	source, err := format.Source(e.buf.Bytes())
+	if err != nil {
+		gvm.Logger.Criticalf("Failed formatting the Go source: %s\n", err.Error())
+		os.Exit(1)
+	}
+	return source
+}
+
+// TranslateToGo translates a program into Go source code, which runs it the
+// same way the GVM would. The code is a standalone program unless a package
+// name is given, in which case the package exports a function running it.
+func TranslateToGo(filePaths []string, options compiler.Options, dstPath string, pkg string) {
+	if pkg != "" && !token.IsIdentifier(pkg) {
+		gvm.Logger.Criticalf("Invalid package name '%s'.\n", pkg)
+		os.Exit(1)
+	}
+
+	program := loadProgram(filePaths, options)
+
+	gvm.Logger.Infof("Translating to Go.\n")
+	writeTranslation(dstPath, emitGo(newTranslation(program), pkg))
+}
@@ -0,0 +1,224 @@
+package vm
+
+import (
+	"fmt"
+	"github.com/vsartor/gvm/gvm"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// breakCondition compares a register with another register or with a constant.
+type breakCondition struct {
+	lhs int64
+	op  string
+	rhs int64
+	// Whether rhs is the index of a register rather than a constant
+	rhsRegister bool
+}
+
+func (cond *breakCondition) holds(vm *virtualMachine) bool {
+	lhs, rhs := vm.reg[cond.lhs], cond.rhs
+	if cond.rhsRegister {
+		rhs = vm.reg[cond.rhs]
+	}
+
+	switch cond.op {
+	case "==":
+		return lhs == rhs
+	case "!=":
+		return lhs != rhs
+	case "<":
+		return lhs < rhs
+	case "<=":
+		return lhs <= rhs
+	case ">":
+		return lhs > rhs
+	case ">=":
+		return lhs >= rhs
+	default:
+		panic("This path should be impossible.")
+	}
+}
+
+func (cond *breakCondition) String() string {
+	if cond.rhsRegister {
+		return fmt.Sprintf("r%d %s r%d", cond.lhs, cond.op, cond.rhs)
+	}
+	return fmt.Sprintf("r%d %s %d", cond.lhs, cond.op, cond.rhs)
+}
+
+// breakpoint stops the debugger before the instruction at a position runs.
+type breakpoint struct {
+	id       int
+	position int64
+	// Condition that must hold for the breakpoint to be hit, if any
+	condition *breakCondition
+	// Number of hits to let by before stopping
+	after int64
+	// Steps the breakpoint was hit at, in order, and the furthest step it was
+	// checked at
+	hitSteps    []int64
+	checkedStep int64
+}
+
+// hit reports whether the breakpoint is hit at the given step and, if so, how
+// many hits there were up to it. Each step is only counted the first time it's
+// checked, so going back and running it again finds the same hit.
+func (bp *breakpoint) hit(vm *virtualMachine, step int64) (int64, bool) {
+	if step > bp.checkedStep {
+		bp.checkedStep = step
+		if bp.condition != nil && !bp.condition.holds(vm) {
+			return 0, false
+		}
+		bp.hitSteps = append(bp.hitSteps, step)
+		return int64(len(bp.hitSteps)), true
+	}
+
+	idx := sort.Search(len(bp.hitSteps), func(i int) bool { return bp.hitSteps[i] >= step })
+	if idx < len(bp.hitSteps) && bp.hitSteps[idx] == step {
+		return int64(idx + 1), true
+	}
+	return 0, false
+}
+
+// watchpoint stops the debugger when a register changes or when the depth of
+// the stack crosses a threshold.
+type watchpoint struct {
+	id int
+	// Register watched, or -1 for the depth of the stack
+	register int64
+	depth    int64
+	// Value when last checked
+	last int64
+}
+
+func (w *watchpoint) value(vm *virtualMachine) int64 {
+	if w.register < 0 {
+		return vm.stackPtr
+	}
+	return vm.reg[w.register]
+}
+
+// triggered reports whether the watched value changing from before to after
+// should stop the debugger. The depth of the stack crosses the threshold when
+// it goes from below it to at least it, or the other way around.
+func (w *watchpoint) triggered(before, after int64) bool {
+	if w.register < 0 {
+		return (before < w.depth) != (after < w.depth)
+	}
+	return before != after
+}
+
+func (w *watchpoint) String() string {
+	if w.register < 0 {
+		return fmt.Sprintf("stack %d", w.depth)
+	}
+	return fmt.Sprintf("r%d", w.register)
+}
+
+func (w *watchpoint) describe(before, after int64) string {
+	if w.register < 0 {
+		return fmt.Sprintf("Watchpoint %d: stack depth went from %d to %d, crossing %d.", w.id, before, after, w.depth)
+	}
+	return fmt.Sprintf("Watchpoint %d: r%d went from %d to %d.", w.id, w.register, before, after)
+}
+
+// parseDebugRegister parses a register written as in the source, e.g. `r3`.
+func parseDebugRegister(text string) (int64, error) {
+	if strings.HasPrefix(text, "r") {
+		if idx, err := strconv.ParseInt(text[1:], 10, 64); err == nil && idx >= 0 && idx < int64(gvm.RegisterCount) {
+			return idx, nil
+		}
+	}
+	return 0, fmt.Errorf("expected r0 to r%d but got '%s'", gvm.RegisterCount-1, text)
+}
+
+// parseCondition parses `<register> <op> <register or constant>`.
+func parseCondition(tokens []string) (*breakCondition, error) {
+	lhs, err := parseDebugRegister(tokens[0])
+	if err != nil {
+		return nil, err
+	}
+
+	cond := &breakCondition{lhs: lhs, op: tokens[1]}
+	switch cond.op {
+	case "==", "!=", "<", "<=", ">", ">=":
+	default:
+		return nil, fmt.Errorf("expected one of ==, !=, <, <=, > or >= but got '%s'", cond.op)
+	}
+
+	if rhs, err := strconv.ParseInt(tokens[2], 10, 64); err == nil {
+		cond.rhs = rhs
+		return cond, nil
+	}
+	if cond.rhs, err = parseDebugRegister(tokens[2]); err != nil {
+		return nil, fmt.Errorf("expected a register or a constant but got '%s'", tokens[2])
+	}
+	cond.rhsRegister = true
+	return cond, nil
+}
+
+// parseBreakpoint parses the arguments of `bp`, which are a label or a code
+// position optionally followed by `if <condition>` and `after <hits>`.
+func parseBreakpoint(tokens []string, debug *gvm.DebugInfo, owners []int64) (*breakpoint, error) {
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("`bp` requires a label or a code position")
+	}
+
+	bp := &breakpoint{checkedStep: -1}
+	found := false
+	if position, err := strconv.ParseInt(tokens[0], 10, 64); err == nil {
+		bp.position, found = position, true
+	} else if debug != nil {
+		bp.position, found = debug.Symbols[tokens[0]]
+	}
+	if !found {
+		return nil, fmt.Errorf("expected a label or a code position but got '%s'", tokens[0])
+	}
+	if bp.position < 0 || bp.position >= int64(len(owners)) || owners[bp.position] != bp.position {
+		return nil, fmt.Errorf("there is no instruction that can run at %d", bp.position)
+	}
+
+	for rest := tokens[1:]; len(rest) > 0; {
+		switch {
+		case rest[0] == "if" && len(rest) >= 4 && bp.condition == nil:
+			cond, err := parseCondition(rest[1:4])
+			if err != nil {
+				return nil, err
+			}
+			bp.condition, rest = cond, rest[4:]
+		case rest[0] == "after" && len(rest) >= 2:
+			after, err := strconv.ParseInt(rest[1], 10, 64)
+			if err != nil || after < 0 {
+				return nil, fmt.Errorf("expected a number of hits but got '%s'", rest[1])
+			}
+			bp.after, rest = after, rest[2:]
+		default:
+			return nil, fmt.Errorf("expected `if <register> <op> <value>` or `after <hits>` but got '%s'",
+				strings.Join(rest, " "))
+		}
+	}
+	return bp, nil
+}
+
+// parseWatchpoint parses the arguments of `watch`, which are either a
+// register or `stack` followed by a depth.
+func parseWatchpoint(tokens []string) (*watchpoint, error) {
+	switch {
+	case len(tokens) == 2 && tokens[0] == "stack":
+		depth, err := strconv.ParseInt(tokens[1], 10, 64)
+		if err != nil || depth < 0 {
+			return nil, fmt.Errorf("expected a stack depth but got '%s'", tokens[1])
+		}
+		return &watchpoint{register: -1, depth: depth}, nil
+	case len(tokens) == 1:
+		register, err := parseDebugRegister(tokens[0])
+		if err != nil {
+			return nil, err
+		}
+		return &watchpoint{register: register}, nil
+	default:
+		return nil, fmt.Errorf("`watch` requires a register or `stack <depth>`")
+	}
+}
@@ -0,0 +1,148 @@
+package vm
+
+import (
+	"bytes"
+	"github.com/vsartor/gvm/gvm/compiler"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// conformanceCases are the examples, and the programs in testdata/conformance
+// going over comparisons and faults, along with the arguments they're run with.
+var conformanceCases = []struct {
+	name string
+	path string
+	args []string
+}{
+	{"arithmetic", "../../examples/arithmetic.gsm", nil},
+	{"fibonacci", "../../examples/fibonacci.gsm", []string{"20"}},
+	{"fibonacci-bad-input", "../../examples/fibonacci.gsm", []string{"twenty"}},
+	{"fibonacci-overflow", "../../examples/fibonacci.gsm", []string{"100000"}},
+	{"jumper", "../../examples/jumper.gsm", nil},
+	{"primes", "../../examples/primes.gsm", []string{"1000"}},
+	{"collatz", "../../examples/collatz.gsm", []string{"1000"}},
+	{"ackermann", "../../examples/ackermann.gsm", []string{"2", "3"}},
+	{"flags", "testdata/conformance/flags.gsm", nil},
+	{"handlers", "testdata/conformance/handlers.gsm", nil},
+	{"uncaught", "testdata/conformance/uncaught.gsm", nil},
+	{"throw", "testdata/conformance/throw.gsm", nil},
+}
+
+// outcome is what running a program shows from the outside.
+type outcome struct {
+	stdout, stderr string
+	status         int
+}
+
+// interpret runs a program in the GVM, reporting faults the same way as `run`.
+func interpret(t *testing.T, path string, args []string) outcome {
+	stdout, err := ioutil.TempFile("", "gvm-stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(stdout.Name())
+	defer stdout.Close()
+
+	saved := os.Stdout
+	os.Stdout = stdout
+	err = Run(compiler.Build([]string{path}, compiler.Options{}), args)
+	os.Stdout = saved
+
+	var result outcome
+	if err != nil {
+		result.stderr = "Execution stopped: " + err.Error() + ".\n"
+		result.status = 1
+	}
+	output, readErr := ioutil.ReadFile(stdout.Name())
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	result.stdout = string(output)
+	return result
+}
+
+// execute runs a translated program.
+func execute(t *testing.T, binary string, args []string) outcome {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(binary, args...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+
+	var result outcome
+	if err := cmd.Run(); err != nil {
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			t.Fatal(err)
+		}
+		result.status = exitErr.ExitCode()
+	}
+	result.stdout, result.stderr = stdout.String(), stderr.String()
+	return result
+}
+
+// build runs a tool building a translated program, failing the test with its
+// output if it doesn't succeed.
+func build(t *testing.T, name string, args ...string) {
+	if output, err := exec.Command(name, args...).CombinedOutput(); err != nil {
+		t.Fatalf("%s %v: %s\n%s", name, args, err, output)
+	}
+}
+
+// TestConformance checks that the programs translated to C and to Go behave
+// the same way as when they are run in the GVM.
+func TestConformance(t *testing.T) {
+	backends := []struct {
+		name string
+		// Tool building the translation, the test being skipped without it
+		tool string
+		// translate writes the translation of the source at path into dir and
+		// builds it, returning the path of the executable
+		translate func(t *testing.T, path string, dir string) string
+	}{
+		{"c", "cc", func(t *testing.T, path string, dir string) string {
+			source, binary := filepath.Join(dir, "main.c"), filepath.Join(dir, "main")
+			TranslateToC([]string{path}, compiler.Options{}, source)
+			build(t, "cc", "-std=c99", "-O2", "-o", binary, source)
+			return binary
+		}},
+		{"go", "go", func(t *testing.T, path string, dir string) string {
+			source, binary := filepath.Join(dir, "main.go"), filepath.Join(dir, "main")
+			TranslateToGo([]string{path}, compiler.Options{}, source, "")
+			build(t, "go", "build", "-o", binary, source)
+			return binary
+		}},
+	}
+
+	for _, backend := range backends {
+		backend := backend
+		t.Run(backend.name, func(t *testing.T) {
+			if _, err := exec.LookPath(backend.tool); err != nil {
+				t.Skipf("%s not found", backend.tool)
+			}
+
+			root, err := ioutil.TempDir("", "gvm-conformance")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(root)
+
+			for _, c := range conformanceCases {
+				c := c
+				t.Run(c.name, func(t *testing.T) {
+					dir := filepath.Join(root, c.name)
+					if err := os.Mkdir(dir, 0755); err != nil {
+						t.Fatal(err)
+					}
+					binary := backend.translate(t, c.path, dir)
+
+					want := interpret(t, c.path, c.args)
+					if got := execute(t, binary, c.args); got != want {
+						t.Errorf("translation ran with %+v, but the GVM ran with %+v", got, want)
+					}
+				})
+			}
+		})
+	}
+}
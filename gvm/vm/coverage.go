@@ -0,0 +1,447 @@
+package vm
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/vsartor/gvm/gvm"
+	"github.com/vsartor/gvm/gvm/compiler"
+	"github.com/vsartor/gvm/gvm/lang"
+	"html"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// First line of coverage files
+const coverageHeader = "gvm coverage"
+
+// coverage holds how many times each instruction of a program ran and how many
+// times each conditional jump was taken.
+type coverage struct {
+	// Hash of the code, telling whether runs are of the same program
+	hash string
+	// Path of the program, used to find its debug information
+	path   string
+	counts map[int64]int64
+	taken  map[int64]int64
+}
+
+func hashCode(code []gvm.Code) string {
+	digest := sha256.New()
+	for _, word := range code {
+		_ = binary.Write(digest, binary.LittleEndian, int64(word))
+	}
+	return hex.EncodeToString(digest.Sum(nil))
+}
+
+// isBranch reports whether an instruction is a conditional jump.
+func isBranch(ins gvm.Code) bool {
+	return lang.IsJump(ins) && ins != lang.Jmp
+}
+
+func newCoverage(program gvm.Program, path string) *coverage {
+	if absPath, err := filepath.Abs(path); err == nil {
+		path = absPath
+	}
+	return &coverage{
+		hash:   hashCode(program.Code),
+		path:   path,
+		counts: make(map[int64]int64),
+		taken:  make(map[int64]int64),
+	}
+}
+
+func (cov *coverage) before(vm *virtualMachine, code []gvm.Code) {
+	position := vm.codePosition
+	cov.counts[position]++
+
+	// Branches are listed even if never taken, so they are told apart
+	if ins := code[position]; isBranch(ins) {
+		var taken int64
+		if (ins == lang.Jerr && vm.errFlag != 0) || (ins != lang.Jerr && vm.conditionHolds(ins)) {
+			taken = 1
+		}
+		cov.taken[position] += taken
+	}
+}
+
+func (cov *coverage) after(vm *virtualMachine, position int64, depth int64) {}
+
+func (cov *coverage) merge(other *coverage) {
+	for position, count := range other.counts {
+		cov.counts[position] += count
+	}
+	for position, taken := range other.taken {
+		cov.taken[position] += taken
+	}
+}
+
+func (cov *coverage) encode(w io.Writer) {
+	fmt.Fprintln(w, coverageHeader)
+	fmt.Fprintf(w, "program %s %s\n", cov.hash, cov.path)
+
+	positions := make([]int64, 0, len(cov.counts))
+	for position := range cov.counts {
+		positions = append(positions, position)
+	}
+	sort.Slice(positions, func(i, j int) bool { return positions[i] < positions[j] })
+	for _, position := range positions {
+		if taken, ok := cov.taken[position]; ok {
+			fmt.Fprintf(w, "%d %d %d\n", position, cov.counts[position], taken)
+		} else {
+			fmt.Fprintf(w, "%d %d\n", position, cov.counts[position])
+		}
+	}
+}
+
+// decodeCoverage reads the format written by encode.
+func decodeCoverage(r io.Reader) (*coverage, error) {
+	scanner := bufio.NewScanner(r)
+	if !scanner.Scan() || scanner.Text() != coverageHeader {
+		return nil, fmt.Errorf("expected '%s' on the first line", coverageHeader)
+	}
+	if !scanner.Scan() {
+		return nil, fmt.Errorf("expected the program on the second line")
+	}
+	fields := strings.SplitN(scanner.Text(), " ", 3)
+	if len(fields) != 3 || fields[0] != "program" {
+		return nil, fmt.Errorf("expected 'program <hash> <path>' on the second line")
+	}
+
+	cov := &coverage{
+		hash:   fields[1],
+		path:   fields[2],
+		counts: make(map[int64]int64),
+		taken:  make(map[int64]int64),
+	}
+	for lineNum := 3; scanner.Scan(); lineNum++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 && len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: expected '<position> <count> [<taken>]'", lineNum)
+		}
+		values := make([]int64, len(fields))
+		for idx, field := range fields {
+			value, err := strconv.ParseInt(field, 10, 64)
+			if err != nil || value < 0 {
+				return nil, fmt.Errorf("line %d: expected a non-negative number, got '%s'", lineNum, field)
+			}
+			values[idx] = value
+		}
+		cov.counts[values[0]] += values[1]
+		if len(values) == 3 {
+			cov.taken[values[0]] += values[2]
+		}
+	}
+	return cov, scanner.Err()
+}
+
+func readCoverage(path string) (*coverage, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return decodeCoverage(file)
+}
+
+// write saves the coverage to dstPath, adding up the counts already there if
+// they were recorded for the same program.
+func (cov *coverage) write(dstPath string) {
+	if _, err := os.Stat(dstPath); err == nil {
+		previous, err := readCoverage(dstPath)
+		switch {
+		case err != nil:
+			gvm.Logger.Warningf("Overwriting '%s', which isn't a valid coverage file: %s.\n", dstPath, err.Error())
+		case previous.hash != cov.hash:
+			gvm.Logger.Warningf("Overwriting '%s', which was recorded for a different program.\n", dstPath)
+		default:
+			gvm.Logger.Infof("Merging with the coverage in '%s'.\n", dstPath)
+			cov.merge(previous)
+		}
+	}
+
+	var buf bytes.Buffer
+	cov.encode(&buf)
+
+	gvm.Logger.Infof("Writing coverage '%s'.\n", dstPath)
+	if err := ioutil.WriteFile(dstPath, buf.Bytes(), 0644); err != nil {
+		gvm.Logger.Criticalf("Failed writing '%s': %s\n", dstPath, err.Error())
+		os.Exit(1)
+	}
+}
+
+// coveredLine gathers the instructions compiled from a line of source.
+type coveredLine struct {
+	positions []int64
+}
+
+// coveredFile is a source file along with its lines holding instructions.
+type coveredFile struct {
+	name  string
+	text  []string
+	lines map[int]*coveredLine
+}
+
+// annotation tells how a line of source was covered.
+type annotation struct {
+	hasCode bool
+	// Largest count among the instructions of the line
+	hits int64
+	// Whether some instructions of the line ran and others didn't
+	partial  bool
+	branches []string
+	// Number of branch directions never followed
+	missed int
+}
+
+type coverageStats struct {
+	lines, linesHit, branches, branchesHit int
+}
+
+func (stats *coverageStats) add(other coverageStats) {
+	stats.lines += other.lines
+	stats.linesHit += other.linesHit
+	stats.branches += other.branches
+	stats.branchesHit += other.branchesHit
+}
+
+func percentOf(hit, total int) float64 {
+	if total == 0 {
+		return 100
+	}
+	return 100 * float64(hit) / float64(total)
+}
+
+func (stats coverageStats) String() string {
+	return fmt.Sprintf("%.2f%% of %d lines, %.2f%% of %d branches",
+		percentOf(stats.linesHit, stats.lines), stats.lines,
+		percentOf(stats.branchesHit, stats.branches), stats.branches)
+}
+
+// annotate tells how a line was covered, counting it towards stats. Lines are
+// covered when all of their instructions ran, and every conditional jump
+// counts as two branches, one for each direction.
+func (cov *coverage) annotate(code []gvm.Code, line *coveredLine, stats *coverageStats) annotation {
+	if line == nil {
+		return annotation{}
+	}
+
+	a := annotation{hasCode: true}
+	ran := 0
+	for _, position := range line.positions {
+		count := cov.counts[position]
+		if count > a.hits {
+			a.hits = count
+		}
+		if count > 0 {
+			ran++
+		}
+
+		if isBranch(code[position]) {
+			taken := cov.taken[position]
+			a.branches = append(a.branches, fmt.Sprintf("taken %d, not taken %d", taken, count-taken))
+			stats.branches += 2
+			for _, followed := range []int64{taken, count - taken} {
+				if followed > 0 {
+					stats.branchesHit++
+				} else {
+					a.missed++
+				}
+			}
+		}
+	}
+	a.partial = ran > 0 && ran < len(line.positions)
+
+	stats.lines++
+	if ran == len(line.positions) {
+		stats.linesHit++
+	}
+	return a
+}
+
+// coveredFiles groups the instructions of a program by the lines of source
+// they were compiled from, reading the source files.
+func coveredFiles(debug *gvm.DebugInfo) []*coveredFile {
+	files := make([]*coveredFile, len(debug.Files))
+	for idx, name := range debug.Files {
+		files[idx] = &coveredFile{name: name, lines: make(map[int]*coveredLine)}
+
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			gvm.Logger.Warningf("Failed reading '%s', the source won't be shown: %s\n", name, err.Error())
+			continue
+		}
+		files[idx].text = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	}
+
+	for _, entry := range debug.Lines {
+		file := files[entry.File]
+		line, ok := file.lines[int(entry.Line)]
+		if !ok {
+			line = &coveredLine{}
+			file.lines[int(entry.Line)] = line
+		}
+		line.positions = append(line.positions, entry.Position)
+	}
+	return files
+}
+
+// lineCount is the number of lines to show for a file, which is that of the
+// source unless it couldn't be read.
+func (file *coveredFile) lineCount() int {
+	count := len(file.text)
+	for lineNum := range file.lines {
+		if lineNum > count {
+			count = lineNum
+		}
+	}
+	return count
+}
+
+func (file *coveredFile) textOf(lineNum int) string {
+	if lineNum > len(file.text) {
+		return ""
+	}
+	return file.text[lineNum-1]
+}
+
+func writeCoverageText(w io.Writer, cov *coverage, code []gvm.Code, files []*coveredFile) {
+	var total coverageStats
+	for _, file := range files {
+		var stats coverageStats
+		var body bytes.Buffer
+		for lineNum := 1; lineNum <= file.lineCount(); lineNum++ {
+			a := cov.annotate(code, file.lines[lineNum], &stats)
+			hits := "-"
+			switch {
+			case !a.hasCode:
+			case a.hits == 0:
+				hits = "#####"
+			case a.partial:
+				hits = fmt.Sprintf("%d*", a.hits)
+			default:
+				hits = fmt.Sprintf("%d", a.hits)
+			}
+			fmt.Fprintf(&body, "%9s:%5d:%s", hits, lineNum, file.textOf(lineNum))
+			if len(a.branches) > 0 {
+				fmt.Fprintf(&body, "  [%s]", strings.Join(a.branches, "; "))
+			}
+			body.WriteByte('\n')
+		}
+		total.add(stats)
+
+		fmt.Fprintf(w, "%s: %s\n", file.name, stats)
+		_, _ = w.Write(body.Bytes())
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintf(w, "Total: %s\n", total)
+}
+
+func writeCoverageHTML(w io.Writer, cov *coverage, code []gvm.Code, files []*coveredFile) {
+	var total coverageStats
+	var body bytes.Buffer
+	for _, file := range files {
+		var stats coverageStats
+		var rows bytes.Buffer
+		for lineNum := 1; lineNum <= file.lineCount(); lineNum++ {
+			a := cov.annotate(code, file.lines[lineNum], &stats)
+			class, hits := "", ""
+			switch {
+			case !a.hasCode:
+			case a.hits == 0:
+				class = "uncovered"
+			case a.partial || a.missed > 0:
+				class, hits = "partial", fmt.Sprintf("%d", a.hits)
+			default:
+				class, hits = "covered", fmt.Sprintf("%d", a.hits)
+			}
+			fmt.Fprintf(&rows, "<tr class=\"%s\" title=\"%s\"><td class=\"num\">%d</td><td class=\"num\">%s</td><td><pre>%s</pre></td></tr>\n",
+				class, html.EscapeString(strings.Join(a.branches, "; ")), lineNum, hits,
+				html.EscapeString(file.textOf(lineNum)))
+		}
+		total.add(stats)
+
+		fmt.Fprintf(&body, "<h2>%s</h2>\n<p>%s</p>\n<table>\n", html.EscapeString(file.name), stats)
+		_, _ = body.Write(rows.Bytes())
+		fmt.Fprintf(&body, "</table>\n")
+	}
+
+	fmt.Fprintf(w, `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Coverage of %s</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+td { padding: 0 0.5em; }
+td.num { text-align: right; color: #666; }
+pre { margin: 0; }
+tr.covered { background: #dfd; }
+tr.uncovered { background: #fdd; }
+tr.partial { background: #ffc; }
+</style>
+</head>
+<body>
+<h1>Coverage of %s</h1>
+<p>Total: %s</p>
+`, html.EscapeString(cov.path), html.EscapeString(cov.path), total)
+	_, _ = w.Write(body.Bytes())
+	fmt.Fprintf(w, "</body>\n</html>\n")
+}
+
+// Cover merges coverage files recorded for the same program and writes its
+// source annotated with how many times each line ran, either as text to the
+// standard output or as a page to htmlPath.
+func Cover(covPaths []string, htmlPath string) {
+	var cov *coverage
+	for _, covPath := range covPaths {
+		gvm.Logger.Infof("Reading coverage '%s'.\n", covPath)
+		other, err := readCoverage(covPath)
+		if err != nil {
+			gvm.Logger.Criticalf("Failed reading '%s': %s\n", covPath, err.Error())
+			os.Exit(1)
+		}
+		if cov == nil {
+			cov = other
+			continue
+		}
+		if other.hash != cov.hash {
+			gvm.Logger.Criticalf("'%s' was recorded for a different program than '%s'.\n", covPath, covPaths[0])
+			os.Exit(1)
+		}
+		cov.merge(other)
+	}
+
+	program := loadProgram([]string{cov.path}, compiler.Options{})
+	if hashCode(program.Code) != cov.hash {
+		gvm.Logger.Criticalf("'%s' changed since the coverage was recorded.\n", cov.path)
+		os.Exit(1)
+	}
+	if program.Debug == nil {
+		gvm.Logger.Criticalf("'%s' carries no debug information to relate it to its source.\n", cov.path)
+		os.Exit(1)
+	}
+
+	files := coveredFiles(program.Debug)
+	if htmlPath == "" {
+		writeCoverageText(os.Stdout, cov, program.Code, files)
+		return
+	}
+
+	var buf bytes.Buffer
+	writeCoverageHTML(&buf, cov, program.Code, files)
+	gvm.Logger.Infof("Writing '%s'.\n", htmlPath)
+	if err := ioutil.WriteFile(htmlPath, buf.Bytes(), 0644); err != nil {
+		gvm.Logger.Criticalf("Failed writing '%s': %s\n", htmlPath, err.Error())
+		os.Exit(1)
+	}
+}
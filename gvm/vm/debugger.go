@@ -11,52 +11,277 @@ import (
 )
 
 type debugContext struct {
-	breakPoints      []int64
+	// Breakpoints by the code position they stop at
+	breakPoints map[int64][]*breakpoint
+	watchPoints []*watchpoint
+	// Number given to the next breakpoint or watchpoint
+	nextID int
+	// Position of the instruction each word of the code belongs to, or -1
+	owners []int64
+	// Step at which breakpoints and watchpoints were last checked, and whether
+	// any of them stopped there
+	checkedStep      int64
+	stopping         bool
 	currentDirective string
 	reader           *bufio.Reader
+	history          *history
 }
 
-func (ctxt *debugContext) isBreakpoint(codePosition int64) bool {
-	for _, bp := range ctxt.breakPoints {
-		if codePosition == bp {
-			return true
+// check reports the breakpoints hit and the watchpoints set off at the current
+// step, and whether the debugger should stop there. Each step is only checked
+// once, so showing it again doesn't count its hits twice, and breakpoints only
+// count a step the first time it runs, not when it's run again after going
+// back.
+func (ctxt *debugContext) check(vm *virtualMachine) bool {
+	if ctxt.checkedStep == ctxt.history.step {
+		return ctxt.stopping
+	}
+	ctxt.checkedStep, ctxt.stopping = ctxt.history.step, false
+
+	for _, w := range ctxt.watchPoints {
+		value := w.value(vm)
+		if w.triggered(w.last, value) {
+			fmt.Println(w.describe(w.last, value))
+			ctxt.stopping = true
+		}
+		w.last = value
+	}
+	for _, bp := range ctxt.breakPoints[vm.codePosition] {
+		if hits, ok := bp.hit(vm, ctxt.history.step); ok && hits > bp.after {
+			fmt.Printf("Breakpoint %d hit.\n", bp.id)
+			ctxt.stopping = true
 		}
 	}
-	return false
+	return ctxt.stopping
 }
 
-func (ctxt *debugContext) isNotBreakpoint(codePosition int64) bool {
-	return !ctxt.isBreakpoint(codePosition)
+// checkBackward reports the breakpoints and watchpoints which stop `rc` at the
+// current step, having just gone back to it. Watchpoints stop at the
+// instruction changing what they watch, and hit counts don't matter.
+func (ctxt *debugContext) checkBackward(vm *virtualMachine) bool {
+	stopping := false
+	for _, w := range ctxt.watchPoints {
+		value := w.value(vm)
+		if w.triggered(value, w.last) {
+			fmt.Println(w.describe(value, w.last))
+			stopping = true
+		}
+		w.last = value
+	}
+	for _, bp := range ctxt.breakPoints[vm.codePosition] {
+		if bp.condition == nil || bp.condition.holds(vm) {
+			fmt.Printf("Breakpoint %d hit.\n", bp.id)
+			stopping = true
+		}
+	}
+	return stopping
+}
+
+// resync takes the current step as the one breakpoints and watchpoints were
+// last checked at, e.g. after going back in time.
+func (ctxt *debugContext) resync(vm *virtualMachine) {
+	for _, w := range ctxt.watchPoints {
+		w.last = w.value(vm)
+	}
+	ctxt.checkedStep, ctxt.stopping = ctxt.history.step, false
 }
 
-func handlePrintInput(param string, vm *virtualMachine, code []gvm.Code) {
+func handlePrintInput(param string, vm *virtualMachine, code []gvm.Code, ctxt *debugContext) {
 	switch param {
 	case "stack":
 		fmt.Printf("%v\n", vm.stack[:vm.stackPtr])
 	case "reg":
 		fmt.Printf("%v\n", vm.reg)
+	case "flags":
+		fmt.Printf("zero=%t sign=%t carry=%t overflow=%t\n",
+			vm.cmpFlag&zeroFlag != 0, vm.cmpFlag&signFlag != 0,
+			vm.cmpFlag&carryFlag != 0, vm.cmpFlag&overflowFlag != 0)
 	case "code":
-		disassemble(code)
+		disassemble(gvm.Program{Code: code, Debug: vm.debug})
+	case "step":
+		fmt.Printf("At step %d, can go back as far as step %d and forward up to step %d without running.\n",
+			ctxt.history.step, ctxt.history.first, ctxt.history.last())
 	default:
 		gvm.Logger.Errorf("Unknown argument '%s'.\n", param)
 	}
 }
 
-func handleBreakPointInput(param string, vm *virtualMachine, code []gvm.Code, ctxt *debugContext) {
-	value, parseErr := strconv.ParseInt(param, 10, 64)
-	if parseErr != nil {
-		gvm.Logger.Errorf("Could not process integer '%s'.\n", value)
+func handleBreakPointInput(params []string, vm *virtualMachine, ctxt *debugContext) {
+	bp, err := parseBreakpoint(params, vm.debug, ctxt.owners)
+	if err != nil {
+		gvm.Logger.Errorf("Can't set the breakpoint: %s.\n", err.Error())
+		return
+	}
+
+	ctxt.nextID++
+	bp.id = ctxt.nextID
+	ctxt.breakPoints[bp.position] = append(ctxt.breakPoints[bp.position], bp)
+	fmt.Printf("%s\n", describeBreakpoint(bp, vm.debug))
+}
+
+func handleWatchInput(params []string, vm *virtualMachine, ctxt *debugContext) {
+	w, err := parseWatchpoint(params)
+	if err != nil {
+		gvm.Logger.Errorf("Can't set the watchpoint: %s.\n", err.Error())
+		return
+	}
+
+	ctxt.nextID++
+	w.id = ctxt.nextID
+	w.last = w.value(vm)
+	ctxt.watchPoints = append(ctxt.watchPoints, w)
+	fmt.Printf("%d: watchpoint on %s\n", w.id, w)
+}
+
+func describeBreakpoint(bp *breakpoint, debug *gvm.DebugInfo) string {
+	var source *gvm.Context
+	if ctxt, ok := debug.SourceOf(bp.position); ok {
+		source = &ctxt
+	}
+	symbol, _ := debug.SymbolOf(bp.position)
+
+	description := fmt.Sprintf("%d: breakpoint at %s", bp.id, formatLocation(bp.position, source, symbol))
+	if bp.condition != nil {
+		description += fmt.Sprintf(" if %s", bp.condition)
+	}
+	if bp.after > 0 {
+		description += fmt.Sprintf(" after %d", bp.after)
+	}
+	return description
+}
+
+// handleInfoInput lists the breakpoints and watchpoints in the order they were
+// set, along with how many times breakpoints were hit.
+func handleInfoInput(param string, vm *virtualMachine, ctxt *debugContext) {
+	if param != "bp" {
+		gvm.Logger.Errorf("Unknown argument '%s'.\n", param)
+		return
+	}
+
+	descriptions := make(map[int]string)
+	for _, bps := range ctxt.breakPoints {
+		for _, bp := range bps {
+			descriptions[bp.id] = fmt.Sprintf("%s, hit count %d", describeBreakpoint(bp, vm.debug), len(bp.hitSteps))
+		}
+	}
+	for _, w := range ctxt.watchPoints {
+		descriptions[w.id] = fmt.Sprintf("%d: watchpoint on %s", w.id, w)
+	}
+
+	if len(descriptions) == 0 {
+		fmt.Printf("No breakpoints or watchpoints.\n")
+	}
+	for id := 1; id <= ctxt.nextID; id++ {
+		if description, ok := descriptions[id]; ok {
+			fmt.Printf("%s\n", description)
+		}
+	}
+}
+
+func handleDeleteInput(param string, ctxt *debugContext) {
+	id, err := strconv.Atoi(param)
+	if err != nil {
+		gvm.Logger.Errorf("Could not process integer '%s'.\n", param)
 		return
 	}
 
-	if ctxt.isNotBreakpoint(value) {
-		ctxt.breakPoints = append(ctxt.breakPoints, value)
+	for position, bps := range ctxt.breakPoints {
+		for idx, bp := range bps {
+			if bp.id == id {
+				ctxt.breakPoints[position] = append(bps[:idx:idx], bps[idx+1:]...)
+				if len(ctxt.breakPoints[position]) == 0 {
+					delete(ctxt.breakPoints, position)
+				}
+				return
+			}
+		}
+	}
+	for idx, w := range ctxt.watchPoints {
+		if w.id == id {
+			ctxt.watchPoints = append(ctxt.watchPoints[:idx:idx], ctxt.watchPoints[idx+1:]...)
+			return
+		}
 	}
+	gvm.Logger.Errorf("There is no breakpoint or watchpoint %d.\n", id)
+}
+
+// handleBreakInput handles the commands managing breakpoints and watchpoints,
+// which are available both while running and once execution stopped.
+func handleBreakInput(tokens []string, vm *virtualMachine, ctxt *debugContext) {
+	switch tokens[0] {
+	case "bp":
+		handleBreakPointInput(tokens[1:], vm, ctxt)
+	case "watch":
+		handleWatchInput(tokens[1:], vm, ctxt)
+	case "info":
+		if len(tokens) != 2 {
+			gvm.Logger.Errorf("`info` requires one argument.\n")
+			return
+		}
+		handleInfoInput(tokens[1], vm, ctxt)
+	case "delete":
+		if len(tokens) != 2 {
+			gvm.Logger.Errorf("`delete` requires one argument.\n")
+			return
+		}
+		handleDeleteInput(tokens[1], ctxt)
+	default:
+		panic("This path should be impossible.")
+	}
+}
+
+// handleTravelInput goes back in time as told by `rs`, `rc` or `goto`, and
+// reports whether it did.
+func handleTravelInput(tokens []string, vm *virtualMachine, code []gvm.Code, ctxt *debugContext) bool {
+	start := ctxt.history.step
+	switch tokens[0] {
+	case "rs":
+		if !ctxt.history.backward(vm) {
+			gvm.Logger.Errorf("Can't go back further than step %d.\n", ctxt.history.first)
+			return false
+		}
+	case "rc":
+		// Go back to the closest breakpoint before the current position, or
+		// to the last instruction setting off a watchpoint
+		ctxt.resync(vm)
+		for ctxt.history.backward(vm) {
+			if ctxt.checkBackward(vm) {
+				break
+			}
+		}
+		if ctxt.history.step == start {
+			gvm.Logger.Errorf("Can't go back further than step %d.\n", ctxt.history.first)
+			return false
+		}
+	case "goto":
+		if len(tokens) != 2 {
+			gvm.Logger.Errorf("`goto` requires one argument.\n")
+			return false
+		}
+		target, err := strconv.ParseInt(tokens[1], 10, 64)
+		if err != nil || target < 0 {
+			gvm.Logger.Errorf("Could not process step '%s'.\n", tokens[1])
+			return false
+		}
+		if err := ctxt.history.travel(vm, code, target); err != nil {
+			gvm.Logger.Errorf("Can't go back: %s.\n", err.Error())
+			return false
+		}
+	default:
+		panic("This path should be impossible.")
+	}
+
+	// Stop at where we got to instead of carrying on with a `c`
+	ctxt.currentDirective = "n"
+	ctxt.resync(vm)
+	fmt.Printf("At step %d.\n", ctxt.history.step)
+	return true
 }
 
 func debugStep(vm *virtualMachine, code []gvm.Code, ctxt *debugContext) {
 	// Show current position
 	disassembleStep(*vm, code)
+	stopping := ctxt.check(vm)
 
 	// Decide what to do
 	promptInput := false
@@ -67,8 +292,8 @@ func debugStep(vm *virtualMachine, code []gvm.Code, ctxt *debugContext) {
 		promptInput = true
 	case "c":
 		// We were told to continue until we reach a breakpoint, so check if
-		// we reached a breakpoint.
-		if ctxt.isBreakpoint(vm.codePosition) {
+		// we reached a breakpoint or set off a watchpoint.
+		if stopping {
 			promptInput = true
 		}
 	default:
@@ -96,12 +321,8 @@ func debugStep(vm *virtualMachine, code []gvm.Code, ctxt *debugContext) {
 				vm.codePosition = int64(len(code))
 				return
 
-			case "bp":
-				if len(tokens) != 2 {
-					gvm.Logger.Errorf("`bp` requires one argument.\n")
-					return
-				}
-				handleBreakPointInput(tokens[1], vm, code, ctxt)
+			case "bp", "watch", "info", "delete":
+				handleBreakInput(tokens, vm, ctxt)
 				return
 
 			case "p":
@@ -109,7 +330,11 @@ func debugStep(vm *virtualMachine, code []gvm.Code, ctxt *debugContext) {
 					gvm.Logger.Errorf("`p` requires one argument.\n")
 					return
 				}
-				handlePrintInput(tokens[1], vm, code)
+				handlePrintInput(tokens[1], vm, code, ctxt)
+				return
+
+			case "rs", "rc", "goto":
+				handleTravelInput(tokens, vm, code, ctxt)
 				return
 
 			default:
@@ -119,8 +344,51 @@ func debugStep(vm *virtualMachine, code []gvm.Code, ctxt *debugContext) {
 		}
 	}
 
-	// Actual execution step
-	executeStep(vm, code)
+	// Actual execution step, or its replay if we went back in time
+	ctxt.history.forward(vm, code)
+}
+
+// debugFault reports the fault that stopped execution and lets the user inspect
+// the state of the virtual machine before leaving, or go back in time, in which
+// case it returns true.
+func debugFault(vm *virtualMachine, code []gvm.Code, ctxt *debugContext) bool {
+	gvm.Logger.Errorf("Execution stopped: %s.\n", vm.fault.Error())
+
+	for {
+		fmt.Printf("gvm.Debugger (stopped): ")
+		userInput, err := ctxt.reader.ReadString('\n')
+		if err != nil {
+			return false
+		}
+
+		tokens := strings.Fields(userInput)
+		if len(tokens) == 0 {
+			continue
+		}
+
+		switch command := tokens[0]; command {
+		case "x", "exit":
+			return false
+
+		case "p":
+			if len(tokens) != 2 {
+				gvm.Logger.Errorf("`p` requires one argument.\n")
+				continue
+			}
+			handlePrintInput(tokens[1], vm, code, ctxt)
+
+		case "bp", "watch", "info", "delete":
+			handleBreakInput(tokens, vm, ctxt)
+
+		case "rs", "rc", "goto":
+			if handleTravelInput(tokens, vm, code, ctxt) && vm.fault == nil {
+				return true
+			}
+
+		default:
+			gvm.Logger.Errorf("Execution has stopped, only `p`, `bp`, `watch`, `info`, `delete`, `rs`, `rc`, `goto` and `x` are available.\n")
+		}
+	}
 }
 
 func Debug(filePath string, args []string) {
@@ -134,24 +402,31 @@ func Debug(filePath string, args []string) {
 	}
 	defer file.Close()
 
-	code := compiler.ReadCode(file)
+	program := compiler.ReadCode(file)
+	owners, err := verify(program)
+	if err != nil {
+		gvm.Logger.Criticalf("Refusing to run '%s': %s.\n", filePath, err.Error())
+		os.Exit(1)
+	}
 
 	gvm.Logger.Infof("Starting execution.\n")
 
-	vm := virtualMachine{
-		stack:        make([]int64, gvm.StackSize),
-		stackPtr:     0,
-		callStack:    make([]int64, gvm.CallStackSize),
-		callStackPtr: 0,
-		reg:          make([]int64, gvm.RegisterCount),
-		codePosition: 0,
-		cmpFlag:      0,
-		errFlag:      0,
-		args:         args,
-	}
-
-	ctxt := debugContext{reader: bufio.NewReader(os.Stdin)}
-	for vm.codePosition < int64(len(code)) {
-		debugStep(&vm, code, &ctxt)
+	vm := newVirtualMachine(program, args)
+
+	ctxt := debugContext{
+		breakPoints: make(map[int64][]*breakpoint),
+		owners:      owners,
+		checkedStep: -1,
+		reader:      bufio.NewReader(os.Stdin),
+		history:     newHistory(vm),
+	}
+	for {
+		for vm.isRunning(program.Code) {
+			debugStep(vm, program.Code, &ctxt)
+		}
+
+		if vm.fault == nil || !debugFault(vm, program.Code, &ctxt) {
+			break
+		}
 	}
 }
@@ -8,42 +8,88 @@ import (
 	"os"
 )
 
-func disassembleStep(vm virtualMachine, code []gvm.Code) virtualMachine {
+// registerName names a register operand of the instruction being disassembled,
+// using the alias it was given in the source if there is one.
+func (vm virtualMachine) registerName(register gvm.Code) string {
+	if alias, ok := vm.debug.AliasOf(vm.codePosition, int64(register)); ok {
+		return alias
+	}
+	return fmt.Sprintf("r%d", register)
+}
+
+// targetName names a position jumped to by the instruction being disassembled,
+// using the label it is at if there is one.
+func (vm virtualMachine) targetName(target gvm.Code) string {
+	if symbol, ok := vm.debug.SymbolOf(int64(target)); ok {
+		return symbol
+	}
+	return fmt.Sprintf("%d", target)
+}
+
+// disassembleInstruction describes the instruction at the current code position,
+// returning the virtualMachine moved to the next one.
+func disassembleInstruction(vm virtualMachine, code []gvm.Code) (string, virtualMachine) {
 	// Because performance is not a concern for this step and this disassembly step will
 	// be used in  conjuction with other functions for debugging purposes, let's make our
 	// life easier  by not mutating the virtualMachine, but instead returning a mutated
 	// copy that the caller can opt to use or not.
 
+	var text string
 	switch instruction := code[vm.codePosition]; instruction {
-	case lang.Halt, lang.Ret, lang.Noop:
-		fmt.Printf("%04d: %s\n", vm.codePosition, lang.ToString(instruction))
+	case lang.Halt, lang.Ret, lang.Noop, lang.Endtry:
+		text = lang.ToString(instruction)
 		vm.codePosition++
 	case lang.Const:
-		fmt.Printf("%04d: %s %d r%d\n",
-			vm.codePosition, lang.ToString(instruction), code[vm.codePosition+1], code[vm.codePosition+2])
+		text = fmt.Sprintf("%s %d %s",
+			lang.ToString(instruction), code[vm.codePosition+1], vm.registerName(code[vm.codePosition+2]))
 		vm.codePosition += 3
-	case lang.Mov, lang.Add, lang.Sub, lang.Mul, lang.Div, lang.Rem, lang.Cmp:
-		fmt.Printf("%04d: %s r%d r%d\n",
-			vm.codePosition, lang.ToString(instruction), code[vm.codePosition+1], code[vm.codePosition+2])
+	case lang.Mov, lang.Add, lang.Sub, lang.Mul, lang.Div, lang.Rem, lang.Cmp,
+		lang.Cmoveq, lang.Cmovne, lang.Cmovgt, lang.Cmovlt, lang.Cmovge, lang.Cmovle,
+		lang.Cmovb, lang.Cmova, lang.Cmovbe, lang.Cmovae:
+		text = fmt.Sprintf("%s %s %s", lang.ToString(instruction),
+			vm.registerName(code[vm.codePosition+1]), vm.registerName(code[vm.codePosition+2]))
 		vm.codePosition += 3
-	case lang.Jmp, lang.Jeq, lang.Jne, lang.Jgt, lang.Jlt, lang.Jge, lang.Jle, lang.Jerr, lang.Call:
-		fmt.Printf("%04d: %s %d\n", vm.codePosition, lang.ToString(instruction), code[vm.codePosition+1])
+	case lang.Jmp, lang.Jeq, lang.Jne, lang.Jgt, lang.Jlt, lang.Jge, lang.Jle, lang.Jerr, lang.Call,
+		lang.Jb, lang.Ja, lang.Jbe, lang.Jae:
+		text = fmt.Sprintf("%s %s", lang.ToString(instruction), vm.targetName(code[vm.codePosition+1]))
 		vm.codePosition += 2
-	case lang.Show, lang.Inc, lang.Dec, lang.Push, lang.Pop, lang.Iarg:
-		fmt.Printf("%04d: %s r%d\n", vm.codePosition, lang.ToString(instruction), code[vm.codePosition+1])
+	case lang.Try:
+		text = fmt.Sprintf("%s %s %s", lang.ToString(instruction),
+			vm.targetName(code[vm.codePosition+1]), vm.registerName(code[vm.codePosition+2]))
+		vm.codePosition += 3
+	case lang.Trap:
+		text = fmt.Sprintf("%s %d", lang.ToString(instruction), code[vm.codePosition+1])
+		vm.codePosition += 2
+	case lang.Show, lang.Inc, lang.Dec, lang.Push, lang.Pop, lang.Iarg, lang.Assert, lang.Throw,
+		lang.Seteq, lang.Setne, lang.Setgt, lang.Setlt, lang.Setge, lang.Setle,
+		lang.Setb, lang.Seta, lang.Setbe, lang.Setae:
+		text = fmt.Sprintf("%s %s",
+			lang.ToString(instruction), vm.registerName(code[vm.codePosition+1]))
 		vm.codePosition += 2
 	default:
 		gvm.Logger.Criticalf("Unexpected instruction code %d.\n", instruction)
 		os.Exit(1)
 	}
 
-	return vm
+	return text, vm
+}
+
+func disassembleStep(vm virtualMachine, code []gvm.Code) virtualMachine {
+	text, next := disassembleInstruction(vm, code)
+	// Code read from the compact encoding also shows where each instruction
+	// is within the file's code
+	if offset, ok := vm.offsets[vm.codePosition]; ok {
+		fmt.Printf("0x%04x %04d: %s\n", offset, vm.codePosition, text)
+	} else {
+		fmt.Printf("%04d: %s\n", vm.codePosition, text)
+	}
+	return next
 }
 
-func disassemble(code []gvm.Code) {
-	vm := virtualMachine{}
-	for vm.codePosition < int64(len(code)) {
-		vm = disassembleStep(vm, code)
+func disassemble(program gvm.Program) {
+	vm := virtualMachine{debug: program.Debug, offsets: program.Offsets}
+	for vm.codePosition < int64(len(program.Code)) {
+		vm = disassembleStep(vm, program.Code)
 	}
 }
 
@@ -58,7 +104,7 @@ func Disassemble(filePath string) {
 	}
 	defer file.Close()
 
-	code := compiler.ReadCode(file)
+	program := compiler.ReadCode(file)
 
-	disassemble(code)
+	disassemble(program)
 }
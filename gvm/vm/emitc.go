@@ -0,0 +1,357 @@
+package vm
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/vsartor/gvm/gvm"
+	"github.com/vsartor/gvm/gvm/compiler"
+	"github.com/vsartor/gvm/gvm/lang"
+	"strings"
+)
+
+// cEmitter translates a program into a C99 function the same way goEmitter
+// does for Go. Arithmetic goes through unsigned integers, so overflows wrap
+// around as they do in the GVM instead of being undefined.
+type cEmitter struct {
+	*translation
+	buf        bytes.Buffer
+	raises     bool
+	dispatches bool
+}
+
+func (e *cEmitter) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&e.buf, format, args...)
+}
+
+// cQuote writes str as a C string literal.
+func cQuote(str string) string {
+	var quoted strings.Builder
+	quoted.WriteByte('"')
+	for _, c := range []byte(str) {
+		switch {
+		case c == '"' || c == '\\':
+			quoted.WriteByte('\\')
+			quoted.WriteByte(c)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&quoted, "\\%03o", c)
+		default:
+			quoted.WriteByte(c)
+		}
+	}
+	quoted.WriteByte('"')
+	return quoted.String()
+}
+
+// cJump continues execution at position, where the end of the code returns.
+func (e *cEmitter) cJump(position int64) string {
+	if position == e.end() {
+		return "return 0;"
+	}
+	return fmt.Sprintf("goto %s;", goLabel(position))
+}
+
+// cRaise raises a fault at the instruction at position.
+func (e *cEmitter) cRaise(position int64, code string) string {
+	e.raises = true
+	return fmt.Sprintf("fault = %s; faultAt = %s; goto raise;", code, cQuote(e.location(position)))
+}
+
+// cThrow raises a fault on behalf of the program, as `trap` and `throw` do.
+func (e *cEmitter) cThrow(position int64, code string) string {
+	return "thrown = 1; " + e.cRaise(position, code)
+}
+
+// cWrap computes lhs op rhs on unsigned integers.
+func cWrap(lhs, op, rhs string) string {
+	return fmt.Sprintf("(int64_t)((uint64_t)%s %s (uint64_t)%s)", lhs, op, rhs)
+}
+
+func (e *cEmitter) emitInstruction(ins decodedInstruction) {
+	op := func(idx int) string { return goRegister(ins.operands[idx]) }
+	target, _ := ins.target()
+
+	switch ins.instruction {
+	case lang.Halt:
+		e.printf("return 0;\n")
+	case lang.Const:
+		// The most negative value can't be written as a literal in C
+		if ins.operands[0] == -1<<63 {
+			e.printf("%s = INT64_MIN;\n", op(1))
+		} else {
+			e.printf("%s = INT64_C(%d);\n", op(1), ins.operands[0])
+		}
+	case lang.Push:
+		e.printf("if (sp == STACK_SIZE) { %s }\n", e.cRaise(ins.position, "FAULT_STACK_OVERFLOW"))
+		e.printf("stack[sp++] = %s;\n", op(0))
+	case lang.Pop:
+		e.printf("if (sp == 0) { %s }\n", e.cRaise(ins.position, "FAULT_STACK_UNDERFLOW"))
+		e.printf("%s = stack[--sp];\n", op(0))
+	case lang.Inc:
+		e.printf("%s = %s;\n", op(0), cWrap(op(0), "+", "1"))
+	case lang.Dec:
+		e.printf("%s = %s;\n", op(0), cWrap(op(0), "-", "1"))
+	case lang.Mov:
+		e.printf("%s = %s;\n", op(1), op(0))
+	case lang.Add:
+		e.printf("%s = %s;\n", op(1), cWrap(op(1), "+", op(0)))
+	case lang.Sub:
+		e.printf("%s = %s;\n", op(1), cWrap(op(1), "-", op(0)))
+	case lang.Mul:
+		e.printf("%s = %s;\n", op(1), cWrap(op(1), "*", op(0)))
+	case lang.Div:
+		e.printf("if (%s == 0) { %s }\n", op(0), e.cRaise(ins.position, "FAULT_DIVISION_BY_ZERO"))
+		// Dividing the most negative value by -1 overflows
+		e.printf("%s = %s == -1 ? %s : %s / %s;\n", op(1), op(0), cWrap("0", "-", op(1)), op(1), op(0))
+	case lang.Rem:
+		e.printf("if (%s == 0) { %s }\n", op(0), e.cRaise(ins.position, "FAULT_DIVISION_BY_ZERO"))
+		e.printf("%s = %s == -1 ? 0 : %s %% %s;\n", op(1), op(0), op(1), op(0))
+	case lang.Cmp:
+		e.printf("cmpFlag = compareFlags(%s, %s);\n", op(1), op(0))
+	case lang.Cmoveq, lang.Cmovne, lang.Cmovgt, lang.Cmovlt, lang.Cmovge, lang.Cmovle,
+		lang.Cmovb, lang.Cmova, lang.Cmovbe, lang.Cmovae:
+		e.printf("if (%s) %s = %s;\n", condition(ins.instruction), op(1), op(0))
+	case lang.Seteq, lang.Setne, lang.Setgt, lang.Setlt, lang.Setge, lang.Setle,
+		lang.Setb, lang.Seta, lang.Setbe, lang.Setae:
+		e.printf("%s = (%s) ? 1 : 0;\n", op(0), condition(ins.instruction))
+	case lang.Jmp:
+		e.printf("%s\n", e.cJump(target))
+	case lang.Jeq, lang.Jne, lang.Jgt, lang.Jlt, lang.Jge, lang.Jle, lang.Jb, lang.Ja, lang.Jbe, lang.Jae:
+		e.printf("if (%s) %s\n", condition(ins.instruction), e.cJump(target))
+	case lang.Jerr:
+		e.printf("if (errFlag != 0) { errFlag = 0; %s }\n", e.cJump(target))
+	case lang.Show:
+		e.printf("printf(\"%%\" PRId64 \"\\n\", %s);\n", op(0))
+	case lang.Call:
+		e.printf("if (csp == CALL_STACK_SIZE) { %s }\n", e.cRaise(ins.position, "FAULT_CALL_STACK_OVERFLOW"))
+		e.printf("callStack[csp++] = %d;\n%s\n", ins.next(), e.cJump(target))
+	case lang.Ret:
+		e.dispatches = true
+		e.printf("if (csp == 0) { %s }\n", e.cRaise(ins.position, "FAULT_CALL_STACK_UNDERFLOW"))
+		e.printf("resume = callStack[--csp];\n")
+		e.printf("/* Handlers installed by the returning routine go out of scope */\n")
+		e.printf("while (hp > 0 && handlers[hp - 1].csp > csp) hp--;\n")
+		e.printf("goto dispatch;\n")
+	case lang.Noop:
+		e.printf(";\n")
+	case lang.Iarg:
+		e.printf("{\n")
+		e.printf("int64_t idx = %s, value;\n", op(0))
+		e.printf("if (idx < 0 || idx >= argCount || !parseInt(args[idx], &value)) errFlag = 1;\n")
+		e.printf("else if (sp == STACK_SIZE) { %s }\n", e.cRaise(ins.position, "FAULT_STACK_OVERFLOW"))
+		e.printf("else stack[sp++] = value;\n")
+		e.printf("}\n")
+	case lang.Assert:
+		e.printf("if (%s == 0) { %s }\n", op(0), e.cRaise(ins.position, "FAULT_ASSERTION"))
+	case lang.Trap:
+		e.printf("%s\n", e.cThrow(ins.position, fmt.Sprintf("INT64_C(%d)", ins.operands[0])))
+	case lang.Try:
+		e.printf("if (hp == HANDLER_STACK_SIZE) { %s }\n", e.cRaise(ins.position, "FAULT_HANDLER_STACK_OVERFLOW"))
+		e.printf("handlers[hp].resume = %d;\nhandlers[hp].reg = %d;\n", target, ins.operands[1])
+		e.printf("handlers[hp].csp = csp;\nhandlers[hp].sp = sp;\nhp++;\n")
+	case lang.Endtry:
+		e.printf("if (hp == 0 || handlers[hp - 1].csp != csp) { %s }\n",
+			e.cRaise(ins.position, "FAULT_UNMATCHED_ENDTRY"))
+		e.printf("hp--;\n")
+	case lang.Throw:
+		e.printf("%s\n", e.cThrow(ins.position, op(0)))
+	default:
+		panic("This path should be impossible.")
+	}
+}
+
+// emitRun writes the function running the code, which returns the exit status
+// of the program.
+func (e *cEmitter) emitRun() {
+	e.printf("static int run(void) {\n")
+	registers := make([]string, gvm.RegisterCount)
+	for register := range registers {
+		registers[register] = goRegister(gvm.Code(register)) + " = 0"
+	}
+	e.printf("int64_t %s;\n", strings.Join(registers, ", "))
+	e.printf("int64_t cmpFlag = 0, errFlag = 0, fault = 0, resume = 0;\n")
+	e.printf("const char *faultAt = \"\";\n")
+	e.printf("int sp = 0, csp = 0, hp = 0, thrown = 0;\n")
+	e.printf("/* Not every program uses all of the state and helpers of the GVM */\n")
+	for register := range registers {
+		e.printf("(void)%s;\n", goRegister(gvm.Code(register)))
+	}
+	for _, name := range []string{"stack", "sp", "callStack", "csp", "handlers", "hp",
+		"cmpFlag", "errFlag", "fault", "faultAt", "thrown", "resume",
+		"compareFlags", "isEqual", "isLess", "isBelow", "parseInt", "reportFault"} {
+		e.printf("(void)%s;\n", name)
+	}
+	e.printf("\n")
+
+	for idx, ins := range e.instructions {
+		if e.isLabeled(ins.position) {
+			// A label must be followed by a statement
+			e.printf("%s: ;\n", goLabel(ins.position))
+		}
+		e.printf("// %s: %s\n", e.location(ins.position), e.describe(ins))
+		e.emitInstruction(ins)
+
+		// Instructions that aren't reached by falling through are labeled
+		if lang.FallsThrough(ins.instruction) && (idx+1 == len(e.instructions) ||
+			e.instructions[idx+1].position != ins.next()) {
+			e.printf("%s\n", e.cJump(ins.next()))
+		}
+	}
+	if len(e.instructions) == 0 {
+		e.printf("return 0;\n")
+	}
+
+	if e.raises {
+		e.dispatches = true
+		e.printf("\nraise:\n")
+		e.printf("if (hp > 0) {\n")
+		e.printf("hp--;\ncsp = handlers[hp].csp;\nsp = handlers[hp].sp;\nthrown = 0;\n")
+		e.printf("switch (handlers[hp].reg) {\n")
+		for _, register := range e.faultRegisters {
+			e.printf("case %d: %s = fault; break;\n", register, goRegister(register))
+		}
+		e.printf("}\nresume = handlers[hp].resume;\ngoto dispatch;\n}\n")
+		e.printf("reportFault(fault, thrown, faultAt);\n")
+		e.printf("return 1;\n")
+	}
+
+	if e.dispatches {
+		e.printf("\ndispatch:\n")
+		e.printf("switch (resume) {\n")
+		for _, position := range e.resumes {
+			e.printf("case %d: %s\n", position, e.cJump(position))
+		}
+		e.printf("}\n")
+		e.printf("return 1;\n")
+	}
+
+	e.printf("}\n")
+}
+
+// indent indents the lines of the body of each block by four spaces, relying
+// on the emitted code opening and closing at most one block per line.
+func indent(source []byte) []byte {
+	var indented bytes.Buffer
+	depth := 0
+	for _, line := range strings.Split(strings.TrimRight(string(source), "\n"), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "}") {
+			depth--
+		}
+
+		isLabel := strings.HasSuffix(trimmed, ":") || strings.HasSuffix(trimmed, ": ;")
+		isComment := strings.HasPrefix(trimmed, "//")
+		isCase := strings.HasPrefix(trimmed, "case ")
+		switch {
+		case trimmed == "":
+		case isLabel && !isComment && !isCase:
+			indented.WriteString(trimmed)
+		default:
+			indented.WriteString(strings.Repeat("    ", depth))
+			indented.WriteString(trimmed)
+		}
+		indented.WriteByte('\n')
+
+		if strings.HasSuffix(trimmed, "{") {
+			depth++
+		}
+	}
+	return indented.Bytes()
+}
+
+// emitC writes a C99 source file with the translated program.
+func emitC(t *translation) []byte {
+	e := &cEmitter{translation: t}
+	e.emitRun()
+	run := e.buf.Bytes()
+
+	e.buf = bytes.Buffer{}
+	e.printf("/* Code generated by gvm emit-c. DO NOT EDIT. */\n\n")
+	e.printf("#include <inttypes.h>\n#include <stdint.h>\n#include <stdio.h>\n\n")
+
+	e.printf("#define STACK_SIZE %d\n", gvm.StackSize)
+	e.printf("#define CALL_STACK_SIZE %d\n", gvm.CallStackSize)
+	e.printf("#define HANDLER_STACK_SIZE %d\n\n", gvm.HandlerStackSize)
+
+	e.printf("/* Codes of the faults raised by the GVM itself */\n")
+	names := map[int64]string{
+		FaultUnknownInstruction:   "FAULT_UNKNOWN_INSTRUCTION",
+		FaultStackUnderflow:       "FAULT_STACK_UNDERFLOW",
+		FaultCallStackOverflow:    "FAULT_CALL_STACK_OVERFLOW",
+		FaultCallStackUnderflow:   "FAULT_CALL_STACK_UNDERFLOW",
+		FaultAssertion:            "FAULT_ASSERTION",
+		FaultStackOverflow:        "FAULT_STACK_OVERFLOW",
+		FaultDivisionByZero:       "FAULT_DIVISION_BY_ZERO",
+		FaultHandlerStackOverflow: "FAULT_HANDLER_STACK_OVERFLOW",
+		FaultUnmatchedEndtry:      "FAULT_UNMATCHED_ENDTRY",
+	}
+	for _, code := range sortedFaultCodes() {
+		e.printf("#define %s INT64_C(%d)\n", names[code], code)
+	}
+	e.printf("\n")
+
+	e.printf("static void reportFault(int64_t fault, int thrown, const char *faultAt) {\n")
+	e.printf("const char *description = NULL;\n")
+	e.printf("if (!thrown) {\n")
+	e.printf("switch (fault) {\n")
+	for _, code := range sortedFaultCodes() {
+		e.printf("case %s: description = %s; break;\n", names[code], cQuote(faultDescriptions[code]))
+	}
+	e.printf("}\n")
+	e.printf("}\n")
+	e.printf("if (description != NULL) {\n")
+	e.printf("fprintf(stderr, \"Execution stopped: %%s at %%s.\\n\", description, faultAt);\n")
+	e.printf("} else {\n")
+	e.printf("fprintf(stderr, \"Execution stopped: trap %%\" PRId64 \" at %%s.\\n\", fault, faultAt);\n")
+	e.printf("}\n")
+	e.printf("}\n\n")
+
+	e.printf("#define ZERO_FLAG 1\n#define SIGN_FLAG 2\n#define CARRY_FLAG 4\n#define OVERFLOW_FLAG 8\n\n")
+	e.printf("static int64_t compareFlags(int64_t lhs, int64_t rhs) {\n")
+	e.printf("int64_t diff = %s, flags = 0;\n", cWrap("lhs", "-", "rhs"))
+	e.printf("if (diff == 0) flags |= ZERO_FLAG;\n")
+	e.printf("if (diff < 0) flags |= SIGN_FLAG;\n")
+	e.printf("if ((uint64_t)lhs < (uint64_t)rhs) flags |= CARRY_FLAG;\n")
+	e.printf("if (((lhs ^ rhs) & (lhs ^ diff)) < 0) flags |= OVERFLOW_FLAG;\n")
+	e.printf("return flags;\n}\n\n")
+	e.printf("static int isEqual(int64_t flags) {\nreturn (flags & ZERO_FLAG) != 0;\n}\n\n")
+	e.printf("static int isLess(int64_t flags) {\n")
+	e.printf("return ((flags & SIGN_FLAG) != 0) != ((flags & OVERFLOW_FLAG) != 0);\n}\n\n")
+	e.printf("static int isBelow(int64_t flags) {\nreturn (flags & CARRY_FLAG) != 0;\n}\n\n")
+
+	e.printf("/* Parses a decimal integer the same way as `iarg` */\n")
+	e.printf("static int parseInt(const char *str, int64_t *value) {\n")
+	e.printf("int negative = *str == '-';\n")
+	e.printf("uint64_t magnitude = 0, limit = negative ? (uint64_t)INT64_MAX + 1 : (uint64_t)INT64_MAX;\n")
+	e.printf("if (*str == '-' || *str == '+') str++;\n")
+	e.printf("if (*str == '\\0') return 0;\n")
+	e.printf("for (; *str != '\\0'; str++) {\n")
+	e.printf("if (*str < '0' || *str > '9') return 0;\n")
+	e.printf("if (magnitude > (limit - (uint64_t)(*str - '0')) / 10) return 0;\n")
+	e.printf("magnitude = magnitude * 10 + (uint64_t)(*str - '0');\n")
+	e.printf("}\n")
+	e.printf("*value = negative ? (int64_t)(0 - magnitude) : (int64_t)magnitude;\n")
+	e.printf("return 1;\n}\n\n")
+
+	e.printf("struct handler {\nint64_t resume;\nint reg, csp, sp;\n};\n\n")
+	e.printf("static int64_t stack[STACK_SIZE];\n")
+	e.printf("static int64_t callStack[CALL_STACK_SIZE];\n")
+	e.printf("static struct handler handlers[HANDLER_STACK_SIZE];\n")
+	e.printf("static char **args;\nstatic int argCount;\n\n")
+
+	e.buf.Write(run)
+
+	e.printf("\nint main(int argc, char **argv) {\n")
+	e.printf("args = argv + 1;\nargCount = argc - 1;\n")
+	e.printf("return run();\n}\n")
+
+	return indent(e.buf.Bytes())
+}
+
+// TranslateToC translates a program into a standalone C99 program, which runs
+// it the same way the GVM would.
+func TranslateToC(filePaths []string, options compiler.Options, dstPath string) {
+	program := loadProgram(filePaths, options)
+
+	gvm.Logger.Infof("Translating to C.\n")
+	writeTranslation(dstPath, emitC(newTranslation(program)))
+}
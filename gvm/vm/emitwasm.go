@@ -0,0 +1,470 @@
+package vm
+
+import (
+	"fmt"
+	"github.com/vsartor/gvm/gvm"
+	"github.com/vsartor/gvm/gvm/compiler"
+	"github.com/vsartor/gvm/gvm/lang"
+	"os"
+)
+
+// Layout of the linear memory of translated programs, whose stacks come before
+// the strings describing faults
+const (
+	wasmStackAt     int64 = 0
+	wasmCallStackAt       = wasmStackAt + int64(gvm.StackSize)*8
+	wasmHandlersAt        = wasmCallStackAt + gvm.CallStackSize*4
+	wasmDataAt            = wasmHandlersAt + gvm.HandlerStackSize*16
+	wasmPageSize          = 65536
+)
+
+// Offsets of the fields of a handler in memory
+const (
+	wasmHandlerResume int64 = iota * 4
+	wasmHandlerRegister
+	wasmHandlerCsp
+	wasmHandlerSp
+)
+
+// wasmEmitter translates a program into a WebAssembly module. Code is split
+// into blocks at every position other code leads to, and runs within a loop
+// dispatching on the index of the block to run, so jumps, calls, returns and
+// handlers all go through the loop.
+type wasmEmitter struct {
+	*translation
+	body []wasmOp
+	// Index of the block starting at each position
+	blocks map[int64]int
+	// Labels of the blocks, the last one being where faults are raised
+	labels []string
+	data   []wasmData
+	// Where each string is in memory
+	strings map[string]int64
+	dataEnd int64
+}
+
+func (e *wasmEmitter) emit(ops ...wasmOp) {
+	e.body = append(e.body, ops...)
+}
+
+// str puts a string in memory, returning where it is and its length.
+func (e *wasmEmitter) str(text string) (int64, int64) {
+	at, ok := e.strings[text]
+	if !ok {
+		at = wasmDataAt + e.dataEnd
+		e.strings[text] = at
+		e.data = append(e.data, wasmData{at, text})
+		e.dataEnd += int64(len(text))
+	}
+	return at, int64(len(text))
+}
+
+// goTo continues execution at the block with the given index.
+func (e *wasmEmitter) goTo(block int) {
+	e.emit(wasmValue("i32.const", int64(block)), wasmRef("local.set", "pc"), wasmRef("br", "dispatch"))
+}
+
+// jump continues execution at position, where the end of the code returns.
+func (e *wasmEmitter) jump(position int64) {
+	if position == e.end() {
+		e.emit(wasmValue("i32.const", 0), wasmPlain("return"))
+		return
+	}
+	e.goTo(e.blocks[position])
+}
+
+// raise raises a fault at the instruction at position, whose code is pushed
+// by the given instructions.
+func (e *wasmEmitter) raise(position int64, code ...wasmOp) {
+	at, length := e.str(e.location(position))
+	e.emit(code...)
+	e.emit(wasmRef("local.set", "fault"))
+	e.emit(wasmValue("i32.const", at), wasmRef("local.set", "faultAt"))
+	e.emit(wasmValue("i32.const", length), wasmRef("local.set", "faultLength"))
+	e.goTo(len(e.labels) - 1)
+}
+
+// throw raises a fault on behalf of the program, as `trap` and `throw` do.
+func (e *wasmEmitter) throw(position int64, code ...wasmOp) {
+	e.emit(wasmValue("i32.const", 1), wasmRef("local.set", "thrown"))
+	e.raise(position, code...)
+}
+
+// raiseIf raises a fault with the given code if check pushes a non-zero value.
+func (e *wasmEmitter) raiseIf(position int64, faultCode int64, check ...wasmOp) {
+	e.emit(check...)
+	e.emit(wasmPlain("if"))
+	e.raise(position, wasmValue("i64.const", faultCode))
+	e.emit(wasmPlain("end"))
+}
+
+// address pushes the address of the item at the index in a local within an
+// array of items with the given size, as a power of two.
+func address(local string, shift int64) []wasmOp {
+	return []wasmOp{wasmRef("local.get", local), wasmValue("i32.const", shift), wasmPlain("i32.shl")}
+}
+
+// adjust adds delta to an i32 local.
+func adjust(local string, delta int64) []wasmOp {
+	return []wasmOp{wasmRef("local.get", local), wasmValue("i32.const", delta),
+		wasmPlain("i32.add"), wasmRef("local.set", local)}
+}
+
+// wasmCondition pushes whether the condition of a conditional jump, move or set
+// holds for the flags in cmpFlag.
+func wasmCondition(instruction gvm.Code) []wasmOp {
+	equal := []wasmOp{wasmRef("local.get", "cmpFlag"), wasmRef("call", "isEqual")}
+	less := []wasmOp{wasmRef("local.get", "cmpFlag"), wasmRef("call", "isLess")}
+	below := []wasmOp{wasmRef("local.get", "cmpFlag"), wasmRef("call", "isBelow")}
+	not, and, or := wasmPlain("i32.eqz"), wasmPlain("i32.and"), wasmPlain("i32.or")
+	join := func(parts ...[]wasmOp) []wasmOp {
+		var ops []wasmOp
+		for _, part := range parts {
+			ops = append(ops, part...)
+		}
+		return ops
+	}
+
+	switch instruction {
+	case lang.Jeq, lang.Cmoveq, lang.Seteq:
+		return equal
+	case lang.Jne, lang.Cmovne, lang.Setne:
+		return join(equal, []wasmOp{not})
+	case lang.Jgt, lang.Cmovgt, lang.Setgt:
+		return join(equal, []wasmOp{not}, less, []wasmOp{not, and})
+	case lang.Jlt, lang.Cmovlt, lang.Setlt:
+		return less
+	case lang.Jge, lang.Cmovge, lang.Setge:
+		return join(less, []wasmOp{not})
+	case lang.Jle, lang.Cmovle, lang.Setle:
+		return join(equal, less, []wasmOp{or})
+	case lang.Jb, lang.Cmovb, lang.Setb:
+		return below
+	case lang.Ja, lang.Cmova, lang.Seta:
+		return join(equal, []wasmOp{not}, below, []wasmOp{not, and})
+	case lang.Jbe, lang.Cmovbe, lang.Setbe:
+		return join(equal, below, []wasmOp{or})
+	case lang.Jae, lang.Cmovae, lang.Setae:
+		return join(below, []wasmOp{not})
+	default:
+		panic("This path should be impossible.")
+	}
+}
+
+func (e *wasmEmitter) emitInstruction(ins decodedInstruction) {
+	op := func(idx int) string { return goRegister(ins.operands[idx]) }
+	get := func(idx int) wasmOp { return wasmRef("local.get", op(idx)) }
+	set := func(idx int) wasmOp { return wasmRef("local.set", op(idx)) }
+	target, _ := ins.target()
+
+	switch ins.instruction {
+	case lang.Halt:
+		e.emit(wasmValue("i32.const", 0), wasmPlain("return"))
+	case lang.Const:
+		e.emit(wasmValue("i64.const", int64(ins.operands[0])), set(1))
+	case lang.Push:
+		e.push(ins.position, get(0))
+	case lang.Pop:
+		e.raiseIf(ins.position, FaultStackUnderflow, wasmRef("local.get", "sp"), wasmPlain("i32.eqz"))
+		e.emit(adjust("sp", -1)...)
+		e.emit(address("sp", 3)...)
+		e.emit(wasmValue("i64.load", wasmStackAt), set(0))
+	case lang.Inc:
+		e.emit(get(0), wasmValue("i64.const", 1), wasmPlain("i64.add"), set(0))
+	case lang.Dec:
+		e.emit(get(0), wasmValue("i64.const", 1), wasmPlain("i64.sub"), set(0))
+	case lang.Mov:
+		e.emit(get(0), set(1))
+	case lang.Add:
+		e.emit(get(1), get(0), wasmPlain("i64.add"), set(1))
+	case lang.Sub:
+		e.emit(get(1), get(0), wasmPlain("i64.sub"), set(1))
+	case lang.Mul:
+		e.emit(get(1), get(0), wasmPlain("i64.mul"), set(1))
+	case lang.Div:
+		e.raiseIf(ins.position, FaultDivisionByZero, get(0), wasmPlain("i64.eqz"))
+		// Dividing the most negative value by -1 overflows, which traps
+		e.emit(get(0), wasmValue("i64.const", -1), wasmPlain("i64.eq"), wasmPlain("if"))
+		e.emit(wasmValue("i64.const", 0), get(1), wasmPlain("i64.sub"), set(1))
+		e.emit(wasmPlain("else"))
+		e.emit(get(1), get(0), wasmPlain("i64.div_s"), set(1))
+		e.emit(wasmPlain("end"))
+	case lang.Rem:
+		e.raiseIf(ins.position, FaultDivisionByZero, get(0), wasmPlain("i64.eqz"))
+		e.emit(get(1), get(0), wasmPlain("i64.rem_s"), set(1))
+	case lang.Cmp:
+		e.emit(get(1), get(0), wasmRef("call", "compareFlags"), wasmRef("local.set", "cmpFlag"))
+	case lang.Cmoveq, lang.Cmovne, lang.Cmovgt, lang.Cmovlt, lang.Cmovge, lang.Cmovle,
+		lang.Cmovb, lang.Cmova, lang.Cmovbe, lang.Cmovae:
+		e.emit(wasmCondition(ins.instruction)...)
+		e.emit(wasmPlain("if"), get(0), set(1), wasmPlain("end"))
+	case lang.Seteq, lang.Setne, lang.Setgt, lang.Setlt, lang.Setge, lang.Setle,
+		lang.Setb, lang.Seta, lang.Setbe, lang.Setae:
+		e.emit(wasmCondition(ins.instruction)...)
+		e.emit(wasmPlain("i64.extend_i32_u"), set(0))
+	case lang.Jmp:
+		e.jump(target)
+	case lang.Jeq, lang.Jne, lang.Jgt, lang.Jlt, lang.Jge, lang.Jle, lang.Jb, lang.Ja, lang.Jbe, lang.Jae:
+		e.emit(wasmCondition(ins.instruction)...)
+		e.emit(wasmPlain("if"))
+		e.jump(target)
+		e.emit(wasmPlain("end"))
+	case lang.Jerr:
+		e.emit(wasmRef("local.get", "errFlag"), wasmPlain("if"))
+		e.emit(wasmValue("i32.const", 0), wasmRef("local.set", "errFlag"))
+		e.jump(target)
+		e.emit(wasmPlain("end"))
+	case lang.Show:
+		e.emit(get(0), wasmRef("call", "show"))
+	case lang.Call:
+		e.raiseIf(ins.position, FaultCallStackOverflow,
+			wasmRef("local.get", "csp"), wasmValue("i32.const", int64(gvm.CallStackSize)), wasmPlain("i32.eq"))
+		e.emit(address("csp", 2)...)
+		e.emit(wasmValue("i32.const", int64(e.blocks[ins.next()])), wasmValue("i32.store", wasmCallStackAt))
+		e.emit(adjust("csp", 1)...)
+		e.jump(target)
+	case lang.Ret:
+		e.raiseIf(ins.position, FaultCallStackUnderflow, wasmRef("local.get", "csp"), wasmPlain("i32.eqz"))
+		e.emit(adjust("csp", -1)...)
+		e.emit(address("csp", 2)...)
+		e.emit(wasmValue("i32.load", wasmCallStackAt), wasmRef("local.set", "pc"))
+		e.emit(wasmComment("Handlers installed by the returning routine go out of scope"))
+		e.emit(wasmRef("block", "unwound"), wasmRef("loop", "unwind"))
+		e.emit(wasmRef("local.get", "hp"), wasmPlain("i32.eqz"), wasmRef("br_if", "unwound"))
+		e.emit(wasmRef("local.get", "hp"), wasmValue("i32.const", 1), wasmPlain("i32.sub"),
+			wasmValue("i32.const", 4), wasmPlain("i32.shl"))
+		e.emit(wasmValue("i32.load", wasmHandlersAt+wasmHandlerCsp), wasmRef("local.get", "csp"),
+			wasmPlain("i32.le_s"), wasmRef("br_if", "unwound"))
+		e.emit(adjust("hp", -1)...)
+		e.emit(wasmRef("br", "unwind"), wasmPlain("end"), wasmPlain("end"))
+		e.emit(wasmRef("br", "dispatch"))
+	case lang.Noop:
+	case lang.Iarg:
+		e.emit(get(0), wasmRef("call", "iarg"), wasmRef("local.set", "ok"), wasmRef("local.set", "value"))
+		e.emit(wasmRef("local.get", "ok"), wasmPlain("i32.eqz"), wasmPlain("if"))
+		e.emit(wasmValue("i32.const", 1), wasmRef("local.set", "errFlag"))
+		e.emit(wasmPlain("else"))
+		e.push(ins.position, wasmRef("local.get", "value"))
+		e.emit(wasmPlain("end"))
+	case lang.Assert:
+		e.raiseIf(ins.position, FaultAssertion, get(0), wasmPlain("i64.eqz"))
+	case lang.Trap:
+		e.throw(ins.position, wasmValue("i64.const", int64(ins.operands[0])))
+	case lang.Try:
+		e.raiseIf(ins.position, FaultHandlerStackOverflow,
+			wasmRef("local.get", "hp"), wasmValue("i32.const", int64(gvm.HandlerStackSize)), wasmPlain("i32.eq"))
+		e.emit(address("hp", 4)...)
+		e.emit(wasmRef("local.set", "handler"))
+		fields := []struct {
+			offset int64
+			value  wasmOp
+		}{
+			{wasmHandlerResume, wasmValue("i32.const", int64(e.blocks[target]))},
+			{wasmHandlerRegister, wasmValue("i32.const", int64(ins.operands[1]))},
+			{wasmHandlerCsp, wasmRef("local.get", "csp")},
+			{wasmHandlerSp, wasmRef("local.get", "sp")},
+		}
+		for _, field := range fields {
+			e.emit(wasmRef("local.get", "handler"), field.value,
+				wasmValue("i32.store", wasmHandlersAt+field.offset))
+		}
+		e.emit(adjust("hp", 1)...)
+	case lang.Endtry:
+		e.raiseIf(ins.position, FaultUnmatchedEndtry, wasmRef("local.get", "hp"), wasmPlain("i32.eqz"))
+		e.raiseIf(ins.position, FaultUnmatchedEndtry, wasmRef("local.get", "hp"), wasmValue("i32.const", 1),
+			wasmPlain("i32.sub"), wasmValue("i32.const", 4), wasmPlain("i32.shl"),
+			wasmValue("i32.load", wasmHandlersAt+wasmHandlerCsp), wasmRef("local.get", "csp"), wasmPlain("i32.ne"))
+		e.emit(adjust("hp", -1)...)
+	case lang.Throw:
+		e.throw(ins.position, get(0))
+	default:
+		panic("This path should be impossible.")
+	}
+}
+
+// push pushes the value pushed by the given instruction onto the stack.
+func (e *wasmEmitter) push(position int64, value wasmOp) {
+	e.raiseIf(position, FaultStackOverflow,
+		wasmRef("local.get", "sp"), wasmValue("i32.const", int64(gvm.StackSize)), wasmPlain("i32.eq"))
+	e.emit(address("sp", 3)...)
+	e.emit(value, wasmValue("i64.store", wasmStackAt))
+	e.emit(adjust("sp", 1)...)
+}
+
+// emitRaise writes the block raising the fault in the fault local, which is
+// either handled by the innermost handler or reported through the fault
+// import, stopping execution.
+func (e *wasmEmitter) emitRaise() {
+	e.emit(wasmRef("local.get", "hp"), wasmPlain("i32.eqz"), wasmPlain("if"))
+	e.emit(wasmValue("i32.const", 0), wasmRef("local.set", "description"))
+	e.emit(wasmValue("i32.const", 0), wasmRef("local.set", "descriptionLength"))
+	// The faults raised by the program are only described by their code
+	e.emit(wasmRef("local.get", "thrown"), wasmPlain("i32.eqz"), wasmPlain("if"))
+	for _, code := range sortedFaultCodes() {
+		at, length := e.str(faultDescriptions[code])
+		e.emit(wasmRef("local.get", "fault"), wasmValue("i64.const", code), wasmPlain("i64.eq"), wasmPlain("if"))
+		e.emit(wasmValue("i32.const", at), wasmRef("local.set", "description"))
+		e.emit(wasmValue("i32.const", length), wasmRef("local.set", "descriptionLength"))
+		e.emit(wasmPlain("end"))
+	}
+	e.emit(wasmPlain("end"))
+	e.emit(wasmRef("local.get", "fault"),
+		wasmRef("local.get", "description"), wasmRef("local.get", "descriptionLength"),
+		wasmRef("local.get", "faultAt"), wasmRef("local.get", "faultLength"), wasmRef("call", "fault"))
+	e.emit(wasmValue("i32.const", 1), wasmPlain("return"))
+	e.emit(wasmPlain("end"))
+
+	e.emit(wasmValue("i32.const", 0), wasmRef("local.set", "thrown"))
+	e.emit(adjust("hp", -1)...)
+	e.emit(address("hp", 4)...)
+	e.emit(wasmRef("local.set", "handler"))
+	e.emit(wasmRef("local.get", "handler"), wasmValue("i32.load", wasmHandlersAt+wasmHandlerCsp),
+		wasmRef("local.set", "csp"))
+	e.emit(wasmRef("local.get", "handler"), wasmValue("i32.load", wasmHandlersAt+wasmHandlerSp),
+		wasmRef("local.set", "sp"))
+	for _, register := range e.faultRegisters {
+		e.emit(wasmRef("local.get", "handler"), wasmValue("i32.load", wasmHandlersAt+wasmHandlerRegister),
+			wasmValue("i32.const", int64(register)), wasmPlain("i32.eq"), wasmPlain("if"))
+		e.emit(wasmRef("local.get", "fault"), wasmRef("local.set", goRegister(register)))
+		e.emit(wasmPlain("end"))
+	}
+	e.emit(wasmRef("local.get", "handler"), wasmValue("i32.load", wasmHandlersAt+wasmHandlerResume),
+		wasmRef("local.set", "pc"))
+	e.emit(wasmRef("br", "dispatch"))
+}
+
+// emitRun writes the body of the function running the code, which returns the
+// exit status of the program.
+func (e *wasmEmitter) emitRun() {
+	if len(e.instructions) == 0 {
+		e.emit(wasmValue("i32.const", 0))
+		return
+	}
+
+	// Blocks are nested so that leaving the innermost one leads to the
+	// first block's code, and so on
+	e.emit(wasmRef("loop", "dispatch"))
+	for idx := len(e.labels) - 1; idx >= 0; idx-- {
+		e.emit(wasmOp{name: "block", ref: e.labels[idx], flat: true})
+	}
+	e.emit(wasmRef("local.get", "pc"), wasmOp{name: "br_table", labels: e.labels})
+
+	for idx, ins := range e.instructions {
+		if block, ok := e.blocks[ins.position]; ok {
+			e.emit(wasmOp{name: "end", ref: e.labels[block], flat: true})
+		}
+		e.emit(wasmComment(fmt.Sprintf("%s: %s", e.location(ins.position), e.describe(ins))))
+		e.emitInstruction(ins)
+
+		// Instructions that aren't reached by falling through start a block
+		if lang.FallsThrough(ins.instruction) && (idx+1 == len(e.instructions) ||
+			e.instructions[idx+1].position != ins.next()) {
+			e.jump(ins.next())
+		}
+	}
+
+	e.emit(wasmOp{name: "end", ref: e.labels[len(e.labels)-1], flat: true})
+	e.emitRaise()
+	e.emit(wasmPlain("end"), wasmPlain("unreachable"))
+}
+
+func i32Function(name string, body ...wasmOp) wasmFunction {
+	return wasmFunction{name: name, params: []wasmLocal{{"flags", "i32"}}, results: []string{"i32"}, body: body}
+}
+
+// emitWasm builds a module with the translated program, exporting a run
+// function which returns its exit status.
+func emitWasm(t *translation) *wasmModule {
+	e := &wasmEmitter{translation: t, blocks: make(map[int64]int), strings: make(map[string]int64)}
+	for idx, ins := range t.instructions {
+		if idx == 0 || t.isLabeled(ins.position) {
+			e.blocks[ins.position] = len(e.labels)
+			e.labels = append(e.labels, goLabel(ins.position))
+		}
+	}
+	e.labels = append(e.labels, "raise")
+	e.emitRun()
+
+	run := wasmFunction{name: "run", export: "run", results: []string{"i32"}, body: e.body}
+	for register := 0; register < gvm.RegisterCount; register++ {
+		run.locals = append(run.locals, wasmLocal{goRegister(gvm.Code(register)), "i64"})
+	}
+	for _, local := range []wasmLocal{{"pc", "i32"}, {"sp", "i32"}, {"csp", "i32"}, {"hp", "i32"},
+		{"handler", "i32"}, {"cmpFlag", "i32"}, {"errFlag", "i32"}, {"value", "i64"}, {"ok", "i32"},
+		{"fault", "i64"}, {"faultAt", "i32"}, {"faultLength", "i32"}, {"thrown", "i32"},
+		{"description", "i32"}, {"descriptionLength", "i32"}} {
+		run.locals = append(run.locals, local)
+	}
+
+	get := func(name string) wasmOp { return wasmRef("local.get", name) }
+	bit := func(shift int64) []wasmOp {
+		return []wasmOp{wasmValue("i32.const", shift), wasmPlain("i32.shl"), wasmPlain("i32.or")}
+	}
+	compareFlags := wasmFunction{
+		name:    "compareFlags",
+		params:  []wasmLocal{{"lhs", "i64"}, {"rhs", "i64"}},
+		results: []string{"i32"},
+		locals:  []wasmLocal{{"diff", "i64"}},
+	}
+	compareFlags.body = append(compareFlags.body,
+		get("lhs"), get("rhs"), wasmPlain("i64.sub"), wasmRef("local.set", "diff"),
+		wasmComment("Zero flag"),
+		get("diff"), wasmPlain("i64.eqz"),
+		wasmComment("Sign flag"),
+		get("diff"), wasmValue("i64.const", 0), wasmPlain("i64.lt_s"))
+	compareFlags.body = append(compareFlags.body, bit(1)...)
+	compareFlags.body = append(compareFlags.body,
+		wasmComment("Carry flag"),
+		get("lhs"), get("rhs"), wasmPlain("i64.lt_u"))
+	compareFlags.body = append(compareFlags.body, bit(2)...)
+	compareFlags.body = append(compareFlags.body,
+		wasmComment("Overflow flag"),
+		get("lhs"), get("rhs"), wasmPlain("i64.xor"), get("lhs"), get("diff"), wasmPlain("i64.xor"),
+		wasmPlain("i64.and"), wasmValue("i64.const", 0), wasmPlain("i64.lt_s"))
+	compareFlags.body = append(compareFlags.body, bit(3)...)
+
+	flag := func(shift int64) []wasmOp {
+		return []wasmOp{get("flags"), wasmValue("i32.const", shift), wasmPlain("i32.shr_u"),
+			wasmValue("i32.const", 1), wasmPlain("i32.and")}
+	}
+	isLess := i32Function("isLess", flag(1)...)
+	isLess.body = append(isLess.body, flag(3)...)
+	isLess.body = append(isLess.body, wasmPlain("i32.ne"))
+
+	functions := []wasmFunction{
+		{name: "show", module: "gvm", params: []wasmLocal{{"value", "i64"}}},
+		{name: "iarg", module: "gvm", params: []wasmLocal{{"index", "i64"}}, results: []string{"i64", "i32"}},
+		{name: "fault", module: "gvm", params: []wasmLocal{{"code", "i64"},
+			{"description", "i32"}, {"descriptionLength", "i32"}, {"location", "i32"}, {"locationLength", "i32"}}},
+		compareFlags,
+		i32Function("isEqual", flag(0)...),
+		isLess,
+		i32Function("isBelow", flag(2)...),
+		run,
+	}
+
+	return &wasmModule{
+		functions: functions,
+		pages:     int((wasmDataAt + e.dataEnd + wasmPageSize - 1) / wasmPageSize),
+		data:      e.data,
+	}
+}
+
+// TranslateToWasm translates a program into a WebAssembly module, in the text
+// or in the binary format, which runs it the same way the GVM would.
+func TranslateToWasm(filePaths []string, options compiler.Options, dstPath string, format string) {
+	if format != "wasm" && format != "wat" {
+		gvm.Logger.Criticalf("Unknown format '%s', expected 'wasm' or 'wat'.\n", format)
+		os.Exit(1)
+	}
+
+	program := loadProgram(filePaths, options)
+
+	gvm.Logger.Infof("Translating to WebAssembly.\n")
+	module := emitWasm(newTranslation(program))
+	if format == "wat" {
+		writeTranslation(dstPath, module.text())
+	} else {
+		writeTranslation(dstPath, module.binary())
+	}
+}
@@ -0,0 +1,50 @@
+package vm
+
+import (
+	"bytes"
+	"flag"
+	"github.com/vsartor/gvm/gvm/compiler"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// TestEmitWat checks the text format of the modules translated from the
+// examples against the golden files in testdata, which -update rewrites.
+func TestEmitWat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gvm-wat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"arithmetic", "fibonacci", "jumper"} {
+		name := name
+		t.Run(name, func(t *testing.T) {
+			dstPath := filepath.Join(dir, name+".wat")
+			TranslateToWasm([]string{"../../examples/" + name + ".gsm"}, compiler.Options{}, dstPath, "wat")
+			got, err := ioutil.ReadFile(dstPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			golden := filepath.Join("testdata", name+".wat")
+			if *update {
+				if err := ioutil.WriteFile(golden, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("translation of %s differs from %s, run the test with -update if that's expected",
+					name, golden)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package vm
+
+import (
+	"fmt"
+	"github.com/vsartor/gvm/gvm"
+)
+
+// Codes of the faults raised by the virtual machine itself. They are all
+// negative, leaving the non-negative codes for programs to use with `trap`.
+const (
+	FaultUnknownInstruction int64 = -(iota + 1)
+	FaultStackUnderflow
+	FaultCallStackOverflow
+	FaultCallStackUnderflow
+	FaultAssertion
+	FaultStackOverflow
+	FaultDivisionByZero
+	FaultHandlerStackOverflow
+	FaultUnmatchedEndtry
+)
+
+var faultDescriptions = map[int64]string{
+	FaultUnknownInstruction:   "unknown instruction",
+	FaultStackUnderflow:       "stack underflow",
+	FaultCallStackOverflow:    "call stack overflow",
+	FaultCallStackUnderflow:   "call stack underflow",
+	FaultAssertion:            "assertion failed",
+	FaultStackOverflow:        "stack overflow",
+	FaultDivisionByZero:       "division by zero",
+	FaultHandlerStackOverflow: "handler stack overflow",
+	FaultUnmatchedEndtry:      "endtry without a matching try",
+}
+
+// Fault is the error returned by Run when execution is stopped by a fault,
+// either raised by the virtual machine or by the program through `trap` or
+// `throw`.
+type Fault struct {
+	Code     int64
+	Position int64
+	// Thrown is set when the program raised the fault itself, in which case
+	// the code is whatever it chose and may collide with the ones of the
+	// virtual machine.
+	Thrown bool
+	// Source is where the faulting instruction was read from, if the program
+	// carries debug information.
+	Source *gvm.Context
+	// Symbol is the position relative to the closest preceding label, if the
+	// program carries debug information.
+	Symbol string
+}
+
+// IsTrap reports whether the fault was raised by the program with `trap` or
+// `throw`.
+func (fault *Fault) IsTrap() bool {
+	return fault.Thrown
+}
+
+func (fault *Fault) Error() string {
+	description, ok := faultDescriptions[fault.Code]
+	if fault.IsTrap() || !ok {
+		description = fmt.Sprintf("trap %d", fault.Code)
+	}
+
+	return fmt.Sprintf("%s at %s", description, formatLocation(fault.Position, fault.Source, fault.Symbol))
+}
+
+// formatLocation shows a code position along with the label and source line it
+// corresponds to, when known.
+func formatLocation(position int64, source *gvm.Context, symbol string) string {
+	location := fmt.Sprintf("%04d", position)
+	if symbol != "" {
+		location += fmt.Sprintf(" <%s>", symbol)
+	}
+	if source != nil {
+		location += fmt.Sprintf(" (%s.%d)", source.FileName, source.LineNum)
+	}
+	return location
+}
+
+// handler is an entry of the handler stack, installed by `try`.
+type handler struct {
+	position     int64
+	codeRegIdx   gvm.Code
+	callStackPtr int64
+	stackPtr     int64
+}
+
+// raise raises a fault at the current code position. If a handler is installed
+// the state is unwound to the one at the time of the matching `try` and
+// execution resumes at the handler, otherwise execution stops.
+func (vm *virtualMachine) raise(code int64) {
+	vm.signal(code, false)
+}
+
+// throw raises a fault on behalf of the program, as `trap` and `throw` do.
+func (vm *virtualMachine) throw(code int64) {
+	vm.signal(code, true)
+}
+
+func (vm *virtualMachine) signal(code int64, thrown bool) {
+	if vm.handlerPtr > 0 {
+		vm.handlerPtr--
+		h := vm.handlers[vm.handlerPtr]
+		vm.callStackPtr = h.callStackPtr
+		vm.stackPtr = h.stackPtr
+		vm.reg[h.codeRegIdx] = code
+		vm.codePosition = h.position
+		return
+	}
+
+	fault := &Fault{Code: code, Position: vm.codePosition, Thrown: thrown}
+	if source, ok := vm.debug.SourceOf(vm.codePosition); ok {
+		fault.Source = &source
+	}
+	if symbol, ok := vm.debug.SymbolOf(vm.codePosition); ok {
+		fault.Symbol = symbol
+	}
+
+	vm.fault = fault
+}
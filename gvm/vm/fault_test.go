@@ -0,0 +1,104 @@
+package vm
+
+import (
+	"github.com/vsartor/gvm/gvm"
+	"github.com/vsartor/gvm/gvm/compiler"
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+	"testing"
+)
+
+// compileSource builds a program from the given source code.
+func compileSource(t *testing.T, source string) gvm.Program {
+	file, err := ioutil.TempFile("", "gvm-*.gsm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if _, err := file.WriteString(source); err != nil {
+		t.Fatal(err)
+	}
+	return compiler.Build([]string{file.Name()}, compiler.Options{})
+}
+
+func TestFault(t *testing.T) {
+	cases := []struct {
+		name    string
+		source  string
+		code    int64
+		isTrap  bool
+		message string
+	}{
+		{"trap", "trap 4\n", 4, true, "trap 4"},
+		{"assert", "const 0 r1\nassert r1\n", FaultAssertion, false, "assertion failed"},
+		{"division by zero", "const 0 r1\ndiv r1 r2\n", FaultDivisionByZero, false, "division by zero"},
+		{"throw", "const 4 r1\nthrow r1\n", 4, true, "trap 4"},
+		{"throw negative", "const -3 r1\nthrow r1\n", -3, true, "trap -3"},
+		{"rethrow", "main:\ntry .caught r1\nconst 0 r2\ndiv r2 r3\nendtry\n.caught:\nthrow r1\n",
+			FaultDivisionByZero, true, "trap -7"},
+		{"caught throw", "main:\ntry .caught r1\nconst 2 r2\nthrow r2\nendtry\n.caught:\npop r1\n",
+			FaultStackUnderflow, false, "stack underflow"},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			err := Run(compileSource(t, c.source), nil)
+			fault, ok := err.(*Fault)
+			if !ok {
+				t.Fatalf("expected a fault, got %v", err)
+			}
+			if fault.Code != c.code || fault.IsTrap() != c.isTrap {
+				t.Errorf("got code %d with IsTrap %v, expected code %d with IsTrap %v",
+					fault.Code, fault.IsTrap(), c.code, c.isTrap)
+			}
+			if message := fault.Error(); !strings.HasPrefix(message, c.message) {
+				t.Errorf("got %q, expected it to start with %q", message, c.message)
+			}
+		})
+	}
+}
+
+func TestAssertAndTrap(t *testing.T) {
+	cases := []struct {
+		name   string
+		source string
+		// Whether the program faults, and with which code at which position,
+		// counting the jump to main the code starts with
+		faults   bool
+		code     int64
+		position int64
+	}{
+		{"assert holds", "const 1 r1\nassert r1\n", false, 0, 0},
+		{"assert holds on negative values", "const -1 r1\nassert r1\n", false, 0, 0},
+		{"assert fails", "const 1 r1\nassert r1\nassert r2\n", true, FaultAssertion, 7},
+		{"trap zero", "noop\ntrap 0\n", true, 0, 3},
+		{"trap", "trap 42\nnoop\n", true, 42, 2},
+		{"largest trap", "trap 0x7fffffffffffffff\n", true, math.MaxInt64, 2},
+		{"trap caught", "main:\ntry .caught r1\ntrap 3\n.caught:\nconst 0 r2\nassert r2\n", true, FaultAssertion, 10},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			vm, _ := runBothWays(t, compileSource(t, c.source))
+			if !c.faults {
+				if vm.fault != nil {
+					t.Errorf("expected no fault, got %s", vm.fault)
+				}
+				return
+			}
+			if vm.fault == nil {
+				t.Fatalf("expected a fault")
+			}
+			if vm.fault.Code != c.code || vm.fault.Position != c.position {
+				t.Errorf("got code %d at %d, expected code %d at %d",
+					vm.fault.Code, vm.fault.Position, c.code, c.position)
+			}
+		})
+	}
+}
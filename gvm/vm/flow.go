@@ -0,0 +1,97 @@
+package vm
+
+import (
+	"github.com/vsartor/gvm/gvm"
+	"github.com/vsartor/gvm/gvm/lang"
+)
+
+// decodedInstruction is an instruction along with its operands, as found at
+// a position of the code.
+type decodedInstruction struct {
+	position    int64
+	instruction gvm.Code
+	operands    []gvm.Code
+	kinds       []int
+}
+
+// decodeAt decodes the instruction at position, returning false if it is
+// unknown or its operands don't fit in the code.
+func decodeAt(code []gvm.Code, position int64) (decodedInstruction, bool) {
+	if position < 0 || position >= int64(len(code)) {
+		return decodedInstruction{}, false
+	}
+
+	kinds, ok := lang.Operands(code[position])
+	if !ok || position+int64(len(kinds)) >= int64(len(code)) {
+		return decodedInstruction{}, false
+	}
+
+	return decodedInstruction{
+		position:    position,
+		instruction: code[position],
+		operands:    code[position+1 : position+1+int64(len(kinds))],
+		kinds:       kinds,
+	}, true
+}
+
+// next returns the position of the instruction following this one.
+func (ins decodedInstruction) next() int64 {
+	return ins.position + 1 + int64(len(ins.operands))
+}
+
+// target returns the code position the instruction refers to, if any.
+func (ins decodedInstruction) target() (int64, bool) {
+	for idx, kind := range ins.kinds {
+		if kind == lang.LabelOperand {
+			return int64(ins.operands[idx]), true
+		}
+	}
+	return 0, false
+}
+
+// readRegisters returns the registers whose values the instruction uses.
+func (ins decodedInstruction) readRegisters() []gvm.Code {
+	switch ins.instruction {
+	case lang.Push, lang.Inc, lang.Dec, lang.Show, lang.Iarg, lang.Assert, lang.Throw, lang.Mov:
+		return []gvm.Code{ins.operands[0]}
+	case lang.Add, lang.Sub, lang.Mul, lang.Div, lang.Rem, lang.Cmp,
+		lang.Cmoveq, lang.Cmovne, lang.Cmovgt, lang.Cmovlt, lang.Cmovge, lang.Cmovle,
+		lang.Cmovb, lang.Cmova, lang.Cmovbe, lang.Cmovae:
+		// Conditional moves keep the value of the destination if the
+		// condition does not hold
+		return []gvm.Code{ins.operands[0], ins.operands[1]}
+	}
+	return nil
+}
+
+// writtenRegisters returns the registers the instruction sets. The register
+// receiving the fault code of a `try` is only set when the handler runs.
+func (ins decodedInstruction) writtenRegisters() []gvm.Code {
+	switch ins.instruction {
+	case lang.Const, lang.Mov, lang.Add, lang.Sub, lang.Mul, lang.Div, lang.Rem,
+		lang.Cmoveq, lang.Cmovne, lang.Cmovgt, lang.Cmovlt, lang.Cmovge, lang.Cmovle,
+		lang.Cmovb, lang.Cmova, lang.Cmovbe, lang.Cmovae:
+		return []gvm.Code{ins.operands[len(ins.operands)-1]}
+	case lang.Pop, lang.Inc, lang.Dec,
+		lang.Seteq, lang.Setne, lang.Setgt, lang.Setlt, lang.Setge, lang.Setle,
+		lang.Setb, lang.Seta, lang.Setbe, lang.Setae:
+		return []gvm.Code{ins.operands[0]}
+	}
+	return nil
+}
+
+// successors returns the positions execution may continue from within the
+// same routine: the following instruction, the target of jumps and the
+// handler installed by `try`. Calls continue with the following instruction,
+// as if the routine called had already returned.
+func (ins decodedInstruction) successors() []int64 {
+	successors := make([]int64, 0, 2)
+	if lang.FallsThrough(ins.instruction) {
+		successors = append(successors, ins.next())
+	}
+	if lang.IsJump(ins.instruction) || ins.instruction == lang.Try {
+		target, _ := ins.target()
+		successors = append(successors, target)
+	}
+	return successors
+}
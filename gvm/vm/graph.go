@@ -0,0 +1,290 @@
+package vm
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/vsartor/gvm/gvm"
+	"github.com/vsartor/gvm/gvm/compiler"
+	"github.com/vsartor/gvm/gvm/lang"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Kinds of edges between basic blocks
+const (
+	fallthroughEdge = "fallthrough"
+	jumpEdge        = "jump"
+	branchEdge      = "branch"
+	handlerEdge     = "handler"
+)
+
+type graphBlock struct {
+	Name         string   `json:"name"`
+	Start        int64    `json:"start"`
+	End          int64    `json:"end"`
+	Source       string   `json:"source,omitempty"`
+	Instructions []string `json:"instructions"`
+}
+
+type graphEdge struct {
+	From int64  `json:"from"`
+	To   int64  `json:"to"`
+	Kind string `json:"kind,omitempty"`
+}
+
+type graphRoutine struct {
+	Name  string `json:"name"`
+	Entry int64  `json:"entry"`
+}
+
+type controlFlowGraph struct {
+	Blocks []graphBlock `json:"blocks"`
+	Edges  []graphEdge  `json:"edges"`
+	// The call graph, whose edges go from the entry of the caller to the
+	// entry of the callee
+	Routines []graphRoutine `json:"routines"`
+	Calls    []graphEdge    `json:"calls"`
+}
+
+// positionName names a code position by its label if there is one.
+func positionName(debug *gvm.DebugInfo, position int64) string {
+	if symbol, ok := debug.SymbolOf(position); ok {
+		return symbol
+	}
+	return fmt.Sprintf("%04d", position)
+}
+
+// decodeAll decodes the instructions in the order they are laid out, stopping
+// at the first one that can't be decoded.
+func decodeAll(code []gvm.Code) []decodedInstruction {
+	instructions := make([]decodedInstruction, 0)
+	for position := int64(0); position < int64(len(code)); {
+		ins, ok := decodeAt(code, position)
+		if !ok {
+			gvm.Logger.Warningf("Unknown instruction or missing operands at %04d.\n", position)
+			break
+		}
+		instructions = append(instructions, ins)
+		position = ins.next()
+	}
+	return instructions
+}
+
+// buildGraph splits the code into basic blocks, which start at the targets of
+// jumps, calls and handlers and end right after instructions that may not fall
+// through to the next one.
+func buildGraph(program gvm.Program) controlFlowGraph {
+	instructions := decodeAll(program.Code)
+
+	leaders := map[int64]bool{0: true}
+	inCode := make(map[int64]bool)
+	for _, ins := range instructions {
+		inCode[ins.position] = true
+	}
+	for _, ins := range instructions {
+		if target, ok := ins.target(); ok && inCode[target] {
+			leaders[target] = true
+		}
+		if lang.IsJump(ins.instruction) || !lang.FallsThrough(ins.instruction) || ins.instruction == lang.Try {
+			leaders[ins.next()] = true
+		}
+	}
+
+	graph := controlFlowGraph{Blocks: make([]graphBlock, 0), Edges: make([]graphEdge, 0)}
+	vm := virtualMachine{debug: program.Debug}
+	for idx, ins := range instructions {
+		if leaders[ins.position] {
+			block := graphBlock{Name: positionName(program.Debug, ins.position), Start: ins.position}
+			if source, ok := program.Debug.SourceOf(ins.position); ok {
+				block.Source = source.String()
+			}
+			graph.Blocks = append(graph.Blocks, block)
+		}
+
+		block := &graph.Blocks[len(graph.Blocks)-1]
+		vm.codePosition = ins.position
+		text, _ := disassembleInstruction(vm, program.Code)
+		block.Instructions = append(block.Instructions, fmt.Sprintf("%04d: %s", ins.position, text))
+		block.End = ins.next()
+
+		isLast := idx+1 == len(instructions) || leaders[ins.next()]
+		if !isLast {
+			continue
+		}
+
+		target, _ := ins.target()
+		if lang.FallsThrough(ins.instruction) && idx+1 < len(instructions) {
+			graph.Edges = append(graph.Edges, graphEdge{block.Start, ins.next(), fallthroughEdge})
+		}
+		switch {
+		case ins.instruction == lang.Jmp:
+			graph.Edges = append(graph.Edges, graphEdge{block.Start, target, jumpEdge})
+		case lang.IsJump(ins.instruction):
+			graph.Edges = append(graph.Edges, graphEdge{block.Start, target, branchEdge})
+		case ins.instruction == lang.Try:
+			graph.Edges = append(graph.Edges, graphEdge{block.Start, target, handlerEdge})
+		}
+	}
+
+	// Edges to positions outside the code, or within an instruction, lead
+	// nowhere
+	starts := make(map[int64]bool)
+	for _, block := range graph.Blocks {
+		starts[block.Start] = true
+	}
+	edges := make([]graphEdge, 0, len(graph.Edges))
+	for _, edge := range graph.Edges {
+		if starts[edge.To] {
+			edges = append(edges, edge)
+		}
+	}
+	graph.Edges = edges
+
+	graph.Routines, graph.Calls = buildCallGraph(program, instructions, inCode)
+	return graph
+}
+
+// entryRoutine finds where the program's own code starts, past the jump to
+// `main` the compiler puts at the start of the code.
+func entryRoutine(program gvm.Program, instructions []decodedInstruction, inCode map[int64]bool) int64 {
+	if target, ok := instructions[0].target(); ok && instructions[0].instruction == lang.Jmp && inCode[target] {
+		return target
+	}
+	if position, ok := program.Debug.Symbols["main"]; ok && inCode[position] {
+		return position
+	}
+	return 0
+}
+
+// buildCallGraph finds the routines of the program, starting from its entry
+// and from each target of a `call`, and which routines they call.
+func buildCallGraph(program gvm.Program, instructions []decodedInstruction,
+	inCode map[int64]bool) ([]graphRoutine, []graphEdge) {
+	routines := make([]graphRoutine, 0)
+	calls := make([]graphEdge, 0)
+	if len(instructions) == 0 {
+		return routines, calls
+	}
+
+	byPosition := make(map[int64]decodedInstruction)
+	entries := []int64{entryRoutine(program, instructions, inCode)}
+	for _, ins := range instructions {
+		byPosition[ins.position] = ins
+		if target, ok := ins.target(); ok && ins.instruction == lang.Call && inCode[target] {
+			entries = append(entries, target)
+		}
+	}
+
+	seenRoutine := make(map[int64]bool)
+	for _, entry := range entries {
+		if seenRoutine[entry] {
+			continue
+		}
+		seenRoutine[entry] = true
+		routines = append(routines, graphRoutine{positionName(program.Debug, entry), entry})
+
+		// Follow the code of the routine, without going into the routines it
+		// calls
+		callees := make(map[int64]bool)
+		visited := map[int64]bool{entry: true}
+		worklist := []int64{entry}
+		for len(worklist) > 0 {
+			ins := byPosition[worklist[len(worklist)-1]]
+			worklist = worklist[:len(worklist)-1]
+
+			if target, ok := ins.target(); ok && ins.instruction == lang.Call && inCode[target] {
+				callees[target] = true
+			}
+			for _, successor := range ins.successors() {
+				if _, ok := byPosition[successor]; ok && !visited[successor] {
+					visited[successor] = true
+					worklist = append(worklist, successor)
+				}
+			}
+		}
+
+		sortedCallees := make([]int64, 0, len(callees))
+		for callee := range callees {
+			sortedCallees = append(sortedCallees, callee)
+		}
+		sort.Slice(sortedCallees, func(i, j int) bool { return sortedCallees[i] < sortedCallees[j] })
+		for _, callee := range sortedCallees {
+			calls = append(calls, graphEdge{From: entry, To: callee})
+		}
+	}
+
+	sort.Slice(routines, func(i, j int) bool { return routines[i].Entry < routines[j].Entry })
+	return routines, calls
+}
+
+func dotEscape(str string) string {
+	str = strings.Replace(str, `\`, `\\`, -1)
+	return strings.Replace(str, `"`, `\"`, -1)
+}
+
+func writeDot(graph controlFlowGraph) {
+	fmt.Println("digraph cfg {")
+	fmt.Println("\tnode [shape=box, fontname=monospace];")
+	for _, block := range graph.Blocks {
+		lines := []string{block.Name}
+		if block.Source != "" {
+			lines[0] += " (" + block.Source + ")"
+		}
+		lines = append(lines, block.Instructions...)
+
+		// Ending lines with `\l` aligns them to the left
+		label := ""
+		for _, line := range lines {
+			label += dotEscape(line) + `\l`
+		}
+		fmt.Printf("\tb%d [label=\"%s\"];\n", block.Start, label)
+	}
+	for _, edge := range graph.Edges {
+		style := ""
+		switch edge.Kind {
+		case branchEdge:
+			style = ", color=blue"
+		case handlerEdge:
+			style = ", style=dashed, color=red"
+		}
+		fmt.Printf("\tb%d -> b%d [label=\"%s\"%s];\n", edge.From, edge.To, edge.Kind, style)
+	}
+	fmt.Println("}")
+
+	fmt.Println("digraph calls {")
+	fmt.Println("\tnode [shape=ellipse, fontname=monospace];")
+	for _, routine := range graph.Routines {
+		fmt.Printf("\tr%d [label=\"%s\"];\n", routine.Entry, dotEscape(routine.Name))
+	}
+	for _, call := range graph.Calls {
+		fmt.Printf("\tr%d -> r%d;\n", call.From, call.To)
+	}
+	fmt.Println("}")
+}
+
+// Graph prints the control flow graph and the call graph of a program, either
+// in the DOT language of Graphviz or as JSON.
+func Graph(filePaths []string, options compiler.Options, format string) {
+	if format != "dot" && format != "json" {
+		gvm.Logger.Criticalf("Unknown graph format '%s', expected 'dot' or 'json'.\n", format)
+		os.Exit(1)
+	}
+
+	program := loadProgram(filePaths, options)
+
+	gvm.Logger.Infof("Building graphs.\n")
+	graph := buildGraph(program)
+
+	if format == "dot" {
+		writeDot(graph)
+		return
+	}
+
+	output, err := json.MarshalIndent(graph, "", "  ")
+	if err != nil {
+		gvm.Logger.Criticalf("Failed encoding the graphs: %s\n", err.Error())
+		os.Exit(1)
+	}
+	fmt.Println(string(output))
+}
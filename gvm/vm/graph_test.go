@@ -0,0 +1,43 @@
+package vm
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCallGraph(t *testing.T) {
+	source := "helper:\nret\nmain:\ncall helper\ncall other\nhalt\nother:\ncall helper\nret\n"
+	graph := buildGraph(compileSource(t, source))
+
+	names := make(map[int64]string)
+	for _, routine := range graph.Routines {
+		names[routine.Entry] = routine.Name
+	}
+	calls := make([]string, 0)
+	for _, call := range graph.Calls {
+		calls = append(calls, names[call.From]+" -> "+names[call.To])
+	}
+
+	// The jump to main at the start of the code is not a routine of its own
+	expected := []string{"main -> helper", "main -> other", "other -> helper"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("got calls %q, expected %q", calls, expected)
+	}
+	if len(graph.Routines) != 3 {
+		t.Errorf("got routines %+v, expected helper, main and other", graph.Routines)
+	}
+
+	// Instructions name what they jump to by its label
+	texts := make([]string, 0)
+	for _, block := range graph.Blocks {
+		for _, text := range block.Instructions {
+			texts = append(texts, text[strings.Index(text, ": ")+2:])
+		}
+	}
+	for _, text := range []string{"jmp main", "call helper", "call other"} {
+		if !strings.Contains(strings.Join(texts, "\n"), text) {
+			t.Errorf("no instruction disassembled as %q, got %q", text, texts)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package vm
+
+import (
+	"fmt"
+	"github.com/vsartor/gvm/gvm"
+)
+
+// Kinds of words of the virtual machine's state that a step can change
+const (
+	registerWord = iota
+	stackWord
+	callStackWord
+	stackPtrWord
+	callStackPtrWord
+	handlerPtrWord
+	codePositionWord
+	cmpFlagWord
+	errFlagWord
+)
+
+// stateChange records a word of the state changed by a step.
+type stateChange struct {
+	kind     int
+	idx      int64
+	old, new int64
+}
+
+// handlerChange records an entry of the handler stack changed by a step.
+type handlerChange struct {
+	idx      int64
+	old, new handler
+}
+
+// historyStep holds what a step changed, so it can be undone and redone.
+type historyStep struct {
+	changes []stateChange
+	handler *handlerChange
+	// Fault that stopped execution, if the step raised one
+	fault *Fault
+}
+
+// snapshot is a full copy of the state at some step, from which later steps
+// can be redone.
+type snapshot struct {
+	step int64
+	vm   virtualMachine
+}
+
+// history records the steps run by the debugger so they can be gone back to.
+// Steps are numbered by how many instructions ran before them, and only the
+// last gvm.DebugHistorySize or so are kept, along with a snapshot every
+// gvm.DebugSnapshotInterval steps.
+type history struct {
+	// Step the virtual machine is at
+	step int64
+	// Oldest step that can be gone back to, which always has a snapshot
+	first int64
+	// Steps from first onwards, steps[i] leading from step first+i to the next
+	steps     []historyStep
+	snapshots []snapshot
+	// Words that the next step could change, and their values beforehand
+	watched []stateChange
+}
+
+func newHistory(vm *virtualMachine) *history {
+	return &history{snapshots: []snapshot{{0, vm.clone()}}}
+}
+
+// last is the furthest step that was run.
+func (h *history) last() int64 {
+	return h.first + int64(len(h.steps))
+}
+
+// clone copies the state of the virtual machine.
+func (vm *virtualMachine) clone() virtualMachine {
+	copied := *vm
+	copied.stack = append([]int64(nil), vm.stack...)
+	copied.callStack = append([]int64(nil), vm.callStack...)
+	copied.handlers = append([]handler(nil), vm.handlers...)
+	copied.reg = append([]int64(nil), vm.reg...)
+	return copied
+}
+
+// restore brings the state of the virtual machine back to a copy of it.
+func (vm *virtualMachine) restore(copied *virtualMachine) {
+	copy(vm.stack, copied.stack)
+	copy(vm.callStack, copied.callStack)
+	copy(vm.handlers, copied.handlers)
+	copy(vm.reg, copied.reg)
+	vm.stackPtr, vm.callStackPtr, vm.handlerPtr = copied.stackPtr, copied.callStackPtr, copied.handlerPtr
+	vm.codePosition, vm.cmpFlag, vm.errFlag = copied.codePosition, copied.cmpFlag, copied.errFlag
+	vm.fault = copied.fault
+}
+
+func (vm *virtualMachine) word(kind int, idx int64) *int64 {
+	switch kind {
+	case registerWord:
+		return &vm.reg[idx]
+	case stackWord:
+		return &vm.stack[idx]
+	case callStackWord:
+		return &vm.callStack[idx]
+	case stackPtrWord:
+		return &vm.stackPtr
+	case callStackPtrWord:
+		return &vm.callStackPtr
+	case handlerPtrWord:
+		return &vm.handlerPtr
+	case codePositionWord:
+		return &vm.codePosition
+	case cmpFlagWord:
+		return &vm.cmpFlag
+	case errFlagWord:
+		return &vm.errFlag
+	default:
+		panic("This path should be impossible.")
+	}
+}
+
+// watch lists the words the next step could change along with their values.
+// Besides registers, pointers and flags, instructions only ever write to the
+// entries the stack pointers point at.
+func (h *history) watch(vm *virtualMachine) {
+	h.watched = h.watched[:0]
+	for idx := range vm.reg {
+		h.watched = append(h.watched, stateChange{kind: registerWord, idx: int64(idx)})
+	}
+	if vm.stackPtr < int64(len(vm.stack)) {
+		h.watched = append(h.watched, stateChange{kind: stackWord, idx: vm.stackPtr})
+	}
+	if vm.callStackPtr < int64(len(vm.callStack)) {
+		h.watched = append(h.watched, stateChange{kind: callStackWord, idx: vm.callStackPtr})
+	}
+	for _, kind := range []int{stackPtrWord, callStackPtrWord, handlerPtrWord, codePositionWord, cmpFlagWord, errFlagWord} {
+		h.watched = append(h.watched, stateChange{kind: kind})
+	}
+	for idx := range h.watched {
+		h.watched[idx].old = *vm.word(h.watched[idx].kind, h.watched[idx].idx)
+	}
+}
+
+// run runs the next step, recording what it changed.
+func (h *history) run(vm *virtualMachine, code []gvm.Code) {
+	h.watch(vm)
+	handlerPtr := vm.handlerPtr
+	var oldHandler handler
+	if handlerPtr < int64(len(vm.handlers)) {
+		oldHandler = vm.handlers[handlerPtr]
+	}
+
+	executeStep(vm, code)
+
+	var step historyStep
+	for _, change := range h.watched {
+		if change.new = *vm.word(change.kind, change.idx); change.new != change.old {
+			step.changes = append(step.changes, change)
+		}
+	}
+	if handlerPtr < int64(len(vm.handlers)) && vm.handlers[handlerPtr] != oldHandler {
+		step.handler = &handlerChange{handlerPtr, oldHandler, vm.handlers[handlerPtr]}
+	}
+	step.fault = vm.fault
+
+	h.steps = append(h.steps, step)
+	h.step++
+	if h.step%gvm.DebugSnapshotInterval == 0 {
+		h.snapshots = append(h.snapshots, snapshot{h.step, vm.clone()})
+	}
+
+	// Forget the oldest steps, up to the next snapshot, when there are too many
+	if len(h.steps) > gvm.DebugHistorySize && len(h.snapshots) > 1 {
+		dropped := int(h.snapshots[1].step - h.first)
+		kept := copy(h.steps, h.steps[dropped:])
+		for idx := kept; idx < len(h.steps); idx++ {
+			h.steps[idx] = historyStep{}
+		}
+		h.steps = h.steps[:kept]
+		h.snapshots = h.snapshots[1:]
+		h.first = h.snapshots[0].step
+	}
+}
+
+// forward moves on to the next step, redoing it if it was already run.
+func (h *history) forward(vm *virtualMachine, code []gvm.Code) {
+	if h.step == h.last() {
+		h.run(vm, code)
+		return
+	}
+
+	step := &h.steps[h.step-h.first]
+	for _, change := range step.changes {
+		*vm.word(change.kind, change.idx) = change.new
+	}
+	if step.handler != nil {
+		vm.handlers[step.handler.idx] = step.handler.new
+	}
+	vm.fault = step.fault
+	h.step++
+}
+
+// backward undoes the last step, returning false if it was forgotten.
+func (h *history) backward(vm *virtualMachine) bool {
+	if h.step == h.first {
+		return false
+	}
+
+	h.step--
+	step := &h.steps[h.step-h.first]
+	for _, change := range step.changes {
+		*vm.word(change.kind, change.idx) = change.old
+	}
+	if step.handler != nil {
+		vm.handlers[step.handler.idx] = step.handler.old
+	}
+	vm.fault = nil
+	return true
+}
+
+// travel goes to the given step, running the program up to it if it's further
+// than any step run so far, and returns an error if it was forgotten.
+func (h *history) travel(vm *virtualMachine, code []gvm.Code, target int64) error {
+	if target < h.first {
+		return fmt.Errorf("step %d is no longer in the history, which starts at step %d", target, h.first)
+	}
+
+	// Steps far enough behind are reached faster from the closest snapshot
+	if target < h.step {
+		closest := h.snapshots[0]
+		for _, snap := range h.snapshots {
+			if snap.step <= target {
+				closest = snap
+			}
+		}
+		if target-closest.step < h.step-target {
+			vm.restore(&closest.vm)
+			h.step = closest.step
+		}
+	}
+
+	for h.step > target {
+		h.backward(vm)
+	}
+	for h.step < target && vm.isRunning(code) {
+		h.forward(vm, code)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package vm
+
+import (
+	"github.com/vsartor/gvm/gvm"
+	"os"
+	"time"
+)
+
+// RunOptions tells what to record about a run besides what the program prints.
+type RunOptions struct {
+	// Path of the pprof profile to write, if any
+	Profile string
+	// Number of labels and instructions to list in a text report, if any
+	Top int
+	// Path of the coverage file to write, or to merge into if it exists
+	Coverage string
+	// Path of the trace to write, if any, and which steps to write to it
+	Trace       string
+	TraceFilter TraceFilter
+}
+
+func (options RunOptions) instrumented() bool {
+	return options.Profile != "" || options.Top > 0 || options.Coverage != "" || options.Trace != ""
+}
+
+// observer watches a program run one instruction at a time.
+type observer interface {
+	// before is called ahead of running the instruction at vm.codePosition.
+	before(vm *virtualMachine, code []gvm.Code)
+	// after is called once the instruction at position ran, depth being the
+	// size of the call stack beforehand.
+	after(vm *virtualMachine, position int64, depth int64)
+}
+
+// runObserved runs a verified program one instruction at a time, letting the
+// observers watch every step.
+func runObserved(program gvm.Program, args []string, observers []observer) error {
+	vm := newVirtualMachine(program, args)
+	for vm.isRunning(program.Code) {
+		position, depth := vm.codePosition, vm.callStackPtr
+		for _, o := range observers {
+			o.before(vm, program.Code)
+		}
+
+		executeStep(vm, program.Code)
+
+		for _, o := range observers {
+			o.after(vm, position, depth)
+		}
+	}
+
+	if vm.fault != nil {
+		return vm.fault
+	}
+	return nil
+}
+
+// RunInstrumented runs a program the same way as Run while recording what the
+// options ask for. Profiles, coverage and traces are written even if the
+// program faults, but not if it fails verification. The path of the program is kept
+// in the coverage so the source can be annotated later on.
+func RunInstrumented(program gvm.Program, path string, args []string, options RunOptions) error {
+	if err := Verify(program); err != nil {
+		return err
+	}
+
+	var observers []observer
+	var p *profile
+	if options.Profile != "" || options.Top > 0 {
+		p = newProfile(program)
+		observers = append(observers, p)
+	}
+	var cov *coverage
+	if options.Coverage != "" {
+		cov = newCoverage(program, path)
+		observers = append(observers, cov)
+	}
+	var t *tracer
+	if options.Trace != "" {
+		t = newTracer(program, options.Trace, options.TraceFilter)
+		observers = append(observers, t)
+	}
+
+	err := runObserved(program, args, observers)
+
+	if p != nil {
+		p.duration = time.Since(p.start)
+		if options.Profile != "" {
+			p.write(options.Profile)
+		}
+		if options.Top > 0 {
+			p.report(os.Stderr, options.Top)
+		}
+	}
+	if cov != nil {
+		cov.write(options.Coverage)
+	}
+	if t != nil {
+		t.close()
+	}
+	return err
+}
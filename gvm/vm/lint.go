@@ -0,0 +1,387 @@
+package vm
+
+import (
+	"fmt"
+	"github.com/vsartor/gvm/gvm"
+	"github.com/vsartor/gvm/gvm/compiler"
+	"github.com/vsartor/gvm/gvm/lang"
+	"sort"
+	"strings"
+)
+
+// Summaries of recursive routines may never settle, e.g. if each call pops one
+// value more than the previous one, so give up refining them at some point
+const maxLintIterations = 100
+
+const allRegisters uint64 = 1<<uint(gvm.RegisterCount) - 1
+
+// flowState is what the linter knows about the GVM right before running an
+// instruction, relative to the start of the routine containing it.
+type flowState struct {
+	// Registers written on every path from the start of the routine
+	defined uint64
+	// Number of values pushed since the start of the routine
+	depth int64
+	// Whether an `iarg` may have set the error flag
+	errMaybe bool
+	// Whether the last value pushed came from an `iarg`, which pushes nothing
+	// when it sets the error flag
+	argPending bool
+}
+
+// routineSummary describes the effect of calling a routine.
+type routineSummary struct {
+	returns bool
+	// Registers written on every path to a `ret`
+	writes uint64
+	// Number of values pushed when returning
+	delta int64
+	// Lowest number of values pushed at any point, including within the
+	// routines it calls, which is negative for routines popping their arguments
+	minDepth int64
+	// Whether the error flag may be set when returning
+	setsErr bool
+}
+
+type callSite struct {
+	callee int64
+	// Registers written by the caller since its own start
+	defined uint64
+}
+
+// routine is the code reachable from the target of a `call`, or from the
+// start of the code, without going into other routines.
+type routine struct {
+	entry   int64
+	summary routineSummary
+	states  map[int64]flowState
+	calls   []callSite
+	// Registers written by every caller before calling the routine
+	entryDefined uint64
+}
+
+type lintWarning struct {
+	position int64
+	message  string
+}
+
+type linter struct {
+	code     []gvm.Code
+	debug    *gvm.DebugInfo
+	routines map[int64]*routine
+	order    []*routine
+	// Positions of the instructions which may run
+	reached  map[int64]bool
+	report   bool
+	warnings map[lintWarning]bool
+}
+
+func (l *linter) warn(position int64, format string, args ...interface{}) {
+	if l.report {
+		l.warnings[lintWarning{position, fmt.Sprintf(format, args...)}] = true
+	}
+}
+
+func (l *linter) routineAt(entry int64) *routine {
+	if r, ok := l.routines[entry]; ok {
+		return r
+	}
+
+	r := &routine{entry: entry, summary: routineSummary{writes: allRegisters}, entryDefined: allRegisters}
+	l.routines[entry] = r
+	l.order = append(l.order, r)
+	return r
+}
+
+func registerBit(register gvm.Code) uint64 {
+	if register < 0 || int(register) >= gvm.RegisterCount {
+		return 0
+	}
+	return 1 << uint(register)
+}
+
+type flowEdge struct {
+	position int64
+	state    flowState
+}
+
+// step computes the state following an instruction, updating the summary of
+// the routine being analyzed.
+func (l *linter) step(r *routine, summary *routineSummary, ins decodedInstruction, state flowState) []flowEdge {
+	defined := r.entryDefined | state.defined
+	for _, register := range ins.readRegisters() {
+		if registerBit(register) == 0 {
+			l.warn(ins.position, "register index %d is out of range", register)
+		} else if defined&registerBit(register) == 0 {
+			l.warn(ins.position, "register r%d may be read before being written", register)
+		}
+	}
+
+	next := state
+	for _, register := range ins.writtenRegisters() {
+		next.defined |= registerBit(register)
+	}
+	if state.depth < summary.minDepth {
+		summary.minDepth = state.depth
+	}
+
+	target, _ := ins.target()
+
+	switch ins.instruction {
+	case lang.Push:
+		next.depth++
+	case lang.Pop:
+		next.depth--
+		if r.entry == 0 && next.depth < 0 {
+			l.warn(ins.position, "`pop` from an empty stack")
+		}
+		if state.argPending {
+			l.warn(ins.position, "`pop` before checking with `jerr` whether `iarg` pushed a value")
+			next.argPending = false
+		}
+	case lang.Iarg:
+		next.depth++
+		next.errMaybe, next.argPending = true, true
+	case lang.Jerr:
+		if !state.errMaybe {
+			l.warn(ins.position, "`jerr` can never jump, as no `iarg` may have set the error flag")
+		}
+		next.errMaybe, next.argPending = false, false
+		taken := next
+		if state.argPending {
+			taken.depth--
+		}
+		return []flowEdge{{ins.next(), next}, {target, taken}}
+	case lang.Call:
+		callee := l.routineAt(target)
+		r.calls = append(r.calls, callSite{target, state.defined})
+
+		depth := state.depth + callee.summary.minDepth
+		if r.entry == 0 && depth < 0 {
+			l.warn(ins.position, "the routine called may pop more values than were pushed")
+		}
+		if depth < summary.minDepth {
+			summary.minDepth = depth
+		}
+
+		if !callee.summary.returns {
+			return nil
+		}
+		next.defined |= callee.summary.writes
+		next.depth += callee.summary.delta
+		next.errMaybe = next.errMaybe || callee.summary.setsErr
+	case lang.Ret:
+		if r.entry == 0 {
+			l.warn(ins.position, "`ret` reached without a matching `call`")
+		}
+		if !summary.returns {
+			summary.returns, summary.delta = true, state.depth
+		} else if summary.delta != state.depth {
+			l.warn(ins.position, "routine returns with a stack depth of %d here but %d elsewhere",
+				state.depth, summary.delta)
+		}
+		summary.writes &= state.defined
+		summary.setsErr = summary.setsErr || state.errMaybe
+		return nil
+	case lang.Try:
+		handler := next
+		handler.defined |= registerBit(ins.operands[1])
+		return []flowEdge{{ins.next(), next}, {target, handler}}
+	}
+
+	edges := make([]flowEdge, 0, 2)
+	for _, successor := range ins.successors() {
+		edges = append(edges, flowEdge{successor, next})
+	}
+	return edges
+}
+
+// analyze follows every path through a routine, returning whether its summary
+// changed.
+func (l *linter) analyze(r *routine) bool {
+	summary := routineSummary{writes: allRegisters}
+	r.states = map[int64]flowState{r.entry: {}}
+	r.calls = nil
+	mismatched := make(map[int64]bool)
+
+	worklist := []int64{r.entry}
+	for len(worklist) > 0 {
+		position := worklist[len(worklist)-1]
+		worklist = worklist[:len(worklist)-1]
+
+		ins, ok := decodeAt(l.code, position)
+		if !ok {
+			l.warn(position, "unknown instruction or missing operands")
+			continue
+		}
+		l.reached[position] = true
+
+		for _, edge := range l.step(r, &summary, ins, r.states[position]) {
+			if edge.position == int64(len(l.code)) {
+				l.warn(position, "execution may run past the end of the code without `halt`")
+				continue
+			} else if edge.position < 0 || edge.position > int64(len(l.code)) {
+				l.warn(position, "jump to %d, outside of the code", edge.position)
+				continue
+			}
+
+			existing, ok := r.states[edge.position]
+			if !ok {
+				r.states[edge.position] = edge.state
+				worklist = append(worklist, edge.position)
+				continue
+			}
+
+			if existing.depth != edge.state.depth && !mismatched[edge.position] {
+				mismatched[edge.position] = true
+				l.warn(edge.position, "paths reaching this point have different stack depths, %d and %d",
+					existing.depth, edge.state.depth)
+			}
+			merged := existing
+			merged.defined &= edge.state.defined
+			merged.errMaybe = merged.errMaybe || edge.state.errMaybe
+			merged.argPending = merged.argPending || edge.state.argPending
+			if merged != existing {
+				r.states[edge.position] = merged
+				worklist = append(worklist, edge.position)
+			}
+		}
+	}
+
+	changed := summary != r.summary
+	r.summary = summary
+	return changed
+}
+
+// propagateEntryDefined finds the registers written by every caller of each
+// routine before calling it.
+func (l *linter) propagateEntryDefined() {
+	for _, r := range l.order {
+		r.entryDefined = allRegisters
+	}
+	l.routineAt(0).entryDefined = 0
+
+	for changed := true; changed; {
+		changed = false
+		for _, r := range l.order {
+			for _, call := range r.calls {
+				callee := l.routines[call.callee]
+				defined := callee.entryDefined & (r.entryDefined | call.defined)
+				if defined != callee.entryDefined {
+					callee.entryDefined = defined
+					changed = true
+				}
+			}
+		}
+	}
+}
+
+// checkUnreachable warns about each sequence of instructions no path leads to.
+func (l *linter) checkUnreachable() {
+	start := int64(-1)
+	for position := int64(0); position < int64(len(l.code)); {
+		ins, ok := decodeAt(l.code, position)
+		if !ok {
+			l.warn(position, "unknown instruction or missing operands")
+			return
+		}
+
+		if l.reached[position] && start >= 0 {
+			l.warn(start, "unreachable code up to %04d", position)
+			start = -1
+		} else if !l.reached[position] && start < 0 {
+			start = position
+		}
+		position = ins.next()
+	}
+
+	if start >= 0 {
+		l.warn(start, "unreachable code up to the end")
+	}
+}
+
+// checkLabels warns about labels no instruction refers to. Sublabels and the
+// labels local to macros are left out, as they often name a part of a routine
+// only to document it.
+func (l *linter) checkLabels() {
+	if l.debug == nil {
+		return
+	}
+
+	referenced := make(map[int64]bool)
+	for position := int64(0); position < int64(len(l.code)); {
+		ins, ok := decodeAt(l.code, position)
+		if !ok {
+			break
+		}
+		if target, ok := ins.target(); ok {
+			referenced[target] = true
+		}
+		position = ins.next()
+	}
+
+	for name, position := range l.debug.Symbols {
+		if name != "main" && !strings.ContainsAny(name, ".@") && !referenced[position] {
+			l.warn(position, "label '%s' is never used", name)
+		}
+	}
+}
+
+func (l *linter) lint() []lintWarning {
+	// Refine the summaries of the routines, which depend on each other
+	l.routineAt(0).entryDefined = 0
+	for iteration, changed := 0, true; changed && iteration < maxLintIterations; iteration++ {
+		changed = false
+		for idx := 0; idx < len(l.order); idx++ {
+			changed = l.analyze(l.order[idx]) || changed
+		}
+	}
+	l.propagateEntryDefined()
+
+	// Go over everything once more, now reporting what is found
+	l.report = true
+	for _, r := range l.order {
+		l.analyze(r)
+	}
+	l.checkUnreachable()
+	l.checkLabels()
+
+	warnings := make([]lintWarning, 0, len(l.warnings))
+	for warning := range l.warnings {
+		warnings = append(warnings, warning)
+	}
+	sort.Slice(warnings, func(i, j int) bool {
+		if warnings[i].position != warnings[j].position {
+			return warnings[i].position < warnings[j].position
+		}
+		return warnings[i].message < warnings[j].message
+	})
+	return warnings
+}
+
+// Lint looks for likely mistakes in a program, printing a warning for each of them. It
+// returns the number of warnings.
+func Lint(filePaths []string, options compiler.Options) int {
+	program := loadProgram(filePaths, options)
+
+	gvm.Logger.Infof("Starting to lint.\n")
+
+	l := linter{
+		code:     program.Code,
+		debug:    program.Debug,
+		routines: make(map[int64]*routine),
+		reached:  make(map[int64]bool),
+		warnings: make(map[lintWarning]bool),
+	}
+	warnings := l.lint()
+	for _, warning := range warnings {
+		var source *gvm.Context
+		if ctxt, ok := program.Debug.SourceOf(warning.position); ok {
+			source = &ctxt
+		}
+		symbol, _ := program.Debug.SymbolOf(warning.position)
+		fmt.Printf("%s: %s\n", formatLocation(warning.position, source, symbol), warning.message)
+	}
+
+	return len(warnings)
+}
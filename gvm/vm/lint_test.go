@@ -0,0 +1,29 @@
+package vm
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLintLabels(t *testing.T) {
+	source := "main:\ncall helper\n.unused:\nhalt\nhelper:\nconst 1 r1\nunused:\nret\n"
+	program := compileSource(t, source)
+
+	l := linter{
+		code:     program.Code,
+		debug:    program.Debug,
+		routines: make(map[int64]*routine),
+		reached:  make(map[int64]bool),
+		warnings: make(map[lintWarning]bool),
+	}
+	messages := make([]string, 0)
+	for _, warning := range l.lint() {
+		messages = append(messages, warning.message)
+	}
+
+	// Only the top-level label is reported, not the sublabel
+	expected := []string{"label 'unused' is never used"}
+	if !reflect.DeepEqual(messages, expected) {
+		t.Errorf("got %q, expected %q", messages, expected)
+	}
+}
@@ -0,0 +1,437 @@
+package vm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/vsartor/gvm/gvm"
+	"github.com/vsartor/gvm/gvm/lang"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// callContext counts the instructions run by a routine when called from a
+// given chain of call sites.
+type callContext struct {
+	parent *callContext
+	// Position of the `call` leading here, or -1 for the outermost context
+	callSite int64
+	children map[int64]*callContext
+	counts   map[int64]int64
+}
+
+func newCallContext(parent *callContext, callSite int64) *callContext {
+	return &callContext{
+		parent:   parent,
+		callSite: callSite,
+		children: make(map[int64]*callContext),
+		counts:   make(map[int64]int64),
+	}
+}
+
+// call returns the context entered by a call from callSite. When the call
+// completes a cycle of call sites that is already repeated right above it,
+// it's folded into the context entered at the start of the cycle, so contexts
+// don't multiply with every level of recursion. The frames left out are the
+// same as the ones of the cycle above them, so every call site, and thus every
+// label, on the stack is kept and cumulative counts stay the same.
+func (ctxt *callContext) call(callSite int64) *callContext {
+	start := ctxt
+	for start != nil && start.callSite != callSite {
+		start = start.parent
+	}
+	if start != nil {
+		repeated := true
+		above := start.parent
+		for frame := ctxt; frame != start.parent; frame = frame.parent {
+			if above == nil || above.callSite != frame.callSite {
+				repeated = false
+				break
+			}
+			above = above.parent
+		}
+		if repeated {
+			return start
+		}
+	}
+
+	child, ok := ctxt.children[callSite]
+	if !ok {
+		child = newCallContext(ctxt, callSite)
+		ctxt.children[callSite] = child
+	}
+	return child
+}
+
+// stack lists position followed by the call sites leading to it, innermost
+// first.
+func (ctxt *callContext) stack(position int64) []int64 {
+	stack := []int64{position}
+	for ; ctxt.callSite >= 0; ctxt = ctxt.parent {
+		stack = append(stack, ctxt.callSite)
+	}
+	return stack
+}
+
+// walk calls visit with the stack and count of every instruction run.
+func (ctxt *callContext) walk(visit func(stack []int64, count int64)) {
+	positions := make([]int64, 0, len(ctxt.counts))
+	for position := range ctxt.counts {
+		positions = append(positions, position)
+	}
+	sort.Slice(positions, func(i, j int) bool { return positions[i] < positions[j] })
+	for _, position := range positions {
+		visit(ctxt.stack(position), ctxt.counts[position])
+	}
+
+	callSites := make([]int64, 0, len(ctxt.children))
+	for callSite := range ctxt.children {
+		callSites = append(callSites, callSite)
+	}
+	sort.Slice(callSites, func(i, j int) bool { return callSites[i] < callSites[j] })
+	for _, callSite := range callSites {
+		ctxt.children[callSite].walk(visit)
+	}
+}
+
+// profile holds how many times each instruction of a program ran.
+type profile struct {
+	program  gvm.Program
+	root     *callContext
+	total    int64
+	start    time.Time
+	duration time.Duration
+	// Context of the routine running at each depth of the call stack
+	contexts []*callContext
+	// Labels sorted by position, keeping the smallest name among labels
+	// sharing a position, and the same for labels that aren't sublabels
+	labels   []symbol
+	routines []symbol
+	// How many times each pair of instructions ran one right after the
+	// other, the second one following the first in the code
+	pairs map[instructionPair]int64
+}
+
+type instructionPair struct {
+	first, second gvm.Code
+}
+
+type symbol struct {
+	name     string
+	position int64
+}
+
+func newProfile(program gvm.Program) *profile {
+	p := &profile{
+		program:  program,
+		root:     newCallContext(nil, -1),
+		start:    time.Now(),
+		contexts: make([]*callContext, gvm.CallStackSize+1),
+		labels:   sortedSymbols(program.Debug, func(name string) bool { return true }),
+		routines: sortedSymbols(program.Debug, func(name string) bool {
+			return !strings.ContainsAny(name, ".@")
+		}),
+		pairs: make(map[instructionPair]int64),
+	}
+	p.contexts[0] = p.root
+	return p
+}
+
+func (p *profile) before(vm *virtualMachine, code []gvm.Code) {
+	p.contexts[vm.callStackPtr].counts[vm.codePosition]++
+	p.total++
+}
+
+func (p *profile) after(vm *virtualMachine, position int64, depth int64) {
+	if vm.callStackPtr > depth {
+		p.contexts[vm.callStackPtr] = p.contexts[depth].call(position)
+	}
+
+	code := p.program.Code
+	kinds, _ := lang.Operands(code[position])
+	if next := position + 1 + int64(len(kinds)); vm.codePosition == next && next < int64(len(code)) {
+		p.pairs[instructionPair{code[position], code[next]}]++
+	}
+}
+
+func sortedSymbols(debug *gvm.DebugInfo, keep func(name string) bool) []symbol {
+	if debug == nil {
+		return nil
+	}
+	byPosition := make(map[int64]string)
+	for name, position := range debug.Symbols {
+		if other, ok := byPosition[position]; keep(name) && (!ok || name < other) {
+			byPosition[position] = name
+		}
+	}
+	symbols := make([]symbol, 0, len(byPosition))
+	for position, name := range byPosition {
+		symbols = append(symbols, symbol{name, position})
+	}
+	sort.Slice(symbols, func(i, j int) bool { return symbols[i].position < symbols[j].position })
+	return symbols
+}
+
+// closest returns the closest symbol preceding position.
+func closest(symbols []symbol, position int64) (symbol, bool) {
+	idx := sort.Search(len(symbols), func(i int) bool { return symbols[i].position > position })
+	if idx == 0 {
+		return symbol{}, false
+	}
+	return symbols[idx-1], true
+}
+
+// Name given to code which isn't preceded by any label
+const unlabeled = "[unlabeled]"
+
+func (p *profile) labelOf(position int64) string {
+	if label, ok := closest(p.labels, position); ok {
+		return label.name
+	}
+	return unlabeled
+}
+
+func (p *profile) routineOf(position int64) symbol {
+	if routine, ok := closest(p.routines, position); ok {
+		return routine
+	}
+	return symbol{unlabeled, 0}
+}
+
+// protoBuffer encodes a protocol buffer message.
+type protoBuffer struct {
+	buf []byte
+}
+
+func (b *protoBuffer) uint(field int, value uint64) {
+	b.buf = appendUnsigned(b.buf, uint64(field)<<3)
+	b.buf = appendUnsigned(b.buf, value)
+}
+
+func (b *protoBuffer) int(field int, value int64) {
+	b.uint(field, uint64(value))
+}
+
+func (b *protoBuffer) bytes(field int, data []byte) {
+	b.buf = appendUnsigned(b.buf, uint64(field)<<3|2)
+	b.buf = appendUnsigned(b.buf, uint64(len(data)))
+	b.buf = append(b.buf, data...)
+}
+
+func (b *protoBuffer) message(field int, message *protoBuffer) {
+	b.bytes(field, message.buf)
+}
+
+func (b *protoBuffer) packed(field int, values []uint64) {
+	var packed []byte
+	for _, value := range values {
+		packed = appendUnsigned(packed, value)
+	}
+	b.bytes(field, packed)
+}
+
+// pprof encodes the profile in the format of pprof, uncompressed. Functions
+// are routines, i.e. labels that aren't sublabels, and locations are code
+// positions along with their source line.
+func (p *profile) pprof() []byte {
+	var msg protoBuffer
+	strings := map[string]int64{"": 0}
+	table := []string{""}
+	str := func(text string) int64 {
+		idx, ok := strings[text]
+		if !ok {
+			idx = int64(len(table))
+			strings[text] = idx
+			table = append(table, text)
+		}
+		return idx
+	}
+
+	valueType := func(kind, unit string) *protoBuffer {
+		var vt protoBuffer
+		vt.int(1, str(kind))
+		vt.int(2, str(unit))
+		return &vt
+	}
+	msg.message(1, valueType("instructions", "count"))
+
+	locations := make(map[int64]uint64)
+	var positions []int64
+	p.root.walk(func(stack []int64, count int64) {
+		ids := make([]uint64, len(stack))
+		for idx, position := range stack {
+			if _, ok := locations[position]; !ok {
+				locations[position] = uint64(len(locations) + 1)
+				positions = append(positions, position)
+			}
+			ids[idx] = locations[position]
+		}
+		var sample protoBuffer
+		sample.packed(1, ids)
+		sample.packed(2, []uint64{uint64(count)})
+		msg.message(2, &sample)
+	})
+
+	functions := make(map[string]uint64)
+	for _, position := range positions {
+		routine := p.routineOf(position)
+		if _, ok := functions[routine.name]; !ok {
+			functions[routine.name] = uint64(len(functions) + 1)
+
+			var function protoBuffer
+			function.uint(1, functions[routine.name])
+			function.int(2, str(routine.name))
+			function.int(3, str(routine.name))
+			if source, ok := p.program.Debug.SourceOf(routine.position); ok {
+				function.int(4, str(source.FileName))
+				function.int(5, int64(source.LineNum))
+			}
+			msg.message(5, &function)
+		}
+
+		var line protoBuffer
+		line.uint(1, functions[routine.name])
+		if source, ok := p.program.Debug.SourceOf(position); ok {
+			line.int(2, int64(source.LineNum))
+		}
+		var location protoBuffer
+		location.uint(1, locations[position])
+		location.uint(3, uint64(position))
+		location.message(4, &line)
+		msg.message(4, &location)
+	}
+
+	msg.message(11, valueType("instructions", "count"))
+	msg.int(12, 1)
+	msg.int(9, p.start.UnixNano())
+	msg.int(10, p.duration.Nanoseconds())
+
+	for _, text := range table {
+		msg.bytes(6, []byte(text))
+	}
+	return msg.buf
+}
+
+func (p *profile) write(dstPath string) {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	_, _ = writer.Write(p.pprof())
+	_ = writer.Close()
+
+	gvm.Logger.Infof("Writing profile '%s'.\n", dstPath)
+	if err := ioutil.WriteFile(dstPath, compressed.Bytes(), 0644); err != nil {
+		gvm.Logger.Criticalf("Failed writing '%s': %s\n", dstPath, err.Error())
+		os.Exit(1)
+	}
+}
+
+// sortedPairs lists the pairs of instructions that ran one after the other,
+// the most frequent first.
+func (p *profile) sortedPairs() []instructionPair {
+	pairs := make([]instructionPair, 0, len(p.pairs))
+	for pair := range p.pairs {
+		pairs = append(pairs, pair)
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if p.pairs[pairs[i]] != p.pairs[pairs[j]] {
+			return p.pairs[pairs[i]] > p.pairs[pairs[j]]
+		}
+		if pairs[i].first != pairs[j].first {
+			return pairs[i].first < pairs[j].first
+		}
+		return pairs[i].second < pairs[j].second
+	})
+	return pairs
+}
+
+// report writes the top labels by the instructions run within them, directly
+// or through the routines they call, the top instructions by how many times
+// they ran and the top pairs of instructions by how many times they ran one
+// right after the other.
+func (p *profile) report(w io.Writer, top int) {
+	flat := make(map[string]int64)
+	cum := make(map[string]int64)
+	byPosition := make(map[int64]int64)
+	p.root.walk(func(stack []int64, count int64) {
+		flat[p.labelOf(stack[0])] += count
+		byPosition[stack[0]] += count
+		// Recursive calls count once towards the labels they go through
+		seen := make(map[string]bool)
+		for _, position := range stack {
+			if label := p.labelOf(position); !seen[label] {
+				seen[label] = true
+				cum[label] += count
+			}
+		}
+	})
+
+	percent := func(count int64) float64 {
+		return 100 * float64(count) / float64(p.total)
+	}
+
+	labels := make([]string, 0, len(cum))
+	for label := range cum {
+		labels = append(labels, label)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		if flat[labels[i]] != flat[labels[j]] {
+			return flat[labels[i]] > flat[labels[j]]
+		}
+		if cum[labels[i]] != cum[labels[j]] {
+			return cum[labels[i]] > cum[labels[j]]
+		}
+		return labels[i] < labels[j]
+	})
+	if len(labels) > top {
+		labels = labels[:top]
+	}
+
+	fmt.Fprintf(w, "Ran %d instructions in %v.\n", p.total, p.duration)
+	fmt.Fprintf(w, "%12s %7s %12s %7s  %s\n", "flat", "flat%", "cum", "cum%", "label")
+	for _, label := range labels {
+		fmt.Fprintf(w, "%12d %6.2f%% %12d %6.2f%%  %s\n",
+			flat[label], percent(flat[label]), cum[label], percent(cum[label]), label)
+	}
+
+	positions := make([]int64, 0, len(byPosition))
+	for position := range byPosition {
+		positions = append(positions, position)
+	}
+	sort.Slice(positions, func(i, j int) bool {
+		if byPosition[positions[i]] != byPosition[positions[j]] {
+			return byPosition[positions[i]] > byPosition[positions[j]]
+		}
+		return positions[i] < positions[j]
+	})
+	if len(positions) > top {
+		positions = positions[:top]
+	}
+
+	fmt.Fprintf(w, "%12s %7s  %s\n", "count", "count%", "instruction")
+	for _, position := range positions {
+		var source *gvm.Context
+		if ctxt, ok := p.program.Debug.SourceOf(position); ok {
+			source = &ctxt
+		}
+		symbol, _ := p.program.Debug.SymbolOf(position)
+		text, _ := disassembleInstruction(virtualMachine{debug: p.program.Debug, codePosition: position},
+			p.program.Code)
+		fmt.Fprintf(w, "%12d %6.2f%%  %s: %s\n", byPosition[position], percent(byPosition[position]),
+			formatLocation(position, source, symbol), text)
+	}
+
+	pairs := p.sortedPairs()
+	if len(pairs) > top {
+		pairs = pairs[:top]
+	}
+
+	fmt.Fprintf(w, "%12s %7s  %s\n", "count", "count%", "pair")
+	for _, pair := range pairs {
+		fmt.Fprintf(w, "%12d %6.2f%%  %s %s\n", p.pairs[pair], percent(p.pairs[pair]),
+			lang.ToString(pair.first), lang.ToString(pair.second))
+	}
+}
@@ -0,0 +1,567 @@
+package vm
+
+import (
+	"fmt"
+	"github.com/vsartor/gvm/gvm"
+	"github.com/vsartor/gvm/gvm/lang"
+	"strconv"
+)
+
+// op is an instruction decoded ahead of execution, with its register operands
+// resolved to the registers themselves and its code position operand to the
+// index of the op found there.
+type op struct {
+	instruction gvm.Code
+	src, dst    *int64
+	// Constant operand, or the register index receiving the fault code of a
+	// `try`
+	value  int64
+	target int
+	// Position of the instruction in the code
+	position int64
+}
+
+// Superinstructions run a pair of ops in a single step. They only replace the
+// first op of the pair in the stream, so the second one is still there for the
+// superinstruction to read its operands from. The pairs are the ones `gvm run
+// --top` reports as running one after the other most often in the fibonacci,
+// primes, collatz and ackermann examples, as checked by TestFusionsAreFrequent,
+// leaving out those starting with a conditional jump as it's already fused
+// with the `cmp` before it.
+const (
+	fusedCmpJeq gvm.Code = -(iota + 1)
+	fusedCmpJne
+	fusedCmpJgt
+	fusedCmpJlt
+	fusedCmpJge
+	fusedCmpJle
+	fusedCmpJb
+	fusedCmpJa
+	fusedCmpJbe
+	fusedCmpJae
+	fusedConstCmp
+	fusedPopPop
+	fusedDecPush
+	fusedPushCall
+	fusedIncJmp
+	fusedMovRem
+	fusedPushRet
+)
+
+type fusion struct {
+	first, second gvm.Code
+	fused         gvm.Code
+}
+
+// Pairs are fused in this order, so when a sequence of three instructions could
+// form two of them only the first one listed is used.
+var fusions = []fusion{
+	{lang.Cmp, lang.Jeq, fusedCmpJeq},
+	{lang.Cmp, lang.Jne, fusedCmpJne},
+	{lang.Cmp, lang.Jgt, fusedCmpJgt},
+	{lang.Cmp, lang.Jlt, fusedCmpJlt},
+	{lang.Cmp, lang.Jge, fusedCmpJge},
+	{lang.Cmp, lang.Jle, fusedCmpJle},
+	{lang.Cmp, lang.Jb, fusedCmpJb},
+	{lang.Cmp, lang.Ja, fusedCmpJa},
+	{lang.Cmp, lang.Jbe, fusedCmpJbe},
+	{lang.Cmp, lang.Jae, fusedCmpJae},
+	{lang.Const, lang.Cmp, fusedConstCmp},
+	{lang.Pop, lang.Pop, fusedPopPop},
+	{lang.Dec, lang.Push, fusedDecPush},
+	{lang.Push, lang.Call, fusedPushCall},
+	{lang.Inc, lang.Jmp, fusedIncJmp},
+	{lang.Mov, lang.Rem, fusedMovRem},
+	{lang.Push, lang.Ret, fusedPushRet},
+}
+
+// stream is the code of a program decoded into ops, ending with a `halt` at
+// the position right after the code so running past the end stops execution.
+type stream struct {
+	ops []op
+	// Index of the op decoded from each position of the code, or -1
+	indexOf []int
+}
+
+// decodeStream decodes the instructions of verified code, as found by verify,
+// against the registers of vm.
+func decodeStream(vm *virtualMachine, code []gvm.Code, owners []int64) *stream {
+	s := &stream{indexOf: make([]int, len(code)+1)}
+	for position := range s.indexOf {
+		s.indexOf[position] = -1
+	}
+
+	for position := int64(0); position < int64(len(code)); position++ {
+		if owners[position] == position {
+			s.indexOf[position] = len(s.ops)
+			s.ops = append(s.ops, op{instruction: code[position], position: position})
+		}
+	}
+	s.indexOf[len(code)] = len(s.ops)
+	s.ops = append(s.ops, op{instruction: lang.Halt, position: int64(len(code))})
+
+	for idx := range s.ops[:len(s.ops)-1] {
+		o := &s.ops[idx]
+		ins, _ := decodeAt(code, o.position)
+
+		switch o.instruction {
+		case lang.Const:
+			o.value = int64(ins.operands[0])
+			o.dst = &vm.reg[ins.operands[1]]
+		case lang.Mov, lang.Add, lang.Sub, lang.Mul, lang.Div, lang.Rem, lang.Cmp,
+			lang.Cmoveq, lang.Cmovne, lang.Cmovgt, lang.Cmovlt, lang.Cmovge, lang.Cmovle,
+			lang.Cmovb, lang.Cmova, lang.Cmovbe, lang.Cmovae:
+			o.src = &vm.reg[ins.operands[0]]
+			o.dst = &vm.reg[ins.operands[1]]
+		case lang.Push, lang.Show, lang.Iarg, lang.Assert, lang.Throw:
+			o.src = &vm.reg[ins.operands[0]]
+		case lang.Pop, lang.Inc, lang.Dec,
+			lang.Seteq, lang.Setne, lang.Setgt, lang.Setlt, lang.Setge, lang.Setle,
+			lang.Setb, lang.Seta, lang.Setbe, lang.Setae:
+			o.dst = &vm.reg[ins.operands[0]]
+		case lang.Trap:
+			o.value = int64(ins.operands[0])
+		case lang.Try:
+			o.value = int64(ins.operands[1])
+		}
+
+		if target, ok := ins.target(); ok {
+			o.target = s.indexOf[target]
+		}
+	}
+
+	s.fuse()
+	return s
+}
+
+// fuse replaces pairs of ops by superinstructions, as long as nothing but the
+// first op of the pair leads to the second one.
+func (s *stream) fuse() {
+	entries := make([]bool, len(s.ops))
+	for _, o := range s.ops {
+		switch o.instruction {
+		case lang.Jmp, lang.Jeq, lang.Jne, lang.Jgt, lang.Jlt, lang.Jge, lang.Jle, lang.Jerr,
+			lang.Jb, lang.Ja, lang.Jbe, lang.Jae, lang.Call, lang.Try:
+			entries[o.target] = true
+		}
+	}
+
+	inPair := make([]bool, len(s.ops))
+	for _, f := range fusions {
+		// The last op is the `halt` after the code
+		for idx := 0; idx+2 < len(s.ops); idx++ {
+			first, second := &s.ops[idx], &s.ops[idx+1]
+			if first.instruction != f.first || second.instruction != f.second ||
+				inPair[idx] || inPair[idx+1] || entries[idx+1] {
+				continue
+			}
+			first.instruction = f.fused
+			inPair[idx], inPair[idx+1] = true, true
+		}
+	}
+}
+
+// raise raises a fault at the op at idx, returning the index of the op to go
+// on with if it was handled.
+func (s *stream) raise(vm *virtualMachine, idx int, code int64) (int, bool) {
+	vm.codePosition = s.ops[idx].position
+	vm.raise(code)
+	return s.resume(vm)
+}
+
+// throw is raise for the faults raised by the program with `trap` and `throw`.
+func (s *stream) throw(vm *virtualMachine, idx int, code int64) (int, bool) {
+	vm.codePosition = s.ops[idx].position
+	vm.throw(code)
+	return s.resume(vm)
+}
+
+// resume returns the index of the op a raised fault was handled at, if it was.
+func (s *stream) resume(vm *virtualMachine) (int, bool) {
+	if vm.fault != nil {
+		return 0, false
+	}
+	return s.indexOf[vm.codePosition], true
+}
+
+// run executes ops until the program halts or is stopped by a fault. It does
+// the same as calling executeStep on the code over and over, without decoding
+// each instruction again every time it runs, and running superinstructions as
+// the pair of instructions they replace.
+func (s *stream) run(vm *virtualMachine) {
+	ops := s.ops
+	idx := s.indexOf[vm.codePosition]
+	handled := true
+
+	for handled {
+		o := &ops[idx]
+
+		switch o.instruction {
+		case lang.Halt:
+			vm.codePosition = ops[len(ops)-1].position
+			return
+		case lang.Const:
+			*o.dst = o.value
+			idx++
+		case lang.Push:
+			if vm.stackPtr == int64(len(vm.stack)) {
+				idx, handled = s.raise(vm, idx, FaultStackOverflow)
+				continue
+			}
+			vm.stack[vm.stackPtr] = *o.src
+			vm.stackPtr++
+			idx++
+		case lang.Pop:
+			if vm.stackPtr == 0 {
+				idx, handled = s.raise(vm, idx, FaultStackUnderflow)
+				continue
+			}
+			vm.stackPtr--
+			*o.dst = vm.stack[vm.stackPtr]
+			idx++
+		case lang.Inc:
+			*o.dst++
+			idx++
+		case lang.Dec:
+			*o.dst--
+			idx++
+		case lang.Mov:
+			*o.dst = *o.src
+			idx++
+		case lang.Add:
+			*o.dst += *o.src
+			idx++
+		case lang.Sub:
+			*o.dst -= *o.src
+			idx++
+		case lang.Mul:
+			*o.dst *= *o.src
+			idx++
+		case lang.Div:
+			if *o.src == 0 {
+				idx, handled = s.raise(vm, idx, FaultDivisionByZero)
+				continue
+			}
+			*o.dst /= *o.src
+			idx++
+		case lang.Rem:
+			if *o.src == 0 {
+				idx, handled = s.raise(vm, idx, FaultDivisionByZero)
+				continue
+			}
+			*o.dst %= *o.src
+			idx++
+		case lang.Cmp:
+			vm.cmpFlag = compareFlags(*o.dst, *o.src)
+			idx++
+		case lang.Cmoveq, lang.Cmovne, lang.Cmovgt, lang.Cmovlt, lang.Cmovge, lang.Cmovle,
+			lang.Cmovb, lang.Cmova, lang.Cmovbe, lang.Cmovae:
+			if vm.conditionHolds(o.instruction) {
+				*o.dst = *o.src
+			}
+			idx++
+		case lang.Seteq, lang.Setne, lang.Setgt, lang.Setlt, lang.Setge, lang.Setle,
+			lang.Setb, lang.Seta, lang.Setbe, lang.Setae:
+			if vm.conditionHolds(o.instruction) {
+				*o.dst = 1
+			} else {
+				*o.dst = 0
+			}
+			idx++
+		case lang.Jmp:
+			idx = o.target
+		case lang.Jeq:
+			if vm.isEqual() {
+				idx = o.target
+			} else {
+				idx++
+			}
+		case lang.Jne:
+			if !vm.isEqual() {
+				idx = o.target
+			} else {
+				idx++
+			}
+		case lang.Jgt:
+			if !vm.isEqual() && !vm.isLess() {
+				idx = o.target
+			} else {
+				idx++
+			}
+		case lang.Jlt:
+			if vm.isLess() {
+				idx = o.target
+			} else {
+				idx++
+			}
+		case lang.Jge:
+			if !vm.isLess() {
+				idx = o.target
+			} else {
+				idx++
+			}
+		case lang.Jle:
+			if vm.isEqual() || vm.isLess() {
+				idx = o.target
+			} else {
+				idx++
+			}
+		case lang.Jb:
+			if vm.isBelow() {
+				idx = o.target
+			} else {
+				idx++
+			}
+		case lang.Ja:
+			if !vm.isEqual() && !vm.isBelow() {
+				idx = o.target
+			} else {
+				idx++
+			}
+		case lang.Jbe:
+			if vm.isEqual() || vm.isBelow() {
+				idx = o.target
+			} else {
+				idx++
+			}
+		case lang.Jae:
+			if !vm.isBelow() {
+				idx = o.target
+			} else {
+				idx++
+			}
+		case lang.Jerr:
+			if vm.errFlag != 0 {
+				vm.errFlag = 0
+				idx = o.target
+			} else {
+				idx++
+			}
+		case lang.Show:
+			fmt.Printf("%d\n", *o.src)
+			idx++
+		case lang.Call:
+			if vm.callStackPtr == int64(len(vm.callStack)) {
+				idx, handled = s.raise(vm, idx, FaultCallStackOverflow)
+				continue
+			}
+			vm.callStack[vm.callStackPtr] = ops[idx+1].position
+			vm.callStackPtr++
+			idx = o.target
+		case lang.Ret:
+			if vm.callStackPtr == 0 {
+				idx, handled = s.raise(vm, idx, FaultCallStackUnderflow)
+				continue
+			}
+			vm.callStackPtr--
+			idx = s.indexOf[vm.callStack[vm.callStackPtr]]
+			// Handlers installed by the returning routine go out of scope
+			for vm.handlerPtr > 0 && vm.handlers[vm.handlerPtr-1].callStackPtr > vm.callStackPtr {
+				vm.handlerPtr--
+			}
+		case lang.Noop:
+			idx++
+		case lang.Iarg:
+			argIdx := *o.src
+			if argIdx < 0 || argIdx >= int64(len(vm.args)) {
+				vm.errFlag = 1
+			} else {
+				value, err := strconv.ParseInt(vm.args[argIdx], 10, 64)
+				if err != nil {
+					vm.errFlag = 1
+				} else if vm.stackPtr == int64(len(vm.stack)) {
+					idx, handled = s.raise(vm, idx, FaultStackOverflow)
+					continue
+				} else {
+					vm.stack[vm.stackPtr] = value
+					vm.stackPtr++
+				}
+			}
+			idx++
+		case lang.Assert:
+			if *o.src == 0 {
+				idx, handled = s.raise(vm, idx, FaultAssertion)
+				continue
+			}
+			idx++
+		case lang.Trap:
+			idx, handled = s.throw(vm, idx, o.value)
+		case lang.Try:
+			if vm.handlerPtr == int64(len(vm.handlers)) {
+				idx, handled = s.raise(vm, idx, FaultHandlerStackOverflow)
+				continue
+			}
+			vm.handlers[vm.handlerPtr] = handler{
+				position:     ops[o.target].position,
+				codeRegIdx:   gvm.Code(o.value),
+				callStackPtr: vm.callStackPtr,
+				stackPtr:     vm.stackPtr,
+			}
+			vm.handlerPtr++
+			idx++
+		case lang.Endtry:
+			if vm.handlerPtr == 0 || vm.handlers[vm.handlerPtr-1].callStackPtr != vm.callStackPtr {
+				idx, handled = s.raise(vm, idx, FaultUnmatchedEndtry)
+				continue
+			}
+			vm.handlerPtr--
+			idx++
+		case lang.Throw:
+			idx, handled = s.throw(vm, idx, *o.src)
+		case fusedCmpJeq:
+			lhs, rhs := *o.dst, *o.src
+			vm.cmpFlag = compareFlags(lhs, rhs)
+			if lhs == rhs {
+				idx = ops[idx+1].target
+			} else {
+				idx += 2
+			}
+		case fusedCmpJne:
+			lhs, rhs := *o.dst, *o.src
+			vm.cmpFlag = compareFlags(lhs, rhs)
+			if lhs != rhs {
+				idx = ops[idx+1].target
+			} else {
+				idx += 2
+			}
+		case fusedCmpJgt:
+			lhs, rhs := *o.dst, *o.src
+			vm.cmpFlag = compareFlags(lhs, rhs)
+			if lhs > rhs {
+				idx = ops[idx+1].target
+			} else {
+				idx += 2
+			}
+		case fusedCmpJlt:
+			lhs, rhs := *o.dst, *o.src
+			vm.cmpFlag = compareFlags(lhs, rhs)
+			if lhs < rhs {
+				idx = ops[idx+1].target
+			} else {
+				idx += 2
+			}
+		case fusedCmpJge:
+			lhs, rhs := *o.dst, *o.src
+			vm.cmpFlag = compareFlags(lhs, rhs)
+			if lhs >= rhs {
+				idx = ops[idx+1].target
+			} else {
+				idx += 2
+			}
+		case fusedCmpJle:
+			lhs, rhs := *o.dst, *o.src
+			vm.cmpFlag = compareFlags(lhs, rhs)
+			if lhs <= rhs {
+				idx = ops[idx+1].target
+			} else {
+				idx += 2
+			}
+		case fusedCmpJb:
+			lhs, rhs := *o.dst, *o.src
+			vm.cmpFlag = compareFlags(lhs, rhs)
+			if uint64(lhs) < uint64(rhs) {
+				idx = ops[idx+1].target
+			} else {
+				idx += 2
+			}
+		case fusedCmpJa:
+			lhs, rhs := *o.dst, *o.src
+			vm.cmpFlag = compareFlags(lhs, rhs)
+			if uint64(lhs) > uint64(rhs) {
+				idx = ops[idx+1].target
+			} else {
+				idx += 2
+			}
+		case fusedCmpJbe:
+			lhs, rhs := *o.dst, *o.src
+			vm.cmpFlag = compareFlags(lhs, rhs)
+			if uint64(lhs) <= uint64(rhs) {
+				idx = ops[idx+1].target
+			} else {
+				idx += 2
+			}
+		case fusedCmpJae:
+			lhs, rhs := *o.dst, *o.src
+			vm.cmpFlag = compareFlags(lhs, rhs)
+			if uint64(lhs) >= uint64(rhs) {
+				idx = ops[idx+1].target
+			} else {
+				idx += 2
+			}
+		case fusedConstCmp:
+			*o.dst = o.value
+			o2 := &ops[idx+1]
+			vm.cmpFlag = compareFlags(*o2.dst, *o2.src)
+			idx += 2
+		case fusedPopPop:
+			if vm.stackPtr < 2 {
+				// Fault on whichever pop finds the stack empty
+				if vm.stackPtr == 0 {
+					idx, handled = s.raise(vm, idx, FaultStackUnderflow)
+					continue
+				}
+				vm.stackPtr--
+				*o.dst = vm.stack[vm.stackPtr]
+				idx, handled = s.raise(vm, idx+1, FaultStackUnderflow)
+				continue
+			}
+			*o.dst = vm.stack[vm.stackPtr-1]
+			*ops[idx+1].dst = vm.stack[vm.stackPtr-2]
+			vm.stackPtr -= 2
+			idx += 2
+		case fusedDecPush:
+			*o.dst--
+			if vm.stackPtr == int64(len(vm.stack)) {
+				idx, handled = s.raise(vm, idx+1, FaultStackOverflow)
+				continue
+			}
+			vm.stack[vm.stackPtr] = *ops[idx+1].src
+			vm.stackPtr++
+			idx += 2
+		case fusedPushCall:
+			if vm.stackPtr == int64(len(vm.stack)) {
+				idx, handled = s.raise(vm, idx, FaultStackOverflow)
+				continue
+			}
+			vm.stack[vm.stackPtr] = *o.src
+			vm.stackPtr++
+			if vm.callStackPtr == int64(len(vm.callStack)) {
+				idx, handled = s.raise(vm, idx+1, FaultCallStackOverflow)
+				continue
+			}
+			vm.callStack[vm.callStackPtr] = ops[idx+2].position
+			vm.callStackPtr++
+			idx = ops[idx+1].target
+		case fusedIncJmp:
+			*o.dst++
+			idx = ops[idx+1].target
+		case fusedMovRem:
+			*o.dst = *o.src
+			o2 := &ops[idx+1]
+			if *o2.src == 0 {
+				idx, handled = s.raise(vm, idx+1, FaultDivisionByZero)
+				continue
+			}
+			*o2.dst %= *o2.src
+			idx += 2
+		case fusedPushRet:
+			if vm.stackPtr == int64(len(vm.stack)) {
+				idx, handled = s.raise(vm, idx, FaultStackOverflow)
+				continue
+			}
+			vm.stack[vm.stackPtr] = *o.src
+			vm.stackPtr++
+			if vm.callStackPtr == 0 {
+				idx, handled = s.raise(vm, idx+1, FaultCallStackUnderflow)
+				continue
+			}
+			vm.callStackPtr--
+			idx = s.indexOf[vm.callStack[vm.callStackPtr]]
+			for vm.handlerPtr > 0 && vm.handlers[vm.handlerPtr-1].callStackPtr > vm.callStackPtr {
+				vm.handlerPtr--
+			}
+		default:
+			panic("This path should be impossible.")
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package vm
+
+import (
+	"fmt"
+	"github.com/vsartor/gvm/gvm"
+	"github.com/vsartor/gvm/gvm/compiler"
+	"github.com/vsartor/gvm/gvm/lang"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// reset puts vm back in the state it starts running a program in, keeping the
+// registers themselves since a stream may have been decoded against them.
+func reset(vm *virtualMachine) {
+	for idx := range vm.reg {
+		vm.reg[idx] = 0
+	}
+	vm.stackPtr, vm.callStackPtr, vm.handlerPtr = 0, 0, 0
+	vm.codePosition, vm.cmpFlag, vm.errFlag = 0, 0, 0
+	vm.fault = nil
+}
+
+// BenchmarkRun compares running the decoded stream of instructions with
+// stepping through the code one instruction at a time. The program is verified
+// and decoded once, ahead of timing, so only the loops running it are compared.
+func BenchmarkRun(b *testing.B) {
+	program := compiler.Build([]string{"../../examples/fibonacci.gsm"}, compiler.Options{})
+	args := []string{"25"}
+	owners, err := verify(program)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	// The result of each run would otherwise flood the benchmark's output
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer devNull.Close()
+	stdout := os.Stdout
+	os.Stdout = devNull
+	defer func() { os.Stdout = stdout }()
+
+	b.Run("run", func(b *testing.B) {
+		vm := newVirtualMachine(program, args)
+		s := decodeStream(vm, program.Code, owners)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			reset(vm)
+			s.run(vm)
+			if vm.fault != nil {
+				b.Fatal(vm.fault)
+			}
+		}
+	})
+
+	b.Run("executeStep", func(b *testing.B) {
+		vm := newVirtualMachine(program, args)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			reset(vm)
+			for vm.isRunning(program.Code) {
+				executeStep(vm, program.Code)
+			}
+			if vm.fault != nil {
+				b.Fatal(vm.fault)
+			}
+		}
+	})
+}
+
+// profiledPrograms are the examples the pairs of instructions to fuse were
+// chosen from, along with the arguments they're run with.
+var profiledPrograms = []struct {
+	path string
+	args []string
+}{
+	{"../../examples/fibonacci.gsm", []string{"20"}},
+	{"../../examples/primes.gsm", []string{"5000"}},
+	{"../../examples/collatz.gsm", []string{"3000"}},
+	{"../../examples/ackermann.gsm", []string{"3", "3"}},
+}
+
+// TestFusionsAreFrequent checks that the fused pairs are the ones the profiler
+// finds running one after the other most often in the examples, counting `cmp`
+// followed by any conditional jump as a single pair since they are all fused
+// the same way. Run it with -v to see the share of each frequent pair.
+func TestFusionsAreFrequent(t *testing.T) {
+	isConditionalJump := func(ins gvm.Code) bool {
+		return lang.IsJump(ins) && ins != lang.Jmp && ins != lang.Jerr
+	}
+	normalize := func(pair instructionPair) instructionPair {
+		if pair.first == lang.Cmp && isConditionalJump(pair.second) {
+			pair.second = lang.Jeq
+		}
+		return pair
+	}
+
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devNull.Close()
+	stdout := os.Stdout
+	os.Stdout = devNull
+	defer func() { os.Stdout = stdout }()
+
+	// Share of the instructions run by each program that start each pair
+	shares := make(map[instructionPair][]float64)
+	for _, p := range profiledPrograms {
+		program := compiler.Build([]string{p.path}, compiler.Options{})
+		if err := Verify(program); err != nil {
+			t.Fatal(err)
+		}
+		prof := newProfile(program)
+		if err := runObserved(program, p.args, []observer{prof}); err != nil {
+			t.Fatal(err)
+		}
+
+		counts := make(map[instructionPair]int64)
+		for pair, count := range prof.pairs {
+			counts[normalize(pair)] += count
+		}
+		for pair, count := range counts {
+			shares[pair] = append(shares[pair], float64(count)/float64(prof.total))
+		}
+	}
+
+	// A pair is frequent if it accounts for a few percent of the instructions
+	// run by at least two of the programs. Pairs starting with a conditional
+	// jump are left out, as it's already fused with the `cmp` before it.
+	const minShare, minPrograms = 0.03, 2
+	frequent := make(map[instructionPair]bool)
+	for pair, programShares := range shares {
+		programs := 0
+		for _, share := range programShares {
+			if share >= minShare {
+				programs++
+			}
+		}
+		if programs >= minPrograms && !isConditionalJump(pair.first) {
+			frequent[pair] = true
+			t.Logf("%s %s: %.2f", lang.ToString(pair.first), lang.ToString(pair.second), programShares)
+		}
+	}
+
+	fused := make(map[instructionPair]bool)
+	for _, f := range fusions {
+		pair := normalize(instructionPair{f.first, f.second})
+		fused[pair] = true
+		if !frequent[pair] {
+			t.Errorf("%s followed by %s is fused but isn't frequent",
+				lang.ToString(pair.first), lang.ToString(pair.second))
+		}
+	}
+	for pair := range frequent {
+		if !fused[pair] {
+			t.Errorf("%s followed by %s is frequent but isn't fused",
+				lang.ToString(pair.first), lang.ToString(pair.second))
+		}
+	}
+}
+
+// runBothWays runs a program by stepping through its code and as a decoded
+// stream, failing the test if the GVM isn't left in the same state by both.
+// It returns the GVM the stream ran in, along with the stream so the test can
+// check which pairs were fused.
+func runBothWays(t *testing.T, program gvm.Program) (*virtualMachine, *stream) {
+	owners, err := verify(program)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stepped := newVirtualMachine(program, nil)
+	for stepped.isRunning(program.Code) {
+		executeStep(stepped, program.Code)
+	}
+
+	streamed := newVirtualMachine(program, nil)
+	s := decodeStream(streamed, program.Code, owners)
+	s.run(streamed)
+
+	states := []struct {
+		name              string
+		stepped, streamed interface{}
+	}{
+		{"registers", stepped.reg, streamed.reg},
+		{"flags", stepped.cmpFlag, streamed.cmpFlag},
+		{"error flag", stepped.errFlag, streamed.errFlag},
+		{"stack", stepped.stack[:stepped.stackPtr], streamed.stack[:streamed.stackPtr]},
+		{"call stack", stepped.callStack[:stepped.callStackPtr], streamed.callStack[:streamed.callStackPtr]},
+		{"handlers", stepped.handlers[:stepped.handlerPtr], streamed.handlers[:streamed.handlerPtr]},
+		{"code position", stepped.codePosition, streamed.codePosition},
+		{"fault", stepped.fault, streamed.fault},
+	}
+	for _, state := range states {
+		if !reflect.DeepEqual(state.stepped, state.streamed) {
+			t.Errorf("%s is %v when stepping but %v when streaming", state.name, state.stepped, state.streamed)
+		}
+	}
+	return streamed, s
+}
+
+type fusedPairCase struct {
+	name   string
+	source string
+	// Superinstruction the stream should hold, or not if unfused is set
+	fused   gvm.Code
+	unfused bool
+}
+
+func TestFusedPairs(t *testing.T) {
+	cases := []fusedPairCase{
+		{"const cmp", "const 3 r1\nconst 5 r2\ncmp r1 r2\nsetlt r3\n", fusedConstCmp, false},
+		{"pop pop", "const 1 r1\nconst 2 r2\npush r1\npush r2\npop r3\npop r4\n", fusedPopPop, false},
+		{"pop pop underflow on first", "pop r3\npop r4\n", fusedPopPop, false},
+		{"pop pop underflow on second", "const 1 r1\npush r1\npop r3\npop r4\n", fusedPopPop, false},
+		{"pop pop underflow handled", "main:\ntry .caught r5\nconst 1 r1\npush r1\npop r3\npop r4\nendtry\n" +
+			".caught:\nmov r5 r6\n", fusedPopPop, false},
+		{"dec push", "const 5 r1\ndec r1\npush r1\n", fusedDecPush, false},
+		{"dec push overflow", "main:\n.fill:\ndec r1\npush r1\njmp .fill\n", fusedDecPush, false},
+		{"push call", "main:\nconst 3 r1\npush r1\ncall f\nhalt\nf:\npop r2\nret\n", fusedPushCall, false},
+		{"push call stack overflow", "main:\nconst 1024 r3\n.fill:\npush r1\ninc r2\ncmp r3 r2\njlt .fill\n" +
+			"push r1\ncall f\nhalt\nf:\nret\n", fusedPushCall, false},
+		{"push call call stack overflow", "f:\npush r1\ncall f\n", fusedPushCall, false},
+		{"inc jmp", "main:\nconst 5 r2\n.loop:\ncmp r2 r1\njeq .end\ninc r1\njmp .loop\n.end:\n", fusedIncJmp, false},
+		{"mov rem", "const 17 r1\nconst 5 r2\nmov r1 r3\nrem r2 r3\n", fusedMovRem, false},
+		{"mov rem division by zero", "const 17 r1\nmov r1 r3\nrem r2 r3\n", fusedMovRem, false},
+		{"push ret", "main:\ncall f\nhalt\nf:\nconst 4 r1\npush r1\nret\n", fusedPushRet, false},
+		{"push ret underflow", "const 4 r1\npush r1\nret\n", fusedPushRet, false},
+		{"push ret handlers", "main:\ncall f\nconst 0 r2\ndiv r2 r3\nf:\ntry .caught r5\npush r1\nret\n" +
+			".caught:\nhalt\n", fusedPushRet, false},
+		{"jump to second of dec push", "main:\nconst 3 r1\njmp .push\n.loop:\ndec r1\n.push:\npush r1\n" +
+			"cmp r2 r1\njne .loop\n", fusedDecPush, true},
+		{"jump to second of cmp jlt", "main:\nconst 2 r1\ncmp r1 r2\njmp .jump\n.compare:\ncmp r2 r1\n" +
+			".jump:\njlt .less\nhalt\n.less:\ninc r2\njmp .compare\n", fusedCmpJlt, true},
+	}
+
+	// Every conditional jump fused with a `cmp`, taken or not as either
+	// operand is less, greater or equal, signed and unsigned
+	operands := [][2]int64{{1, 1}, {1, 2}, {2, 1}, {-1, 1}, {1, -1}}
+	for _, f := range fusions {
+		if f.first != lang.Cmp {
+			continue
+		}
+		for _, values := range operands {
+			jump := lang.ToString(f.second)
+			cases = append(cases, fusedPairCase{
+				fmt.Sprintf("cmp %s %d %d", jump, values[0], values[1]),
+				fmt.Sprintf("main:\nconst %d r1\nconst %d r2\ncmp r1 r2\n%s .taken\nconst 1 r3\nhalt\n"+
+					".taken:\nconst 2 r3\n", values[0], values[1], jump),
+				f.fused, false,
+			})
+		}
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			_, s := runBothWays(t, compileSource(t, c.source))
+
+			found := false
+			for _, o := range s.ops {
+				found = found || o.instruction == c.fused
+			}
+			if found == c.unfused {
+				t.Errorf("expected the stream to hold superinstruction %d: %v", c.fused, !c.unfused)
+			}
+		})
+	}
+}
@@ -0,0 +1,360 @@
+(module
+  (import "gvm" "show" (func $show (param $value i64)))
+  (import "gvm" "iarg" (func $iarg (param $index i64) (result i64 i32)))
+  (import "gvm" "fault" (func $fault (param $code i64) (param $description i32) (param $descriptionLength i32) (param $location i32) (param $locationLength i32)))
+  (memory (export "memory") 1)
+  (data (i32.const 10752) "0041 (../../examples/arithmetic.gsm.26)")
+  (data (i32.const 10791) "0052 (../../examples/arithmetic.gsm.32)")
+  (data (i32.const 10830) "unknown instruction")
+  (data (i32.const 10849) "stack underflow")
+  (data (i32.const 10864) "call stack overflow")
+  (data (i32.const 10883) "call stack underflow")
+  (data (i32.const 10903) "assertion failed")
+  (data (i32.const 10919) "stack overflow")
+  (data (i32.const 10933) "division by zero")
+  (data (i32.const 10949) "handler stack overflow")
+  (data (i32.const 10971) "endtry without a matching try")
+
+  (func $compareFlags (param $lhs i64) (param $rhs i64) (result i32)
+    (local $diff i64)
+    local.get $lhs
+    local.get $rhs
+    i64.sub
+    local.set $diff
+    ;; Zero flag
+    local.get $diff
+    i64.eqz
+    ;; Sign flag
+    local.get $diff
+    i64.const 0
+    i64.lt_s
+    i32.const 1
+    i32.shl
+    i32.or
+    ;; Carry flag
+    local.get $lhs
+    local.get $rhs
+    i64.lt_u
+    i32.const 2
+    i32.shl
+    i32.or
+    ;; Overflow flag
+    local.get $lhs
+    local.get $rhs
+    i64.xor
+    local.get $lhs
+    local.get $diff
+    i64.xor
+    i64.and
+    i64.const 0
+    i64.lt_s
+    i32.const 3
+    i32.shl
+    i32.or
+  )
+
+  (func $isEqual (param $flags i32) (result i32)
+    local.get $flags
+    i32.const 0
+    i32.shr_u
+    i32.const 1
+    i32.and
+  )
+
+  (func $isLess (param $flags i32) (result i32)
+    local.get $flags
+    i32.const 1
+    i32.shr_u
+    i32.const 1
+    i32.and
+    local.get $flags
+    i32.const 3
+    i32.shr_u
+    i32.const 1
+    i32.and
+    i32.ne
+  )
+
+  (func $isBelow (param $flags i32) (result i32)
+    local.get $flags
+    i32.const 2
+    i32.shr_u
+    i32.const 1
+    i32.and
+  )
+
+  (func $run (export "run") (result i32)
+    (local $r0 i64)
+    (local $r1 i64)
+    (local $r2 i64)
+    (local $r3 i64)
+    (local $r4 i64)
+    (local $r5 i64)
+    (local $r6 i64)
+    (local $r7 i64)
+    (local $r8 i64)
+    (local $r9 i64)
+    (local $r10 i64)
+    (local $r11 i64)
+    (local $r12 i64)
+    (local $r13 i64)
+    (local $r14 i64)
+    (local $r15 i64)
+    (local $pc i32)
+    (local $sp i32)
+    (local $csp i32)
+    (local $hp i32)
+    (local $handler i32)
+    (local $cmpFlag i32)
+    (local $errFlag i32)
+    (local $value i64)
+    (local $ok i32)
+    (local $fault i64)
+    (local $faultAt i32)
+    (local $faultLength i32)
+    (local $thrown i32)
+    (local $description i32)
+    (local $descriptionLength i32)
+    loop $dispatch
+      block $raise
+      block $p0000
+      local.get $pc
+      br_table $p0000 $raise
+      end $p0000
+      ;; 0000: noop
+      ;; 0001: noop
+      ;; 0002 (../../examples/arithmetic.gsm.6): const -14 r1
+      i64.const -14
+      local.set $r1
+      ;; 0005 (../../examples/arithmetic.gsm.7): const 64 r2
+      i64.const 64
+      local.set $r2
+      ;; 0008 (../../examples/arithmetic.gsm.8): add r1 r2
+      local.get $r2
+      local.get $r1
+      i64.add
+      local.set $r2
+      ;; 0011 (../../examples/arithmetic.gsm.9): show r2
+      local.get $r2
+      call $show
+      ;; 0013 (../../examples/arithmetic.gsm.12): const 14 r1
+      i64.const 14
+      local.set $r1
+      ;; 0016 (../../examples/arithmetic.gsm.13): const 64 r2
+      i64.const 64
+      local.set $r2
+      ;; 0019 (../../examples/arithmetic.gsm.14): sub r1 r2
+      local.get $r2
+      local.get $r1
+      i64.sub
+      local.set $r2
+      ;; 0022 (../../examples/arithmetic.gsm.15): show r2
+      local.get $r2
+      call $show
+      ;; 0024 (../../examples/arithmetic.gsm.18): const -10 r1
+      i64.const -10
+      local.set $r1
+      ;; 0027 (../../examples/arithmetic.gsm.19): const -5 r2
+      i64.const -5
+      local.set $r2
+      ;; 0030 (../../examples/arithmetic.gsm.20): mul r1 r2
+      local.get $r2
+      local.get $r1
+      i64.mul
+      local.set $r2
+      ;; 0033 (../../examples/arithmetic.gsm.21): show r2
+      local.get $r2
+      call $show
+      ;; 0035 (../../examples/arithmetic.gsm.24): const 5 r1
+      i64.const 5
+      local.set $r1
+      ;; 0038 (../../examples/arithmetic.gsm.25): const 250 r2
+      i64.const 250
+      local.set $r2
+      ;; 0041 (../../examples/arithmetic.gsm.26): div r1 r2
+      local.get $r1
+      i64.eqz
+      if
+        i64.const -7
+        local.set $fault
+        i32.const 10752
+        local.set $faultAt
+        i32.const 39
+        local.set $faultLength
+        i32.const 1
+        local.set $pc
+        br $dispatch
+      end
+      local.get $r1
+      i64.const -1
+      i64.eq
+      if
+        i64.const 0
+        local.get $r2
+        i64.sub
+        local.set $r2
+      else
+        local.get $r2
+        local.get $r1
+        i64.div_s
+        local.set $r2
+      end
+      ;; 0044 (../../examples/arithmetic.gsm.27): show r2
+      local.get $r2
+      call $show
+      ;; 0046 (../../examples/arithmetic.gsm.30): const 80 r1
+      i64.const 80
+      local.set $r1
+      ;; 0049 (../../examples/arithmetic.gsm.31): const 130 r2
+      i64.const 130
+      local.set $r2
+      ;; 0052 (../../examples/arithmetic.gsm.32): rem r1 r2
+      local.get $r1
+      i64.eqz
+      if
+        i64.const -7
+        local.set $fault
+        i32.const 10791
+        local.set $faultAt
+        i32.const 39
+        local.set $faultLength
+        i32.const 1
+        local.set $pc
+        br $dispatch
+      end
+      local.get $r2
+      local.get $r1
+      i64.rem_s
+      local.set $r2
+      ;; 0055 (../../examples/arithmetic.gsm.33): show r2
+      local.get $r2
+      call $show
+      ;; 0057 (../../examples/arithmetic.gsm.35): halt
+      i32.const 0
+      return
+      end $raise
+      local.get $hp
+      i32.eqz
+      if
+        i32.const 0
+        local.set $description
+        i32.const 0
+        local.set $descriptionLength
+        local.get $thrown
+        i32.eqz
+        if
+          local.get $fault
+          i64.const -1
+          i64.eq
+          if
+            i32.const 10830
+            local.set $description
+            i32.const 19
+            local.set $descriptionLength
+          end
+          local.get $fault
+          i64.const -2
+          i64.eq
+          if
+            i32.const 10849
+            local.set $description
+            i32.const 15
+            local.set $descriptionLength
+          end
+          local.get $fault
+          i64.const -3
+          i64.eq
+          if
+            i32.const 10864
+            local.set $description
+            i32.const 19
+            local.set $descriptionLength
+          end
+          local.get $fault
+          i64.const -4
+          i64.eq
+          if
+            i32.const 10883
+            local.set $description
+            i32.const 20
+            local.set $descriptionLength
+          end
+          local.get $fault
+          i64.const -5
+          i64.eq
+          if
+            i32.const 10903
+            local.set $description
+            i32.const 16
+            local.set $descriptionLength
+          end
+          local.get $fault
+          i64.const -6
+          i64.eq
+          if
+            i32.const 10919
+            local.set $description
+            i32.const 14
+            local.set $descriptionLength
+          end
+          local.get $fault
+          i64.const -7
+          i64.eq
+          if
+            i32.const 10933
+            local.set $description
+            i32.const 16
+            local.set $descriptionLength
+          end
+          local.get $fault
+          i64.const -8
+          i64.eq
+          if
+            i32.const 10949
+            local.set $description
+            i32.const 22
+            local.set $descriptionLength
+          end
+          local.get $fault
+          i64.const -9
+          i64.eq
+          if
+            i32.const 10971
+            local.set $description
+            i32.const 29
+            local.set $descriptionLength
+          end
+        end
+        local.get $fault
+        local.get $description
+        local.get $descriptionLength
+        local.get $faultAt
+        local.get $faultLength
+        call $fault
+        i32.const 1
+        return
+      end
+      i32.const 0
+      local.set $thrown
+      local.get $hp
+      i32.const -1
+      i32.add
+      local.set $hp
+      local.get $hp
+      i32.const 4
+      i32.shl
+      local.set $handler
+      local.get $handler
+      i32.load offset=8712
+      local.set $csp
+      local.get $handler
+      i32.load offset=8716
+      local.set $sp
+      local.get $handler
+      i32.load offset=8704
+      local.set $pc
+      br $dispatch
+    end
+    unreachable
+  )
+)
@@ -0,0 +1,735 @@
+(module
+  (import "gvm" "show" (func $show (param $value i64)))
+  (import "gvm" "iarg" (func $iarg (param $index i64) (result i64 i32)))
+  (import "gvm" "fault" (func $fault (param $code i64) (param $description i32) (param $descriptionLength i32) (param $location i32) (param $locationLength i32)))
+  (memory (export "memory") 1)
+  (data (i32.const 10752) "0012 <fibonacci.recursive+2> (../../examples/fibonacci.gsm.11)")
+  (data (i32.const 10814) "0014 <fibonacci.recursive+4> (../../examples/fibonacci.gsm.12)")
+  (data (i32.const 10876) "0016 <fibonacci.recursive+6> (../../examples/fibonacci.gsm.14)")
+  (data (i32.const 10938) "0018 <fibonacci.recursive+8> (../../examples/fibonacci.gsm.15)")
+  (data (i32.const 11000) "0022 <fibonacci.recursive+12> (../../examples/fibonacci.gsm.17)")
+  (data (i32.const 11063) "0024 <fibonacci.recursive+14> (../../examples/fibonacci.gsm.18)")
+  (data (i32.const 11126) "0026 <fibonacci.recursive+16> (../../examples/fibonacci.gsm.20)")
+  (data (i32.const 11189) "0028 <fibonacci.recursive+18> (../../examples/fibonacci.gsm.21)")
+  (data (i32.const 11252) "0033 <fibonacci.recursive+23> (../../examples/fibonacci.gsm.23)")
+  (data (i32.const 11315) "0040 <fibonacci.simple+3> (../../examples/fibonacci.gsm.27)")
+  (data (i32.const 11374) "0042 <fibonacci.end> (../../examples/fibonacci.gsm.29)")
+  (data (i32.const 11428) "0046 <main+3> (../../examples/fibonacci.gsm.34)")
+  (data (i32.const 11475) "0050 <main+7> (../../examples/fibonacci.gsm.36)")
+  (data (i32.const 11522) "0052 <main.start> (../../examples/fibonacci.gsm.39)")
+  (data (i32.const 11573) "0054 <main.start+2> (../../examples/fibonacci.gsm.40)")
+  (data (i32.const 11626) "unknown instruction")
+  (data (i32.const 11645) "stack underflow")
+  (data (i32.const 11660) "call stack overflow")
+  (data (i32.const 11679) "call stack underflow")
+  (data (i32.const 11699) "assertion failed")
+  (data (i32.const 11715) "stack overflow")
+  (data (i32.const 11729) "division by zero")
+  (data (i32.const 11745) "handler stack overflow")
+  (data (i32.const 11767) "endtry without a matching try")
+
+  (func $compareFlags (param $lhs i64) (param $rhs i64) (result i32)
+    (local $diff i64)
+    local.get $lhs
+    local.get $rhs
+    i64.sub
+    local.set $diff
+    ;; Zero flag
+    local.get $diff
+    i64.eqz
+    ;; Sign flag
+    local.get $diff
+    i64.const 0
+    i64.lt_s
+    i32.const 1
+    i32.shl
+    i32.or
+    ;; Carry flag
+    local.get $lhs
+    local.get $rhs
+    i64.lt_u
+    i32.const 2
+    i32.shl
+    i32.or
+    ;; Overflow flag
+    local.get $lhs
+    local.get $rhs
+    i64.xor
+    local.get $lhs
+    local.get $diff
+    i64.xor
+    i64.and
+    i64.const 0
+    i64.lt_s
+    i32.const 3
+    i32.shl
+    i32.or
+  )
+
+  (func $isEqual (param $flags i32) (result i32)
+    local.get $flags
+    i32.const 0
+    i32.shr_u
+    i32.const 1
+    i32.and
+  )
+
+  (func $isLess (param $flags i32) (result i32)
+    local.get $flags
+    i32.const 1
+    i32.shr_u
+    i32.const 1
+    i32.and
+    local.get $flags
+    i32.const 3
+    i32.shr_u
+    i32.const 1
+    i32.and
+    i32.ne
+  )
+
+  (func $isBelow (param $flags i32) (result i32)
+    local.get $flags
+    i32.const 2
+    i32.shr_u
+    i32.const 1
+    i32.and
+  )
+
+  (func $run (export "run") (result i32)
+    (local $r0 i64)
+    (local $r1 i64)
+    (local $r2 i64)
+    (local $r3 i64)
+    (local $r4 i64)
+    (local $r5 i64)
+    (local $r6 i64)
+    (local $r7 i64)
+    (local $r8 i64)
+    (local $r9 i64)
+    (local $r10 i64)
+    (local $r11 i64)
+    (local $r12 i64)
+    (local $r13 i64)
+    (local $r14 i64)
+    (local $r15 i64)
+    (local $pc i32)
+    (local $sp i32)
+    (local $csp i32)
+    (local $hp i32)
+    (local $handler i32)
+    (local $cmpFlag i32)
+    (local $errFlag i32)
+    (local $value i64)
+    (local $ok i32)
+    (local $fault i64)
+    (local $faultAt i32)
+    (local $faultLength i32)
+    (local $thrown i32)
+    (local $description i32)
+    (local $descriptionLength i32)
+    loop $dispatch
+      block $raise
+      block $p0058
+      block $p0054
+      block $p0043
+      block $p0042
+      block $p0037
+      block $p0026
+      block $p0016
+      block $p0002
+      block $p0000
+      local.get $pc
+      br_table $p0000 $p0002 $p0016 $p0026 $p0037 $p0042 $p0043 $p0054 $p0058 $raise
+      end $p0000
+      ;; 0000: jmp main
+      i32.const 6
+      local.set $pc
+      br $dispatch
+      end $p0002
+      ;; 0002 <fibonacci> (../../examples/fibonacci.gsm.4): const 1 r10
+      i64.const 1
+      local.set $r10
+      ;; 0005 <fibonacci+3> (../../examples/fibonacci.gsm.5): cmp r1 r10
+      local.get $r10
+      local.get $r1
+      call $compareFlags
+      local.set $cmpFlag
+      ;; 0008 <fibonacci+6> (../../examples/fibonacci.gsm.7): jge fibonacci.simple
+      local.get $cmpFlag
+      call $isLess
+      i32.eqz
+      if
+        i32.const 4
+        local.set $pc
+        br $dispatch
+      end
+      ;; 0010 <fibonacci.recursive> (../../examples/fibonacci.gsm.10): dec r1
+      local.get $r1
+      i64.const 1
+      i64.sub
+      local.set $r1
+      ;; 0012 <fibonacci.recursive+2> (../../examples/fibonacci.gsm.11): push r1
+      local.get $sp
+      i32.const 1024
+      i32.eq
+      if
+        i64.const -6
+        local.set $fault
+        i32.const 10752
+        local.set $faultAt
+        i32.const 62
+        local.set $faultLength
+        i32.const 9
+        local.set $pc
+        br $dispatch
+      end
+      local.get $sp
+      i32.const 3
+      i32.shl
+      local.get $r1
+      i64.store
+      local.get $sp
+      i32.const 1
+      i32.add
+      local.set $sp
+      ;; 0014 <fibonacci.recursive+4> (../../examples/fibonacci.gsm.12): call fibonacci
+      local.get $csp
+      i32.const 128
+      i32.eq
+      if
+        i64.const -3
+        local.set $fault
+        i32.const 10814
+        local.set $faultAt
+        i32.const 62
+        local.set $faultLength
+        i32.const 9
+        local.set $pc
+        br $dispatch
+      end
+      local.get $csp
+      i32.const 2
+      i32.shl
+      i32.const 2
+      i32.store offset=8192
+      local.get $csp
+      i32.const 1
+      i32.add
+      local.set $csp
+      i32.const 1
+      local.set $pc
+      br $dispatch
+      end $p0016
+      ;; 0016 <fibonacci.recursive+6> (../../examples/fibonacci.gsm.14): pop r2
+      local.get $sp
+      i32.eqz
+      if
+        i64.const -2
+        local.set $fault
+        i32.const 10876
+        local.set $faultAt
+        i32.const 62
+        local.set $faultLength
+        i32.const 9
+        local.set $pc
+        br $dispatch
+      end
+      local.get $sp
+      i32.const -1
+      i32.add
+      local.set $sp
+      local.get $sp
+      i32.const 3
+      i32.shl
+      i64.load
+      local.set $r2
+      ;; 0018 <fibonacci.recursive+8> (../../examples/fibonacci.gsm.15): pop r1
+      local.get $sp
+      i32.eqz
+      if
+        i64.const -2
+        local.set $fault
+        i32.const 10938
+        local.set $faultAt
+        i32.const 62
+        local.set $faultLength
+        i32.const 9
+        local.set $pc
+        br $dispatch
+      end
+      local.get $sp
+      i32.const -1
+      i32.add
+      local.set $sp
+      local.get $sp
+      i32.const 3
+      i32.shl
+      i64.load
+      local.set $r1
+      ;; 0020 <fibonacci.recursive+10> (../../examples/fibonacci.gsm.16): dec r1
+      local.get $r1
+      i64.const 1
+      i64.sub
+      local.set $r1
+      ;; 0022 <fibonacci.recursive+12> (../../examples/fibonacci.gsm.17): push r2
+      local.get $sp
+      i32.const 1024
+      i32.eq
+      if
+        i64.const -6
+        local.set $fault
+        i32.const 11000
+        local.set $faultAt
+        i32.const 63
+        local.set $faultLength
+        i32.const 9
+        local.set $pc
+        br $dispatch
+      end
+      local.get $sp
+      i32.const 3
+      i32.shl
+      local.get $r2
+      i64.store
+      local.get $sp
+      i32.const 1
+      i32.add
+      local.set $sp
+      ;; 0024 <fibonacci.recursive+14> (../../examples/fibonacci.gsm.18): call fibonacci
+      local.get $csp
+      i32.const 128
+      i32.eq
+      if
+        i64.const -3
+        local.set $fault
+        i32.const 11063
+        local.set $faultAt
+        i32.const 63
+        local.set $faultLength
+        i32.const 9
+        local.set $pc
+        br $dispatch
+      end
+      local.get $csp
+      i32.const 2
+      i32.shl
+      i32.const 3
+      i32.store offset=8192
+      local.get $csp
+      i32.const 1
+      i32.add
+      local.set $csp
+      i32.const 1
+      local.set $pc
+      br $dispatch
+      end $p0026
+      ;; 0026 <fibonacci.recursive+16> (../../examples/fibonacci.gsm.20): pop r2
+      local.get $sp
+      i32.eqz
+      if
+        i64.const -2
+        local.set $fault
+        i32.const 11126
+        local.set $faultAt
+        i32.const 63
+        local.set $faultLength
+        i32.const 9
+        local.set $pc
+        br $dispatch
+      end
+      local.get $sp
+      i32.const -1
+      i32.add
+      local.set $sp
+      local.get $sp
+      i32.const 3
+      i32.shl
+      i64.load
+      local.set $r2
+      ;; 0028 <fibonacci.recursive+18> (../../examples/fibonacci.gsm.21): pop r3
+      local.get $sp
+      i32.eqz
+      if
+        i64.const -2
+        local.set $fault
+        i32.const 11189
+        local.set $faultAt
+        i32.const 63
+        local.set $faultLength
+        i32.const 9
+        local.set $pc
+        br $dispatch
+      end
+      local.get $sp
+      i32.const -1
+      i32.add
+      local.set $sp
+      local.get $sp
+      i32.const 3
+      i32.shl
+      i64.load
+      local.set $r3
+      ;; 0030 <fibonacci.recursive+20> (../../examples/fibonacci.gsm.22): add r3 r2
+      local.get $r2
+      local.get $r3
+      i64.add
+      local.set $r2
+      ;; 0033 <fibonacci.recursive+23> (../../examples/fibonacci.gsm.23): push r2
+      local.get $sp
+      i32.const 1024
+      i32.eq
+      if
+        i64.const -6
+        local.set $fault
+        i32.const 11252
+        local.set $faultAt
+        i32.const 63
+        local.set $faultLength
+        i32.const 9
+        local.set $pc
+        br $dispatch
+      end
+      local.get $sp
+      i32.const 3
+      i32.shl
+      local.get $r2
+      i64.store
+      local.get $sp
+      i32.const 1
+      i32.add
+      local.set $sp
+      ;; 0035 <fibonacci.recursive+25> (../../examples/fibonacci.gsm.24): jmp fibonacci.end
+      i32.const 5
+      local.set $pc
+      br $dispatch
+      end $p0037
+      ;; 0037 <fibonacci.simple> (../../examples/fibonacci.gsm.26): const 1 r2
+      i64.const 1
+      local.set $r2
+      ;; 0040 <fibonacci.simple+3> (../../examples/fibonacci.gsm.27): push r2
+      local.get $sp
+      i32.const 1024
+      i32.eq
+      if
+        i64.const -6
+        local.set $fault
+        i32.const 11315
+        local.set $faultAt
+        i32.const 59
+        local.set $faultLength
+        i32.const 9
+        local.set $pc
+        br $dispatch
+      end
+      local.get $sp
+      i32.const 3
+      i32.shl
+      local.get $r2
+      i64.store
+      local.get $sp
+      i32.const 1
+      i32.add
+      local.set $sp
+      end $p0042
+      ;; 0042 <fibonacci.end> (../../examples/fibonacci.gsm.29): ret
+      local.get $csp
+      i32.eqz
+      if
+        i64.const -4
+        local.set $fault
+        i32.const 11374
+        local.set $faultAt
+        i32.const 54
+        local.set $faultLength
+        i32.const 9
+        local.set $pc
+        br $dispatch
+      end
+      local.get $csp
+      i32.const -1
+      i32.add
+      local.set $csp
+      local.get $csp
+      i32.const 2
+      i32.shl
+      i32.load offset=8192
+      local.set $pc
+      ;; Handlers installed by the returning routine go out of scope
+      block $unwound
+        loop $unwind
+          local.get $hp
+          i32.eqz
+          br_if $unwound
+          local.get $hp
+          i32.const 1
+          i32.sub
+          i32.const 4
+          i32.shl
+          i32.load offset=8712
+          local.get $csp
+          i32.le_s
+          br_if $unwound
+          local.get $hp
+          i32.const -1
+          i32.add
+          local.set $hp
+          br $unwind
+        end
+      end
+      br $dispatch
+      end $p0043
+      ;; 0043 <main> (../../examples/fibonacci.gsm.33): const 0 r1
+      i64.const 0
+      local.set $r1
+      ;; 0046 <main+3> (../../examples/fibonacci.gsm.34): iarg r1
+      local.get $r1
+      call $iarg
+      local.set $ok
+      local.set $value
+      local.get $ok
+      i32.eqz
+      if
+        i32.const 1
+        local.set $errFlag
+      else
+        local.get $sp
+        i32.const 1024
+        i32.eq
+        if
+          i64.const -6
+          local.set $fault
+          i32.const 11428
+          local.set $faultAt
+          i32.const 47
+          local.set $faultLength
+          i32.const 9
+          local.set $pc
+          br $dispatch
+        end
+        local.get $sp
+        i32.const 3
+        i32.shl
+        local.get $value
+        i64.store
+        local.get $sp
+        i32.const 1
+        i32.add
+        local.set $sp
+      end
+      ;; 0048 <main+5> (../../examples/fibonacci.gsm.35): jerr main.bad_input
+      local.get $errFlag
+      if
+        i32.const 0
+        local.set $errFlag
+        i32.const 8
+        local.set $pc
+        br $dispatch
+      end
+      ;; 0050 <main+7> (../../examples/fibonacci.gsm.36): pop r1
+      local.get $sp
+      i32.eqz
+      if
+        i64.const -2
+        local.set $fault
+        i32.const 11475
+        local.set $faultAt
+        i32.const 47
+        local.set $faultLength
+        i32.const 9
+        local.set $pc
+        br $dispatch
+      end
+      local.get $sp
+      i32.const -1
+      i32.add
+      local.set $sp
+      local.get $sp
+      i32.const 3
+      i32.shl
+      i64.load
+      local.set $r1
+      ;; 0052 <main.start> (../../examples/fibonacci.gsm.39): call fibonacci
+      local.get $csp
+      i32.const 128
+      i32.eq
+      if
+        i64.const -3
+        local.set $fault
+        i32.const 11522
+        local.set $faultAt
+        i32.const 51
+        local.set $faultLength
+        i32.const 9
+        local.set $pc
+        br $dispatch
+      end
+      local.get $csp
+      i32.const 2
+      i32.shl
+      i32.const 7
+      i32.store offset=8192
+      local.get $csp
+      i32.const 1
+      i32.add
+      local.set $csp
+      i32.const 1
+      local.set $pc
+      br $dispatch
+      end $p0054
+      ;; 0054 <main.start+2> (../../examples/fibonacci.gsm.40): pop r1
+      local.get $sp
+      i32.eqz
+      if
+        i64.const -2
+        local.set $fault
+        i32.const 11573
+        local.set $faultAt
+        i32.const 53
+        local.set $faultLength
+        i32.const 9
+        local.set $pc
+        br $dispatch
+      end
+      local.get $sp
+      i32.const -1
+      i32.add
+      local.set $sp
+      local.get $sp
+      i32.const 3
+      i32.shl
+      i64.load
+      local.set $r1
+      ;; 0056 <main.start+4> (../../examples/fibonacci.gsm.41): show r1
+      local.get $r1
+      call $show
+      end $p0058
+      ;; 0058 <main.bad_input> (../../examples/fibonacci.gsm.43): halt
+      i32.const 0
+      return
+      end $raise
+      local.get $hp
+      i32.eqz
+      if
+        i32.const 0
+        local.set $description
+        i32.const 0
+        local.set $descriptionLength
+        local.get $thrown
+        i32.eqz
+        if
+          local.get $fault
+          i64.const -1
+          i64.eq
+          if
+            i32.const 11626
+            local.set $description
+            i32.const 19
+            local.set $descriptionLength
+          end
+          local.get $fault
+          i64.const -2
+          i64.eq
+          if
+            i32.const 11645
+            local.set $description
+            i32.const 15
+            local.set $descriptionLength
+          end
+          local.get $fault
+          i64.const -3
+          i64.eq
+          if
+            i32.const 11660
+            local.set $description
+            i32.const 19
+            local.set $descriptionLength
+          end
+          local.get $fault
+          i64.const -4
+          i64.eq
+          if
+            i32.const 11679
+            local.set $description
+            i32.const 20
+            local.set $descriptionLength
+          end
+          local.get $fault
+          i64.const -5
+          i64.eq
+          if
+            i32.const 11699
+            local.set $description
+            i32.const 16
+            local.set $descriptionLength
+          end
+          local.get $fault
+          i64.const -6
+          i64.eq
+          if
+            i32.const 11715
+            local.set $description
+            i32.const 14
+            local.set $descriptionLength
+          end
+          local.get $fault
+          i64.const -7
+          i64.eq
+          if
+            i32.const 11729
+            local.set $description
+            i32.const 16
+            local.set $descriptionLength
+          end
+          local.get $fault
+          i64.const -8
+          i64.eq
+          if
+            i32.const 11745
+            local.set $description
+            i32.const 22
+            local.set $descriptionLength
+          end
+          local.get $fault
+          i64.const -9
+          i64.eq
+          if
+            i32.const 11767
+            local.set $description
+            i32.const 29
+            local.set $descriptionLength
+          end
+        end
+        local.get $fault
+        local.get $description
+        local.get $descriptionLength
+        local.get $faultAt
+        local.get $faultLength
+        call $fault
+        i32.const 1
+        return
+      end
+      i32.const 0
+      local.set $thrown
+      local.get $hp
+      i32.const -1
+      i32.add
+      local.set $hp
+      local.get $hp
+      i32.const 4
+      i32.shl
+      local.set $handler
+      local.get $handler
+      i32.load offset=8712
+      local.set $csp
+      local.get $handler
+      i32.load offset=8716
+      local.set $sp
+      local.get $handler
+      i32.load offset=8704
+      local.set $pc
+      br $dispatch
+    end
+    unreachable
+  )
+)
@@ -0,0 +1,455 @@
+(module
+  (import "gvm" "show" (func $show (param $value i64)))
+  (import "gvm" "iarg" (func $iarg (param $index i64) (result i64 i32)))
+  (import "gvm" "fault" (func $fault (param $code i64) (param $description i32) (param $descriptionLength i32) (param $location i32) (param $locationLength i32)))
+  (memory (export "memory") 1)
+  (data (i32.const 10752) "unknown instruction")
+  (data (i32.const 10771) "stack underflow")
+  (data (i32.const 10786) "call stack overflow")
+  (data (i32.const 10805) "call stack underflow")
+  (data (i32.const 10825) "assertion failed")
+  (data (i32.const 10841) "stack overflow")
+  (data (i32.const 10855) "division by zero")
+  (data (i32.const 10871) "handler stack overflow")
+  (data (i32.const 10893) "endtry without a matching try")
+
+  (func $compareFlags (param $lhs i64) (param $rhs i64) (result i32)
+    (local $diff i64)
+    local.get $lhs
+    local.get $rhs
+    i64.sub
+    local.set $diff
+    ;; Zero flag
+    local.get $diff
+    i64.eqz
+    ;; Sign flag
+    local.get $diff
+    i64.const 0
+    i64.lt_s
+    i32.const 1
+    i32.shl
+    i32.or
+    ;; Carry flag
+    local.get $lhs
+    local.get $rhs
+    i64.lt_u
+    i32.const 2
+    i32.shl
+    i32.or
+    ;; Overflow flag
+    local.get $lhs
+    local.get $rhs
+    i64.xor
+    local.get $lhs
+    local.get $diff
+    i64.xor
+    i64.and
+    i64.const 0
+    i64.lt_s
+    i32.const 3
+    i32.shl
+    i32.or
+  )
+
+  (func $isEqual (param $flags i32) (result i32)
+    local.get $flags
+    i32.const 0
+    i32.shr_u
+    i32.const 1
+    i32.and
+  )
+
+  (func $isLess (param $flags i32) (result i32)
+    local.get $flags
+    i32.const 1
+    i32.shr_u
+    i32.const 1
+    i32.and
+    local.get $flags
+    i32.const 3
+    i32.shr_u
+    i32.const 1
+    i32.and
+    i32.ne
+  )
+
+  (func $isBelow (param $flags i32) (result i32)
+    local.get $flags
+    i32.const 2
+    i32.shr_u
+    i32.const 1
+    i32.and
+  )
+
+  (func $run (export "run") (result i32)
+    (local $r0 i64)
+    (local $r1 i64)
+    (local $r2 i64)
+    (local $r3 i64)
+    (local $r4 i64)
+    (local $r5 i64)
+    (local $r6 i64)
+    (local $r7 i64)
+    (local $r8 i64)
+    (local $r9 i64)
+    (local $r10 i64)
+    (local $r11 i64)
+    (local $r12 i64)
+    (local $r13 i64)
+    (local $r14 i64)
+    (local $r15 i64)
+    (local $pc i32)
+    (local $sp i32)
+    (local $csp i32)
+    (local $hp i32)
+    (local $handler i32)
+    (local $cmpFlag i32)
+    (local $errFlag i32)
+    (local $value i64)
+    (local $ok i32)
+    (local $fault i64)
+    (local $faultAt i32)
+    (local $faultLength i32)
+    (local $thrown i32)
+    (local $description i32)
+    (local $descriptionLength i32)
+    loop $dispatch
+      block $raise
+      block $p0095
+      block $p0091
+      block $p0084
+      block $p0080
+      block $p0073
+      block $p0069
+      block $p0062
+      block $p0058
+      block $p0051
+      block $p0045
+      block $p0038
+      block $p0032
+      block $p0025
+      block $p0019
+      block $p0015
+      block $p0007
+      block $p0000
+      local.get $pc
+      br_table $p0000 $p0007 $p0015 $p0019 $p0025 $p0032 $p0038 $p0045 $p0051 $p0058 $p0062 $p0069 $p0073 $p0080 $p0084 $p0091 $p0095 $raise
+      end $p0000
+      ;; 0000: jmp main
+      i32.const 1
+      local.set $pc
+      br $dispatch
+      end $p0007
+      ;; 0007 <main> (../../examples/jumper.gsm.11): const 0 r1
+      i64.const 0
+      local.set $r1
+      ;; 0010 <main+3> (../../examples/jumper.gsm.12): const 1 r2
+      i64.const 1
+      local.set $r2
+      ;; 0013 <main+6> (../../examples/jumper.gsm.13): jmp test_jmp
+      i32.const 2
+      local.set $pc
+      br $dispatch
+      end $p0015
+      ;; 0015 <test_jmp> (../../examples/jumper.gsm.16): jmp test_jmp.success
+      i32.const 3
+      local.set $pc
+      br $dispatch
+      end $p0019
+      ;; 0019 <test_jmp.success> (../../examples/jumper.gsm.19): show r2
+      local.get $r2
+      call $show
+      ;; 0021 <test_jmp.success+2> (../../examples/jumper.gsm.20): jmp test_jeq
+      i32.const 4
+      local.set $pc
+      br $dispatch
+      end $p0025
+      ;; 0025 <test_jeq> (../../examples/jumper.gsm.24): cmp r1 r1
+      local.get $r1
+      local.get $r1
+      call $compareFlags
+      local.set $cmpFlag
+      ;; 0028 <test_jeq+3> (../../examples/jumper.gsm.25): jeq test_jeq.success
+      local.get $cmpFlag
+      call $isEqual
+      if
+        i32.const 5
+        local.set $pc
+        br $dispatch
+      end
+      ;; 0030 <test_jeq+5> (../../examples/jumper.gsm.26): show r1
+      local.get $r1
+      call $show
+      end $p0032
+      ;; 0032 <test_jeq.success> (../../examples/jumper.gsm.28): show r2
+      local.get $r2
+      call $show
+      ;; 0034 <test_jeq.success+2> (../../examples/jumper.gsm.29): jmp test_jne
+      i32.const 6
+      local.set $pc
+      br $dispatch
+      end $p0038
+      ;; 0038 <test_jne> (../../examples/jumper.gsm.33): cmp r1 r2
+      local.get $r2
+      local.get $r1
+      call $compareFlags
+      local.set $cmpFlag
+      ;; 0041 <test_jne+3> (../../examples/jumper.gsm.34): jne test_jne.success
+      local.get $cmpFlag
+      call $isEqual
+      i32.eqz
+      if
+        i32.const 7
+        local.set $pc
+        br $dispatch
+      end
+      ;; 0043 <test_jne+5> (../../examples/jumper.gsm.35): show r1
+      local.get $r1
+      call $show
+      end $p0045
+      ;; 0045 <test_jne.success> (../../examples/jumper.gsm.37): show r2
+      local.get $r2
+      call $show
+      ;; 0047 <test_jne.success+2> (../../examples/jumper.gsm.38): jmp test_jgt
+      i32.const 8
+      local.set $pc
+      br $dispatch
+      end $p0051
+      ;; 0051 <test_jgt> (../../examples/jumper.gsm.42): cmp r1 r2
+      local.get $r2
+      local.get $r1
+      call $compareFlags
+      local.set $cmpFlag
+      ;; 0054 <test_jgt+3> (../../examples/jumper.gsm.43): jgt test_jgt.success
+      local.get $cmpFlag
+      call $isEqual
+      i32.eqz
+      local.get $cmpFlag
+      call $isLess
+      i32.eqz
+      i32.and
+      if
+        i32.const 9
+        local.set $pc
+        br $dispatch
+      end
+      ;; 0056 <test_jgt+5> (../../examples/jumper.gsm.44): show r1
+      local.get $r1
+      call $show
+      end $p0058
+      ;; 0058 <test_jgt.success> (../../examples/jumper.gsm.46): show r2
+      local.get $r2
+      call $show
+      ;; 0060 <test_jgt.success+2> (../../examples/jumper.gsm.47): jmp test_jlt
+      i32.const 10
+      local.set $pc
+      br $dispatch
+      end $p0062
+      ;; 0062 <test_jlt> (../../examples/jumper.gsm.50): cmp r2 r1
+      local.get $r1
+      local.get $r2
+      call $compareFlags
+      local.set $cmpFlag
+      ;; 0065 <test_jlt+3> (../../examples/jumper.gsm.51): jlt test_jlt.success
+      local.get $cmpFlag
+      call $isLess
+      if
+        i32.const 11
+        local.set $pc
+        br $dispatch
+      end
+      ;; 0067 <test_jlt+5> (../../examples/jumper.gsm.52): show r1
+      local.get $r1
+      call $show
+      end $p0069
+      ;; 0069 <test_jlt.success> (../../examples/jumper.gsm.54): show r2
+      local.get $r2
+      call $show
+      ;; 0071 <test_jlt.success+2> (../../examples/jumper.gsm.55): jmp test_jge
+      i32.const 12
+      local.set $pc
+      br $dispatch
+      end $p0073
+      ;; 0073 <test_jge> (../../examples/jumper.gsm.58): cmp r1 r1
+      local.get $r1
+      local.get $r1
+      call $compareFlags
+      local.set $cmpFlag
+      ;; 0076 <test_jge+3> (../../examples/jumper.gsm.59): jge test_jge.success
+      local.get $cmpFlag
+      call $isLess
+      i32.eqz
+      if
+        i32.const 13
+        local.set $pc
+        br $dispatch
+      end
+      ;; 0078 <test_jge+5> (../../examples/jumper.gsm.60): show r1
+      local.get $r1
+      call $show
+      end $p0080
+      ;; 0080 <test_jge.success> (../../examples/jumper.gsm.62): show r2
+      local.get $r2
+      call $show
+      ;; 0082 <test_jge.success+2> (../../examples/jumper.gsm.63): jmp test_jle
+      i32.const 14
+      local.set $pc
+      br $dispatch
+      end $p0084
+      ;; 0084 <test_jle> (../../examples/jumper.gsm.66): cmp r2 r2
+      local.get $r2
+      local.get $r2
+      call $compareFlags
+      local.set $cmpFlag
+      ;; 0087 <test_jle+3> (../../examples/jumper.gsm.67): jle test_jle.success
+      local.get $cmpFlag
+      call $isEqual
+      local.get $cmpFlag
+      call $isLess
+      i32.or
+      if
+        i32.const 15
+        local.set $pc
+        br $dispatch
+      end
+      ;; 0089 <test_jle+5> (../../examples/jumper.gsm.68): show r1
+      local.get $r1
+      call $show
+      end $p0091
+      ;; 0091 <test_jle.success> (../../examples/jumper.gsm.70): show r2
+      local.get $r2
+      call $show
+      ;; 0093 <test_jle.success+2> (../../examples/jumper.gsm.71): jmp end
+      i32.const 16
+      local.set $pc
+      br $dispatch
+      end $p0095
+      ;; 0095 <end> (../../examples/jumper.gsm.74): halt
+      i32.const 0
+      return
+      end $raise
+      local.get $hp
+      i32.eqz
+      if
+        i32.const 0
+        local.set $description
+        i32.const 0
+        local.set $descriptionLength
+        local.get $thrown
+        i32.eqz
+        if
+          local.get $fault
+          i64.const -1
+          i64.eq
+          if
+            i32.const 10752
+            local.set $description
+            i32.const 19
+            local.set $descriptionLength
+          end
+          local.get $fault
+          i64.const -2
+          i64.eq
+          if
+            i32.const 10771
+            local.set $description
+            i32.const 15
+            local.set $descriptionLength
+          end
+          local.get $fault
+          i64.const -3
+          i64.eq
+          if
+            i32.const 10786
+            local.set $description
+            i32.const 19
+            local.set $descriptionLength
+          end
+          local.get $fault
+          i64.const -4
+          i64.eq
+          if
+            i32.const 10805
+            local.set $description
+            i32.const 20
+            local.set $descriptionLength
+          end
+          local.get $fault
+          i64.const -5
+          i64.eq
+          if
+            i32.const 10825
+            local.set $description
+            i32.const 16
+            local.set $descriptionLength
+          end
+          local.get $fault
+          i64.const -6
+          i64.eq
+          if
+            i32.const 10841
+            local.set $description
+            i32.const 14
+            local.set $descriptionLength
+          end
+          local.get $fault
+          i64.const -7
+          i64.eq
+          if
+            i32.const 10855
+            local.set $description
+            i32.const 16
+            local.set $descriptionLength
+          end
+          local.get $fault
+          i64.const -8
+          i64.eq
+          if
+            i32.const 10871
+            local.set $description
+            i32.const 22
+            local.set $descriptionLength
+          end
+          local.get $fault
+          i64.const -9
+          i64.eq
+          if
+            i32.const 10893
+            local.set $description
+            i32.const 29
+            local.set $descriptionLength
+          end
+        end
+        local.get $fault
+        local.get $description
+        local.get $descriptionLength
+        local.get $faultAt
+        local.get $faultLength
+        call $fault
+        i32.const 1
+        return
+      end
+      i32.const 0
+      local.set $thrown
+      local.get $hp
+      i32.const -1
+      i32.add
+      local.set $hp
+      local.get $hp
+      i32.const 4
+      i32.shl
+      local.set $handler
+      local.get $handler
+      i32.load offset=8712
+      local.set $csp
+      local.get $handler
+      i32.load offset=8716
+      local.set $sp
+      local.get $handler
+      i32.load offset=8704
+      local.set $pc
+      br $dispatch
+    end
+    unreachable
+  )
+)
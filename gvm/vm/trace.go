@@ -0,0 +1,186 @@
+package vm
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/vsartor/gvm/gvm"
+	"os"
+	"strconv"
+)
+
+// TraceFilter narrows down the steps written to a trace. Steps are counted from
+// zero, and both windows include their start but not their end.
+type TraceFilter struct {
+	FirstStep int64
+	// Step where tracing ends, if positive
+	LastStep int64
+	// Label or code position where the traced code starts, if any
+	From string
+	// Label or code position where the traced code ends, if any
+	To string
+}
+
+// traceRecord describes a step of execution, holding only the registers and
+// flags that the instruction changed.
+type traceRecord struct {
+	Step        int64            `json:"step"`
+	Position    int64            `json:"position"`
+	Symbol      string           `json:"symbol,omitempty"`
+	Source      string           `json:"source,omitempty"`
+	Instruction string           `json:"instruction"`
+	Registers   map[string]int64 `json:"registers,omitempty"`
+	Stack       int64            `json:"stack"`
+	Calls       int64            `json:"calls"`
+	Flags       *traceFlags      `json:"flags,omitempty"`
+	Fault       string           `json:"fault,omitempty"`
+}
+
+// traceFlags are the flags after a step changing any of them.
+type traceFlags struct {
+	// Names of the flags set by the last comparison
+	Cmp []string `json:"cmp"`
+	Err int64    `json:"err"`
+}
+
+func comparisonFlagNames(cmpFlag int64) []string {
+	names := []string{}
+	for _, flag := range []struct {
+		bit  int64
+		name string
+	}{{zeroFlag, "zero"}, {signFlag, "sign"}, {carryFlag, "carry"}, {overflowFlag, "overflow"}} {
+		if cmpFlag&flag.bit != 0 {
+			names = append(names, flag.name)
+		}
+	}
+	return names
+}
+
+// tracer writes a record for every step of execution passing its filter, as
+// one JSON object per line.
+type tracer struct {
+	program gvm.Program
+	file    *os.File
+	writer  *bufio.Writer
+	symbols []symbol
+	filter  TraceFilter
+	// Positions of the traced code, from start up to but not including end
+	start, end int64
+	step       int64
+	// State before the step being traced, if it is
+	tracing bool
+	reg     []int64
+	cmpFlag int64
+	errFlag int64
+}
+
+// resolveTracePosition returns the position given by a label or a number.
+func resolveTracePosition(debug *gvm.DebugInfo, location string) int64 {
+	if position, err := strconv.ParseInt(location, 10, 64); err == nil && position >= 0 {
+		return position
+	}
+	if debug != nil {
+		if position, ok := debug.Symbols[location]; ok {
+			return position
+		}
+	}
+	gvm.Logger.Criticalf("Expected a label or a code position to trace from or to, got '%s'.\n", location)
+	os.Exit(1)
+	return 0
+}
+
+func newTracer(program gvm.Program, dstPath string, filter TraceFilter) *tracer {
+	t := &tracer{
+		program: program,
+		symbols: sortedSymbols(program.Debug, func(name string) bool { return true }),
+		filter:  filter,
+		start:   0,
+		end:     int64(len(program.Code)),
+		reg:     make([]int64, gvm.RegisterCount),
+	}
+	if filter.From != "" {
+		t.start = resolveTracePosition(program.Debug, filter.From)
+	}
+	if filter.To != "" {
+		t.end = resolveTracePosition(program.Debug, filter.To)
+	}
+	if t.end <= t.start {
+		gvm.Logger.Criticalf("Expected '--trace-range' to end after it starts, got %d to %d.\n", t.start, t.end)
+		os.Exit(1)
+	}
+
+	gvm.Logger.Infof("Writing trace '%s'.\n", dstPath)
+	file, err := os.Create(dstPath)
+	if err != nil {
+		gvm.Logger.Criticalf("Failed creating '%s': %s\n", dstPath, err.Error())
+		os.Exit(1)
+	}
+	t.file = file
+	t.writer = bufio.NewWriter(file)
+	return t
+}
+
+func (t *tracer) before(vm *virtualMachine, code []gvm.Code) {
+	t.tracing = t.step >= t.filter.FirstStep && (t.filter.LastStep <= 0 || t.step < t.filter.LastStep) &&
+		vm.codePosition >= t.start && vm.codePosition < t.end
+	if t.tracing {
+		copy(t.reg, vm.reg)
+		t.cmpFlag, t.errFlag = vm.cmpFlag, vm.errFlag
+	}
+}
+
+func (t *tracer) after(vm *virtualMachine, position int64, depth int64) {
+	step := t.step
+	t.step++
+	if !t.tracing {
+		return
+	}
+
+	record := traceRecord{
+		Step:     step,
+		Position: position,
+		Stack:    vm.stackPtr,
+		Calls:    vm.callStackPtr,
+	}
+	if label, ok := closest(t.symbols, position); ok {
+		record.Symbol = label.name
+		if position > label.position {
+			record.Symbol += fmt.Sprintf("+%d", position-label.position)
+		}
+	}
+	if source, ok := t.program.Debug.SourceOf(position); ok {
+		record.Source = source.String()
+	}
+	record.Instruction, _ = disassembleInstruction(virtualMachine{debug: t.program.Debug, codePosition: position},
+		t.program.Code)
+
+	for idx, value := range vm.reg {
+		if value != t.reg[idx] {
+			if record.Registers == nil {
+				record.Registers = make(map[string]int64)
+			}
+			record.Registers[fmt.Sprintf("r%d", idx)] = value
+		}
+	}
+	if vm.cmpFlag != t.cmpFlag || vm.errFlag != t.errFlag {
+		record.Flags = &traceFlags{Cmp: comparisonFlagNames(vm.cmpFlag), Err: vm.errFlag}
+	}
+	if vm.fault != nil {
+		record.Fault = vm.fault.Error()
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		panic("This path should be impossible.")
+	}
+	_, _ = t.writer.Write(line)
+	_ = t.writer.WriteByte('\n')
+}
+
+func (t *tracer) close() {
+	if err := t.writer.Flush(); err != nil {
+		gvm.Logger.Criticalf("Failed writing '%s': %s\n", t.file.Name(), err.Error())
+		os.Exit(1)
+	}
+	_ = t.file.Close()
+}
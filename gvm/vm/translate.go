@@ -0,0 +1,150 @@
+package vm
+
+import (
+	"github.com/vsartor/gvm/gvm"
+	"github.com/vsartor/gvm/gvm/lang"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// translation is what backends translating a program into another language
+// need to know about its code, which must pass Verify.
+type translation struct {
+	program gvm.Program
+	// Instructions execution may reach, in the order they are laid out
+	instructions []decodedInstruction
+	// Positions jumps and calls lead to
+	targets map[int64]bool
+	// Positions execution resumes from after a `ret`, or after a fault
+	// caught by a handler, sorted
+	resumes []int64
+	// Registers given to `try` to receive fault codes, sorted
+	faultRegisters []gvm.Code
+}
+
+func newTranslation(program gvm.Program) *translation {
+	owners, err := verify(program)
+	if err != nil {
+		gvm.Logger.Criticalf("Refusing to translate: %s.\n", err.Error())
+		os.Exit(1)
+	}
+
+	t := &translation{program: program, targets: make(map[int64]bool)}
+	resumes := make(map[int64]bool)
+	faultRegisters := make(map[gvm.Code]bool)
+	for position := int64(0); position < int64(len(program.Code)); position++ {
+		if owners[position] != position {
+			continue
+		}
+
+		ins, _ := decodeAt(program.Code, position)
+		t.instructions = append(t.instructions, ins)
+
+		target, _ := ins.target()
+		switch ins.instruction {
+		case lang.Call:
+			t.targets[target] = true
+			resumes[ins.next()] = true
+		case lang.Try:
+			resumes[target] = true
+			faultRegisters[ins.operands[1]] = true
+		default:
+			if lang.IsJump(ins.instruction) {
+				t.targets[target] = true
+			}
+		}
+	}
+
+	for position := range resumes {
+		t.resumes = append(t.resumes, position)
+	}
+	sort.Slice(t.resumes, func(i, j int) bool { return t.resumes[i] < t.resumes[j] })
+	for register := range faultRegisters {
+		t.faultRegisters = append(t.faultRegisters, register)
+	}
+	sort.Slice(t.faultRegisters, func(i, j int) bool { return t.faultRegisters[i] < t.faultRegisters[j] })
+
+	return t
+}
+
+// end is the position right after the code, where execution stops.
+func (t *translation) end() int64 {
+	return int64(len(t.program.Code))
+}
+
+// isLabeled reports whether other code leads to the instruction at position,
+// so it needs a label in the translated code.
+func (t *translation) isLabeled(position int64) bool {
+	if t.targets[position] {
+		return true
+	}
+	idx := sort.Search(len(t.resumes), func(i int) bool { return t.resumes[i] >= position })
+	return idx < len(t.resumes) && t.resumes[idx] == position
+}
+
+// location describes a position the same way faults do.
+func (t *translation) location(position int64) string {
+	var source *gvm.Context
+	if ctxt, ok := t.program.Debug.SourceOf(position); ok {
+		source = &ctxt
+	}
+	symbol, _ := t.program.Debug.SymbolOf(position)
+	return formatLocation(position, source, symbol)
+}
+
+// describe disassembles an instruction, for comments in the translated code.
+func (t *translation) describe(ins decodedInstruction) string {
+	text, _ := disassembleInstruction(virtualMachine{debug: t.program.Debug, codePosition: ins.position},
+		t.program.Code)
+	return text
+}
+
+// sortedFaultCodes returns the codes of the faults raised by the virtual
+// machine itself.
+func sortedFaultCodes() []int64 {
+	codes := make([]int64, 0, len(faultDescriptions))
+	for code := range faultDescriptions {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] > codes[j] })
+	return codes
+}
+
+func writeTranslation(dstPath string, source []byte) {
+	gvm.Logger.Infof("Writing '%s'.\n", dstPath)
+	if err := ioutil.WriteFile(dstPath, source, 0644); err != nil {
+		gvm.Logger.Criticalf("Failed writing '%s': %s\n", dstPath, err.Error())
+		os.Exit(1)
+	}
+}
+
+// condition is an expression, valid both in Go and in C, telling whether the
+// condition of a conditional jump, move or set holds for the flags in cmpFlag
+// given the functions isEqual, isLess and isBelow.
+func condition(instruction gvm.Code) string {
+	switch instruction {
+	case lang.Jeq, lang.Cmoveq, lang.Seteq:
+		return "isEqual(cmpFlag)"
+	case lang.Jne, lang.Cmovne, lang.Setne:
+		return "!isEqual(cmpFlag)"
+	case lang.Jgt, lang.Cmovgt, lang.Setgt:
+		return "!isEqual(cmpFlag) && !isLess(cmpFlag)"
+	case lang.Jlt, lang.Cmovlt, lang.Setlt:
+		return "isLess(cmpFlag)"
+	case lang.Jge, lang.Cmovge, lang.Setge:
+		return "!isLess(cmpFlag)"
+	case lang.Jle, lang.Cmovle, lang.Setle:
+		return "isEqual(cmpFlag) || isLess(cmpFlag)"
+	case lang.Jb, lang.Cmovb, lang.Setb:
+		return "isBelow(cmpFlag)"
+	case lang.Ja, lang.Cmova, lang.Seta:
+		return "!isEqual(cmpFlag) && !isBelow(cmpFlag)"
+	case lang.Jbe, lang.Cmovbe, lang.Setbe:
+		return "isEqual(cmpFlag) || isBelow(cmpFlag)"
+	case lang.Jae, lang.Cmovae, lang.Setae:
+		return "!isBelow(cmpFlag)"
+	default:
+		panic("This path should be impossible.")
+	}
+}
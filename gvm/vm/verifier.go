@@ -0,0 +1,120 @@
+package vm
+
+import (
+	"fmt"
+	"github.com/vsartor/gvm/gvm"
+	"github.com/vsartor/gvm/gvm/lang"
+)
+
+// VerificationError is the error returned by Verify, and by Run, for code the
+// virtual machine refuses to run.
+type VerificationError struct {
+	Position int64
+	Reason   string
+	// Source is where the offending instruction was read from, if the program
+	// carries debug information.
+	Source *gvm.Context
+	// Symbol is the position relative to the closest preceding label, if the
+	// program carries debug information.
+	Symbol string
+}
+
+func (err *VerificationError) Error() string {
+	return fmt.Sprintf("%s at %s", err.Reason, formatLocation(err.Position, err.Source, err.Symbol))
+}
+
+func newVerificationError(debug *gvm.DebugInfo, position int64, format string, args ...interface{}) error {
+	err := &VerificationError{Position: position, Reason: fmt.Sprintf(format, args...)}
+	if source, ok := debug.SourceOf(position); ok {
+		err.Source = &source
+	}
+	if symbol, ok := debug.SymbolOf(position); ok {
+		err.Symbol = symbol
+	}
+	return err
+}
+
+// Verify decodes every instruction reachable from the start of the code,
+// checking that its opcode is known, that its operands fit in the code, that
+// its registers exist, that its trap code isn't negative and that the positions
+// it may continue from are the start of an instruction. Code that passes can be
+// run without checking any of this at each step.
+func Verify(program gvm.Program) error {
+	_, err := verify(program)
+	return err
+}
+
+// verify implements Verify, also returning the position of the instruction
+// each word of the code belongs to, or -1 for words that can't be reached.
+func verify(program gvm.Program) ([]int64, error) {
+	code := program.Code
+	end := int64(len(code))
+
+	// Position of the instruction each word of the code belongs to, or -1
+	owners := make([]int64, len(code))
+	for idx := range owners {
+		owners[idx] = -1
+	}
+
+	type pending struct {
+		position int64
+		// Position of the instruction leading to it, or -1 for the start
+		from int64
+	}
+
+	worklist := []pending{{0, -1}}
+	for len(worklist) > 0 {
+		current := worklist[len(worklist)-1]
+		worklist = worklist[:len(worklist)-1]
+		position := current.position
+
+		if position < 0 || position > end {
+			return nil, newVerificationError(program.Debug, current.from,
+				"jump to %d, beyond the bounds of the code", position)
+		}
+		// Running past the end of the code stops the program like `halt`
+		if position == end || owners[position] == position {
+			continue
+		}
+		if owners[position] >= 0 {
+			return nil, newVerificationError(program.Debug, current.from,
+				"jump to %04d, inside the instruction starting at %04d", position, owners[position])
+		}
+
+		kinds, ok := lang.Operands(code[position])
+		if !ok {
+			return nil, newVerificationError(program.Debug, position, "unknown instruction %d", code[position])
+		}
+		if position+int64(len(kinds)) >= end {
+			return nil, newVerificationError(program.Debug, position, "missing operands")
+		}
+		for word := position; word <= position+int64(len(kinds)); word++ {
+			if owners[word] >= 0 {
+				return nil, newVerificationError(program.Debug, position,
+					"instruction overlaps the one at %04d", owners[word])
+			}
+			owners[word] = position
+		}
+
+		ins, _ := decodeAt(code, position)
+		for idx, kind := range ins.kinds {
+			operand := ins.operands[idx]
+			if kind == lang.RegisterOperand && (operand < 0 || int(operand) >= gvm.RegisterCount) {
+				return nil, newVerificationError(program.Debug, position, "register index %d is out of range", operand)
+			}
+		}
+		if ins.instruction == lang.Trap && ins.operands[0] < 0 {
+			return nil, newVerificationError(program.Debug, position,
+				"trap code %d is negative, which is reserved for the GVM's own faults", ins.operands[0])
+		}
+
+		for _, successor := range ins.successors() {
+			worklist = append(worklist, pending{successor, position})
+		}
+		if target, ok := ins.target(); ok && ins.instruction == lang.Call {
+			worklist = append(worklist, pending{target, position})
+		}
+	}
+
+	return owners, nil
+}
@@ -0,0 +1,59 @@
+package vm
+
+import (
+	"github.com/vsartor/gvm/gvm"
+	"github.com/vsartor/gvm/gvm/lang"
+	"strings"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	cases := []struct {
+		name string
+		code []gvm.Code
+		// Start of the reason the code is rejected for and the position it's
+		// reported at, if it is
+		reason   string
+		position int64
+	}{
+		{"valid", []gvm.Code{lang.Const, 5, 1, lang.Show, 1, lang.Halt}, "", 0},
+		{"empty", []gvm.Code{}, "", 0},
+		{"jump to the end", []gvm.Code{lang.Jmp, 2}, "", 0},
+		{"unreachable garbage", []gvm.Code{lang.Halt, 9999, -1}, "", 0},
+		{"unknown instruction", []gvm.Code{lang.Noop, 9999}, "unknown instruction 9999", 1},
+		{"negative instruction", []gvm.Code{-3}, "unknown instruction -3", 0},
+		{"missing operands", []gvm.Code{lang.Noop, lang.Const, 5}, "missing operands", 1},
+		{"jump inside an instruction", []gvm.Code{lang.Const, 5, 1, lang.Jmp, 2}, "jump to 0002, inside", 3},
+		{"call inside an instruction", []gvm.Code{lang.Const, 5, 1, lang.Call, 1}, "jump to 0001, inside", 3},
+		{"handler inside an instruction", []gvm.Code{lang.Const, 5, 1, lang.Try, 1, 1, lang.Endtry},
+			"jump to 0001, inside", 3},
+		{"jump beyond the code", []gvm.Code{lang.Jeq, 10}, "jump to 10, beyond", 0},
+		{"jump before the code", []gvm.Code{lang.Jmp, -2}, "jump to -2, beyond", 0},
+		{"register out of range", []gvm.Code{lang.Inc, gvm.Code(gvm.RegisterCount)},
+			"register index 16 is out of range", 0},
+		{"negative register", []gvm.Code{lang.Mov, 1, -1}, "register index -1 is out of range", 0},
+		{"negative trap code", []gvm.Code{lang.Trap, -1}, "trap code -1 is negative", 0},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			err := Verify(gvm.Program{Code: c.code})
+			if c.reason == "" {
+				if err != nil {
+					t.Errorf("expected the code to be accepted, got %s", err)
+				}
+				return
+			}
+
+			verificationErr, ok := err.(*VerificationError)
+			if !ok {
+				t.Fatalf("expected a verification error, got %v", err)
+			}
+			if !strings.HasPrefix(verificationErr.Reason, c.reason) || verificationErr.Position != c.position {
+				t.Errorf("got %q at %d, expected %q at %d",
+					verificationErr.Reason, verificationErr.Position, c.reason, c.position)
+			}
+		})
+	}
+}
@@ -14,13 +14,118 @@ type virtualMachine struct {
 	stackPtr     int64
 	callStack    []int64
 	callStackPtr int64
+	handlers     []handler
+	handlerPtr   int64
 	reg          []int64
 	codePosition int64
 	cmpFlag      int64
 	errFlag      int64
 	args         []string
+	debug        *gvm.DebugInfo
+	// Byte offsets of the instructions in the compact encoding, only shown
+	// when disassembling
+	offsets map[int64]int64
+	fault   *Fault
 }
 
+func newVirtualMachine(program gvm.Program, args []string) *virtualMachine {
+	return &virtualMachine{
+		stack:        make([]int64, gvm.StackSize),
+		stackPtr:     0,
+		callStack:    make([]int64, gvm.CallStackSize),
+		callStackPtr: 0,
+		handlers:     make([]handler, gvm.HandlerStackSize),
+		handlerPtr:   0,
+		reg:          make([]int64, gvm.RegisterCount),
+		codePosition: 0,
+		cmpFlag:      0,
+		errFlag:      0,
+		args:         args,
+		debug:        program.Debug,
+	}
+}
+
+// isRunning reports whether execution should go on, i.e. the program has not
+// halted, ran past the end of its code or was stopped by a fault.
+func (vm *virtualMachine) isRunning(code []gvm.Code) bool {
+	return vm.fault == nil && vm.codePosition < int64(len(code))
+}
+
+// Flags stored in cmpFlag by the `cmp` instruction, mirroring the ones a
+// hardware ALU would set when subtracting the two operands.
+const (
+	zeroFlag int64 = 1 << iota
+	signFlag
+	carryFlag
+	overflowFlag
+)
+
+// compareFlags computes the flags resulting from the subtraction lhs - rhs.
+func compareFlags(lhs, rhs int64) int64 {
+	diff := lhs - rhs
+	flags := int64(0)
+	if diff == 0 {
+		flags |= zeroFlag
+	}
+	if diff < 0 {
+		flags |= signFlag
+	}
+	if uint64(lhs) < uint64(rhs) {
+		flags |= carryFlag
+	}
+	if (lhs^rhs)&(lhs^diff) < 0 {
+		flags |= overflowFlag
+	}
+	return flags
+}
+
+func (vm *virtualMachine) isEqual() bool {
+	return vm.cmpFlag&zeroFlag != 0
+}
+
+// isLess reports a signed less than, which holds when the sign of the result
+// differs from the overflow flag.
+func (vm *virtualMachine) isLess() bool {
+	return (vm.cmpFlag&signFlag != 0) != (vm.cmpFlag&overflowFlag != 0)
+}
+
+// isBelow reports an unsigned less than, which holds when the subtraction
+// needed to borrow.
+func (vm *virtualMachine) isBelow() bool {
+	return vm.cmpFlag&carryFlag != 0
+}
+
+// conditionHolds evaluates the condition encoded by a conditional jump, move or
+// set instruction against the flags of the last comparison.
+func (vm *virtualMachine) conditionHolds(instruction gvm.Code) bool {
+	switch instruction {
+	case lang.Jeq, lang.Cmoveq, lang.Seteq:
+		return vm.isEqual()
+	case lang.Jne, lang.Cmovne, lang.Setne:
+		return !vm.isEqual()
+	case lang.Jgt, lang.Cmovgt, lang.Setgt:
+		return !vm.isEqual() && !vm.isLess()
+	case lang.Jlt, lang.Cmovlt, lang.Setlt:
+		return vm.isLess()
+	case lang.Jge, lang.Cmovge, lang.Setge:
+		return !vm.isLess()
+	case lang.Jle, lang.Cmovle, lang.Setle:
+		return vm.isEqual() || vm.isLess()
+	case lang.Jb, lang.Cmovb, lang.Setb:
+		return vm.isBelow()
+	case lang.Ja, lang.Cmova, lang.Seta:
+		return !vm.isEqual() && !vm.isBelow()
+	case lang.Jbe, lang.Cmovbe, lang.Setbe:
+		return vm.isEqual() || vm.isBelow()
+	case lang.Jae, lang.Cmovae, lang.Setae:
+		return !vm.isBelow()
+	default:
+		panic("This path should be impossible.")
+	}
+}
+
+// executeStep runs the instruction at the current code position. It relies on
+// the code having been verified, so it doesn't check operands or jump targets.
 func executeStep(vm *virtualMachine, code []gvm.Code) {
 	switch instruction := code[vm.codePosition]; instruction {
 	case lang.Halt:
@@ -32,14 +137,18 @@ func executeStep(vm *virtualMachine, code []gvm.Code) {
 		vm.reg[dstRegIdx] = intConst
 		vm.codePosition += 3
 	case lang.Push:
+		if vm.stackPtr == int64(len(vm.stack)) {
+			vm.raise(FaultStackOverflow)
+			return
+		}
 		srcRegIdx := code[vm.codePosition+1]
 		vm.stack[vm.stackPtr] = vm.reg[srcRegIdx]
 		vm.stackPtr++
 		vm.codePosition += 2
 	case lang.Pop:
 		if vm.stackPtr == 0 {
-			gvm.Logger.Criticalf("Stack underflow.\n")
-			os.Exit(1)
+			vm.raise(FaultStackUnderflow)
+			return
 		}
 		vm.stackPtr--
 		dstRegIdx := code[vm.codePosition+1]
@@ -76,53 +185,101 @@ func executeStep(vm *virtualMachine, code []gvm.Code) {
 	case lang.Div:
 		srcRegIdx := code[vm.codePosition+1]
 		dstRegIdx := code[vm.codePosition+2]
+		if vm.reg[srcRegIdx] == 0 {
+			vm.raise(FaultDivisionByZero)
+			return
+		}
 		vm.reg[dstRegIdx] /= vm.reg[srcRegIdx]
 		vm.codePosition += 3
 	case lang.Rem:
 		srcRegIdx := code[vm.codePosition+1]
 		dstRegIdx := code[vm.codePosition+2]
+		if vm.reg[srcRegIdx] == 0 {
+			vm.raise(FaultDivisionByZero)
+			return
+		}
 		vm.reg[dstRegIdx] %= vm.reg[srcRegIdx]
 		vm.codePosition += 3
 	case lang.Cmp:
 		srcRegIdx := code[vm.codePosition+1]
 		dstRegIdx := code[vm.codePosition+2]
-		vm.cmpFlag = vm.reg[dstRegIdx] - vm.reg[srcRegIdx]
-		vm.cmpFlag = vm.reg[code[vm.codePosition+2]] - vm.reg[code[vm.codePosition+1]]
+		vm.cmpFlag = compareFlags(vm.reg[dstRegIdx], vm.reg[srcRegIdx])
 		vm.codePosition += 3
+	case lang.Cmoveq, lang.Cmovne, lang.Cmovgt, lang.Cmovlt, lang.Cmovge, lang.Cmovle,
+		lang.Cmovb, lang.Cmova, lang.Cmovbe, lang.Cmovae:
+		srcRegIdx := code[vm.codePosition+1]
+		dstRegIdx := code[vm.codePosition+2]
+		if vm.conditionHolds(instruction) {
+			vm.reg[dstRegIdx] = vm.reg[srcRegIdx]
+		}
+		vm.codePosition += 3
+	case lang.Seteq, lang.Setne, lang.Setgt, lang.Setlt, lang.Setge, lang.Setle,
+		lang.Setb, lang.Seta, lang.Setbe, lang.Setae:
+		dstRegIdx := code[vm.codePosition+1]
+		if vm.conditionHolds(instruction) {
+			vm.reg[dstRegIdx] = 1
+		} else {
+			vm.reg[dstRegIdx] = 0
+		}
+		vm.codePosition += 2
 	case lang.Jmp:
 		vm.codePosition = int64(code[vm.codePosition+1])
 	case lang.Jeq:
-		if vm.cmpFlag == 0 {
+		if vm.isEqual() {
 			vm.codePosition = int64(code[vm.codePosition+1])
 		} else {
 			vm.codePosition += 2
 		}
 	case lang.Jne:
-		if vm.cmpFlag != 0 {
+		if !vm.isEqual() {
 			vm.codePosition = int64(code[vm.codePosition+1])
 		} else {
 			vm.codePosition += 2
 		}
 	case lang.Jgt:
-		if vm.cmpFlag > 0 {
+		if !vm.isEqual() && !vm.isLess() {
 			vm.codePosition = int64(code[vm.codePosition+1])
 		} else {
 			vm.codePosition += 2
 		}
 	case lang.Jlt:
-		if vm.cmpFlag < 0 {
+		if vm.isLess() {
 			vm.codePosition = int64(code[vm.codePosition+1])
 		} else {
 			vm.codePosition += 2
 		}
 	case lang.Jge:
-		if vm.cmpFlag >= 0 {
+		if !vm.isLess() {
 			vm.codePosition = int64(code[vm.codePosition+1])
 		} else {
 			vm.codePosition += 2
 		}
 	case lang.Jle:
-		if vm.cmpFlag <= 0 {
+		if vm.isEqual() || vm.isLess() {
+			vm.codePosition = int64(code[vm.codePosition+1])
+		} else {
+			vm.codePosition += 2
+		}
+	case lang.Jb:
+		if vm.isBelow() {
+			vm.codePosition = int64(code[vm.codePosition+1])
+		} else {
+			vm.codePosition += 2
+		}
+	case lang.Ja:
+		if !vm.isEqual() && !vm.isBelow() {
+			vm.codePosition = int64(code[vm.codePosition+1])
+		} else {
+			vm.codePosition += 2
+		}
+	case lang.Jbe:
+		if vm.isEqual() || vm.isBelow() {
+			vm.codePosition = int64(code[vm.codePosition+1])
+		} else {
+			vm.codePosition += 2
+		}
+	case lang.Jae:
+		if !vm.isBelow() {
 			vm.codePosition = int64(code[vm.codePosition+1])
 		} else {
 			vm.codePosition += 2
@@ -140,19 +297,23 @@ func executeStep(vm *virtualMachine, code []gvm.Code) {
 		vm.codePosition += 2
 	case lang.Call:
 		if vm.callStackPtr == int64(len(vm.callStack)) {
-			gvm.Logger.Criticalf("Call stack overflow.\n")
-			os.Exit(1)
+			vm.raise(FaultCallStackOverflow)
+			return
 		}
 		vm.callStack[vm.callStackPtr] = vm.codePosition + 2
 		vm.codePosition = int64(code[vm.codePosition+1])
 		vm.callStackPtr++
 	case lang.Ret:
 		if vm.callStackPtr == 0 {
-			gvm.Logger.Criticalf("Call stack underflow.\n")
-			os.Exit(1)
+			vm.raise(FaultCallStackUnderflow)
+			return
 		}
 		vm.callStackPtr--
 		vm.codePosition = vm.callStack[vm.callStackPtr]
+		// Handlers installed by the returning routine go out of scope
+		for vm.handlerPtr > 0 && vm.handlers[vm.handlerPtr-1].callStackPtr > vm.callStackPtr {
+			vm.handlerPtr--
+		}
 	case lang.Noop:
 		vm.codePosition++
 	case lang.Iarg:
@@ -164,19 +325,90 @@ func executeStep(vm *virtualMachine, code []gvm.Code) {
 			value, err := strconv.ParseInt(vm.args[argIdx], 10, 64)
 			if err != nil {
 				vm.errFlag = 1
+			} else if vm.stackPtr == int64(len(vm.stack)) {
+				vm.raise(FaultStackOverflow)
+				return
 			} else {
 				vm.stack[vm.stackPtr] = value
 				vm.stackPtr++
 			}
 		}
 		vm.codePosition += 2
+	case lang.Assert:
+		srcRegIdx := code[vm.codePosition+1]
+		if vm.reg[srcRegIdx] == 0 {
+			vm.raise(FaultAssertion)
+			return
+		}
+		vm.codePosition += 2
+	case lang.Trap:
+		vm.throw(int64(code[vm.codePosition+1]))
+	case lang.Try:
+		if vm.handlerPtr == int64(len(vm.handlers)) {
+			vm.raise(FaultHandlerStackOverflow)
+			return
+		}
+		vm.handlers[vm.handlerPtr] = handler{
+			position:     int64(code[vm.codePosition+1]),
+			codeRegIdx:   code[vm.codePosition+2],
+			callStackPtr: vm.callStackPtr,
+			stackPtr:     vm.stackPtr,
+		}
+		vm.handlerPtr++
+		vm.codePosition += 3
+	case lang.Endtry:
+		if vm.handlerPtr == 0 || vm.handlers[vm.handlerPtr-1].callStackPtr != vm.callStackPtr {
+			vm.raise(FaultUnmatchedEndtry)
+			return
+		}
+		vm.handlerPtr--
+		vm.codePosition++
+	case lang.Throw:
+		srcRegIdx := code[vm.codePosition+1]
+		vm.throw(vm.reg[srcRegIdx])
 	default:
-		gvm.Logger.Criticalf("Unexpected instruction code %d.\n", code[vm.codePosition])
-		os.Exit(1)
+		gvm.Logger.Debugf("Unexpected instruction code %d.\n", code[vm.codePosition])
+		vm.raise(FaultUnknownInstruction)
+	}
+}
+
+// Run executes a program until it halts. Programs that don't pass Verify are
+// not run, returning a *VerificationError. If execution is stopped by a fault,
+// it is returned as a *Fault.
+func Run(program gvm.Program, args []string) error {
+	owners, err := verify(program)
+	if err != nil {
+		return err
+	}
+
+	vm := newVirtualMachine(program, args)
+	decodeStream(vm, program.Code, owners).run(vm)
+
+	if vm.fault != nil {
+		return vm.fault
 	}
+	return nil
 }
 
-func Execute(filePath string, args []string) {
+// loadProgram reads a program given either as a binary file or as the source
+// files to compile.
+func loadProgram(filePaths []string, options compiler.Options) gvm.Program {
+	if len(filePaths) == 1 && compiler.IsBinaryFile(filePaths[0]) {
+		gvm.Logger.Infof("Opening file '%s'.\n", filePaths[0])
+		file, err := os.Open(filePaths[0])
+		if err != nil {
+			gvm.Logger.Criticalf("Failed opening '%s': %s\n", filePaths[0], err.Error())
+			os.Exit(1)
+		}
+		defer file.Close()
+
+		return compiler.ReadCode(file)
+	}
+
+	return compiler.Build(filePaths, options)
+}
+
+func Execute(filePath string, args []string, options RunOptions) {
 	gvm.Logger.Infof("Starting to disassemble.\n")
 
 	gvm.Logger.Infof("Opening file '%s'.\n", filePath)
@@ -187,23 +419,21 @@ func Execute(filePath string, args []string) {
 	}
 	defer file.Close()
 
-	code := compiler.ReadCode(file)
+	program := compiler.ReadCode(file)
 
 	gvm.Logger.Infof("Starting execution.\n")
 
-	vm := virtualMachine{
-		stack:        make([]int64, gvm.StackSize),
-		stackPtr:     0,
-		callStack:    make([]int64, gvm.CallStackSize),
-		callStackPtr: 0,
-		reg:          make([]int64, gvm.RegisterCount),
-		codePosition: 0,
-		cmpFlag:      0,
-		errFlag:      0,
-		args:         args,
+	if options.instrumented() {
+		err = RunInstrumented(program, filePath, args, options)
+	} else {
+		err = Run(program, args)
 	}
-
-	for vm.codePosition < int64(len(code)) {
-		executeStep(&vm, code)
+	if err != nil {
+		if _, ok := err.(*VerificationError); ok {
+			gvm.Logger.Criticalf("Refusing to run '%s': %s.\n", filePath, err.Error())
+		} else {
+			gvm.Logger.Criticalf("Execution stopped: %s.\n", err.Error())
+		}
+		os.Exit(1)
 	}
 }
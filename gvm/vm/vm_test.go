@@ -0,0 +1,114 @@
+package vm
+
+import (
+	"fmt"
+	"github.com/vsartor/gvm/gvm/lang"
+	"math"
+	"testing"
+)
+
+// comparedValues are compared with each other in every way, including the ones
+// whose subtraction overflows or whose order differs when taken as unsigned.
+var comparedValues = []int64{math.MinInt64, math.MinInt64 + 1, -2, -1, 0, 1, 2, math.MaxInt64 - 1, math.MaxInt64}
+
+// conditions are the suffixes of the conditional jumps, moves and sets along
+// with what they test about the operands of the last comparison.
+var conditions = []struct {
+	suffix string
+	holds  func(lhs, rhs int64) bool
+}{
+	{"eq", func(lhs, rhs int64) bool { return lhs == rhs }},
+	{"ne", func(lhs, rhs int64) bool { return lhs != rhs }},
+	{"gt", func(lhs, rhs int64) bool { return lhs > rhs }},
+	{"lt", func(lhs, rhs int64) bool { return lhs < rhs }},
+	{"ge", func(lhs, rhs int64) bool { return lhs >= rhs }},
+	{"le", func(lhs, rhs int64) bool { return lhs <= rhs }},
+	{"b", func(lhs, rhs int64) bool { return uint64(lhs) < uint64(rhs) }},
+	{"a", func(lhs, rhs int64) bool { return uint64(lhs) > uint64(rhs) }},
+	{"be", func(lhs, rhs int64) bool { return uint64(lhs) <= uint64(rhs) }},
+	{"ae", func(lhs, rhs int64) bool { return uint64(lhs) >= uint64(rhs) }},
+}
+
+func TestCompareFlags(t *testing.T) {
+	cases := []struct {
+		lhs, rhs int64
+		flags    int64
+	}{
+		{0, 0, zeroFlag},
+		{2, 1, 0},
+		{1, 2, signFlag | carryFlag},
+		{-1, 1, signFlag},
+		{1, -1, carryFlag},
+		{-1, -1, zeroFlag},
+		{math.MinInt64, 1, overflowFlag},
+		{math.MaxInt64, -1, signFlag | carryFlag | overflowFlag},
+		{math.MinInt64, math.MaxInt64, overflowFlag},
+		{math.MaxInt64, math.MinInt64, signFlag | carryFlag | overflowFlag},
+		{math.MinInt64, math.MinInt64, zeroFlag},
+		{0, math.MinInt64, signFlag | carryFlag | overflowFlag},
+	}
+
+	for _, c := range cases {
+		if flags := compareFlags(c.lhs, c.rhs); flags != c.flags {
+			t.Errorf("compareFlags(%d, %d) = %04b, expected %04b", c.lhs, c.rhs, flags, c.flags)
+		}
+	}
+}
+
+func TestConditionalJumps(t *testing.T) {
+	for _, condition := range conditions {
+		jump, err := lang.ParseInstruction("j" + condition.suffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, lhs := range comparedValues {
+			for _, rhs := range comparedValues {
+				vm := virtualMachine{cmpFlag: compareFlags(lhs, rhs)}
+				if holds := vm.conditionHolds(jump); holds != condition.holds(lhs, rhs) {
+					t.Errorf("j%s after comparing %d with %d: %v", condition.suffix, lhs, rhs, holds)
+				}
+			}
+		}
+	}
+
+	// The same when running programs, where the stream fuses `cmp` with the
+	// jump. Comparing r1 with r2 looks at r2 - r1.
+	for _, condition := range conditions {
+		for _, lhs := range comparedValues {
+			for _, rhs := range comparedValues {
+				source := fmt.Sprintf("main:\nconst %d r2\nconst %d r1\ncmp r1 r2\nj%s .taken\nhalt\n"+
+					".taken:\nconst 1 r3\n", lhs, rhs, condition.suffix)
+				vm, _ := runBothWays(t, compileSource(t, source))
+				if taken := vm.reg[3] == 1; taken != condition.holds(lhs, rhs) {
+					t.Errorf("j%s after comparing %d with %d: %v", condition.suffix, lhs, rhs, taken)
+				}
+			}
+		}
+	}
+}
+
+func TestConditionalMoveAndSet(t *testing.T) {
+	for _, condition := range conditions {
+		for _, lhs := range comparedValues {
+			for _, rhs := range comparedValues {
+				// Neither instruction changes the flags, so both see the same comparison
+				source := fmt.Sprintf("const %d r2\nconst %d r1\nconst 7 r3\nconst 9 r4\ncmp r1 r2\n"+
+					"cmov%s r3 r4\nset%s r5\n", lhs, rhs, condition.suffix, condition.suffix)
+				vm, _ := runBothWays(t, compileSource(t, source))
+
+				moved, set := int64(9), int64(0)
+				if condition.holds(lhs, rhs) {
+					moved, set = 7, 1
+				}
+				if vm.reg[4] != moved || vm.reg[5] != set {
+					t.Errorf("cmov%s and set%s after comparing %d with %d gave %d and %d, expected %d and %d",
+						condition.suffix, condition.suffix, lhs, rhs, vm.reg[4], vm.reg[5], moved, set)
+				}
+				if vm.cmpFlag != compareFlags(lhs, rhs) {
+					t.Errorf("cmov%s and set%s changed the flags", condition.suffix, condition.suffix)
+				}
+			}
+		}
+	}
+}
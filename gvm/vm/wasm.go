@@ -0,0 +1,348 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// wasmOp is a WebAssembly instruction, which can be written both in the text
+// and in the binary format.
+type wasmOp struct {
+	name string
+	// Local, function or label the instruction refers to, or the label of the
+	// block it opens
+	ref string
+	// Targets of a br_table, the last one being the default
+	labels []string
+	// Constant, or memory offset of loads and stores
+	value int64
+	// Blocks which don't indent their contents in the text format
+	flat bool
+}
+
+func wasmPlain(name string) wasmOp              { return wasmOp{name: name} }
+func wasmRef(name, ref string) wasmOp           { return wasmOp{name: name, ref: ref} }
+func wasmValue(name string, value int64) wasmOp { return wasmOp{name: name, value: value} }
+func wasmComment(text string) wasmOp            { return wasmOp{name: ";;", ref: text} }
+
+// wasmLocal is a parameter or a local variable of a function.
+type wasmLocal struct {
+	name      string
+	valueType string
+}
+
+// wasmFunction is either imported, when it has no body, or defined.
+type wasmFunction struct {
+	name    string
+	module  string
+	export  string
+	params  []wasmLocal
+	results []string
+	locals  []wasmLocal
+	body    []wasmOp
+}
+
+// wasmData is a segment of data initializing memory at an address.
+type wasmData struct {
+	at   int64
+	data string
+}
+
+// wasmModule is a module with a single exported memory.
+type wasmModule struct {
+	// Imported functions must come before the defined ones
+	functions []wasmFunction
+	pages     int
+	data      []wasmData
+}
+
+var wasmOpcodes = map[string]byte{
+	"unreachable": 0x00, "block": 0x02, "loop": 0x03, "if": 0x04, "else": 0x05, "end": 0x0b,
+	"br": 0x0c, "br_if": 0x0d, "br_table": 0x0e, "return": 0x0f, "call": 0x10,
+	"local.get": 0x20, "local.set": 0x21,
+	"i32.load": 0x28, "i64.load": 0x29, "i32.store": 0x36, "i64.store": 0x37,
+	"i32.const": 0x41, "i64.const": 0x42,
+	"i32.eqz": 0x45, "i32.eq": 0x46, "i32.ne": 0x47, "i32.le_s": 0x4c,
+	"i64.eqz": 0x50, "i64.eq": 0x51, "i64.lt_s": 0x53, "i64.lt_u": 0x54,
+	"i32.add": 0x6a, "i32.sub": 0x6b, "i32.and": 0x71, "i32.or": 0x72, "i32.shl": 0x74, "i32.shr_u": 0x76,
+	"i64.add": 0x7c, "i64.sub": 0x7d, "i64.mul": 0x7e, "i64.div_s": 0x7f, "i64.rem_s": 0x81,
+	"i64.and": 0x83, "i64.xor": 0x85, "i64.extend_i32_u": 0xad,
+}
+
+var wasmValueTypes = map[string]byte{"i32": 0x7f, "i64": 0x7e}
+
+// Alignment of loads and stores, as a power of two
+var wasmAlignments = map[string]uint64{"i32.load": 2, "i64.load": 3, "i32.store": 2, "i64.store": 3}
+
+// wasmQuote writes data as a string in the text format.
+func wasmQuote(data string) string {
+	var quoted strings.Builder
+	quoted.WriteByte('"')
+	for _, c := range []byte(data) {
+		if c < ' ' || c > '~' || c == '"' || c == '\\' {
+			fmt.Fprintf(&quoted, "\\%02x", c)
+		} else {
+			quoted.WriteByte(c)
+		}
+	}
+	quoted.WriteByte('"')
+	return quoted.String()
+}
+
+func (function *wasmFunction) signature() string {
+	var sig strings.Builder
+	for _, param := range function.params {
+		fmt.Fprintf(&sig, " (param $%s %s)", param.name, param.valueType)
+	}
+	if len(function.results) > 0 {
+		fmt.Fprintf(&sig, " (result %s)", strings.Join(function.results, " "))
+	}
+	return sig.String()
+}
+
+// text writes the module in the text format.
+func (module *wasmModule) text() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("(module\n")
+	for _, function := range module.functions {
+		if function.module != "" {
+			fmt.Fprintf(&buf, "  (import %q %q (func $%s%s))\n",
+				function.module, function.name, function.name, function.signature())
+		}
+	}
+	fmt.Fprintf(&buf, "  (memory (export \"memory\") %d)\n", module.pages)
+	for _, segment := range module.data {
+		fmt.Fprintf(&buf, "  (data (i32.const %d) %s)\n", segment.at, wasmQuote(segment.data))
+	}
+
+	for _, function := range module.functions {
+		if function.module != "" {
+			continue
+		}
+		fmt.Fprintf(&buf, "\n  (func $%s", function.name)
+		if function.export != "" {
+			fmt.Fprintf(&buf, " (export %q)", function.export)
+		}
+		fmt.Fprintf(&buf, "%s\n", function.signature())
+		for _, local := range function.locals {
+			fmt.Fprintf(&buf, "    (local $%s %s)\n", local.name, local.valueType)
+		}
+
+		depth := 2
+		for _, op := range function.body {
+			if (op.name == "end" || op.name == "else") && !op.flat {
+				depth--
+			}
+			buf.WriteString(strings.Repeat("  ", depth))
+			switch op.name {
+			case ";;":
+				fmt.Fprintf(&buf, ";; %s", op.ref)
+			case "i32.const", "i64.const":
+				fmt.Fprintf(&buf, "%s %d", op.name, op.value)
+			case "i32.load", "i64.load", "i32.store", "i64.store":
+				buf.WriteString(op.name)
+				if op.value != 0 {
+					fmt.Fprintf(&buf, " offset=%d", op.value)
+				}
+			case "br_table":
+				fmt.Fprintf(&buf, "%s $%s", op.name, strings.Join(op.labels, " $"))
+			case "block", "loop", "if", "end", "br", "br_if", "call", "local.get", "local.set":
+				buf.WriteString(op.name)
+				if op.ref != "" {
+					fmt.Fprintf(&buf, " $%s", op.ref)
+				}
+			default:
+				buf.WriteString(op.name)
+			}
+			buf.WriteByte('\n')
+			if (op.name == "block" || op.name == "loop" || op.name == "if" || op.name == "else") && !op.flat {
+				depth++
+			}
+		}
+		buf.WriteString("  )\n")
+	}
+	buf.WriteString(")\n")
+	return buf.Bytes()
+}
+
+func appendUnsigned(buf []byte, value uint64) []byte {
+	for {
+		b := byte(value & 0x7f)
+		value >>= 7
+		if value == 0 {
+			return append(buf, b)
+		}
+		buf = append(buf, b|0x80)
+	}
+}
+
+func appendSigned(buf []byte, value int64) []byte {
+	for {
+		b := byte(value & 0x7f)
+		value >>= 7
+		if (value == 0 && b&0x40 == 0) || (value == -1 && b&0x40 != 0) {
+			return append(buf, b)
+		}
+		buf = append(buf, b|0x80)
+	}
+}
+
+func appendName(buf []byte, name string) []byte {
+	return append(appendUnsigned(buf, uint64(len(name))), name...)
+}
+
+func appendSection(buf []byte, id byte, contents []byte) []byte {
+	buf = append(buf, id)
+	buf = appendUnsigned(buf, uint64(len(contents)))
+	return append(buf, contents...)
+}
+
+func appendValueTypes(buf []byte, types []string) []byte {
+	buf = appendUnsigned(buf, uint64(len(types)))
+	for _, valueType := range types {
+		buf = append(buf, wasmValueTypes[valueType])
+	}
+	return buf
+}
+
+// code encodes the body of a defined function.
+func (function *wasmFunction) code(functionIndices map[string]int) []byte {
+	localIndices := make(map[string]int)
+	for idx, param := range function.params {
+		localIndices[param.name] = idx
+	}
+	for idx, local := range function.locals {
+		localIndices[local.name] = len(function.params) + idx
+	}
+
+	var body []byte
+	body = appendUnsigned(body, uint64(len(function.locals)))
+	for _, local := range function.locals {
+		body = appendUnsigned(body, 1)
+		body = append(body, wasmValueTypes[local.valueType])
+	}
+
+	// Branches refer to the blocks they leave by how deeply they are nested
+	var labels []string
+	depth := func(label string) uint64 {
+		for idx := len(labels) - 1; idx >= 0; idx-- {
+			if labels[idx] == label {
+				return uint64(len(labels) - 1 - idx)
+			}
+		}
+		panic("This path should be impossible.")
+	}
+
+	for _, op := range function.body {
+		if op.name == ";;" {
+			continue
+		}
+		body = append(body, wasmOpcodes[op.name])
+		switch op.name {
+		case "block", "loop", "if":
+			body = append(body, 0x40)
+			labels = append(labels, op.ref)
+		case "end":
+			labels = labels[:len(labels)-1]
+		case "br", "br_if":
+			body = appendUnsigned(body, depth(op.ref))
+		case "br_table":
+			body = appendUnsigned(body, uint64(len(op.labels)-1))
+			for _, label := range op.labels {
+				body = appendUnsigned(body, depth(label))
+			}
+		case "call":
+			body = appendUnsigned(body, uint64(functionIndices[op.ref]))
+		case "local.get", "local.set":
+			body = appendUnsigned(body, uint64(localIndices[op.ref]))
+		case "i32.const":
+			body = appendSigned(body, int64(int32(op.value)))
+		case "i64.const":
+			body = appendSigned(body, op.value)
+		case "i32.load", "i64.load", "i32.store", "i64.store":
+			body = appendUnsigned(body, wasmAlignments[op.name])
+			body = appendUnsigned(body, uint64(op.value))
+		}
+	}
+	body = append(body, wasmOpcodes["end"])
+
+	return append(appendUnsigned(nil, uint64(len(body))), body...)
+}
+
+// binary writes the module in the binary format.
+func (module *wasmModule) binary() []byte {
+	buf := []byte("\x00asm")
+	buf = append(buf, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(buf[4:], 1)
+
+	// Functions with the same signature share their type
+	var types []byte
+	typeIndices := make(map[string]int)
+	functionIndices := make(map[string]int)
+	for idx, function := range module.functions {
+		functionIndices[function.name] = idx
+		sig := function.signature()
+		if _, ok := typeIndices[sig]; ok {
+			continue
+		}
+		typeIndices[sig] = len(typeIndices)
+		types = append(types, 0x60)
+		params := make([]string, len(function.params))
+		for idx, param := range function.params {
+			params[idx] = param.valueType
+		}
+		types = appendValueTypes(types, params)
+		types = appendValueTypes(types, function.results)
+	}
+	buf = appendSection(buf, 1, append(appendUnsigned(nil, uint64(len(typeIndices))), types...))
+
+	var imports, defined, code []byte
+	importCount, definedCount := 0, 0
+	for _, function := range module.functions {
+		if function.module != "" {
+			importCount++
+			imports = appendName(imports, function.module)
+			imports = appendName(imports, function.name)
+			imports = append(imports, 0x00)
+			imports = appendUnsigned(imports, uint64(typeIndices[function.signature()]))
+		} else {
+			definedCount++
+			defined = appendUnsigned(defined, uint64(typeIndices[function.signature()]))
+			code = append(code, function.code(functionIndices)...)
+		}
+	}
+	buf = appendSection(buf, 2, append(appendUnsigned(nil, uint64(importCount)), imports...))
+	buf = appendSection(buf, 3, append(appendUnsigned(nil, uint64(definedCount)), defined...))
+
+	memory := appendUnsigned([]byte{1, 0x00}, uint64(module.pages))
+	buf = appendSection(buf, 5, memory)
+
+	var exports []byte
+	exportCount := 1
+	exports = appendName(exports, "memory")
+	exports = append(exports, 0x02, 0x00)
+	for _, function := range module.functions {
+		if function.export != "" {
+			exportCount++
+			exports = appendName(exports, function.export)
+			exports = append(exports, 0x00)
+			exports = appendUnsigned(exports, uint64(functionIndices[function.name]))
+		}
+	}
+	buf = appendSection(buf, 7, append(appendUnsigned(nil, uint64(exportCount)), exports...))
+
+	buf = appendSection(buf, 10, append(appendUnsigned(nil, uint64(definedCount)), code...))
+
+	data := appendUnsigned(nil, uint64(len(module.data)))
+	for _, segment := range module.data {
+		data = append(data, 0x00, wasmOpcodes["i32.const"])
+		data = appendSigned(data, segment.at)
+		data = append(data, wasmOpcodes["end"])
+		data = appendName(data, segment.data)
+	}
+	buf = appendSection(buf, 11, data)
+
+	return buf
+}
@@ -9,6 +9,7 @@ import (
 	"os"
 	"path"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -19,6 +20,134 @@ func init() {
 	appLogger.SetLogLevel(loggo.INFO)
 }
 
+// Flags accepted by the commands that compile source files
+var compilerFlags = map[string]bool{
+	"-I": true,
+	"-O": false,
+}
+
+// Flags accepted by the `compile` command, which may also produce object files
+var compileCommandFlags = map[string]bool{
+	"-I": true,
+	"-c": false,
+	"-O": false,
+}
+
+// Flags accepted by the `graph` command
+var graphFlags = map[string]bool{
+	"-I":       true,
+	"-O":       false,
+	"--format": true,
+}
+
+// Flags accepted by the `aot` command
+var aotFlags = map[string]bool{
+	"-I":        true,
+	"-O":        false,
+	"-o":        true,
+	"--package": true,
+}
+
+// Flags accepted by the `emit-c` command
+var emitCFlags = map[string]bool{
+	"-I": true,
+	"-O": false,
+	"-o": true,
+}
+
+// Flags accepted by the `emit-wasm` command
+var emitWasmFlags = map[string]bool{
+	"-I":       true,
+	"-O":       false,
+	"-o":       true,
+	"--format": true,
+}
+
+// Flags accepted by the `run` command
+var runFlags = map[string]bool{
+	"--profile":     true,
+	"--top":         true,
+	"--coverage":    true,
+	"--trace":       true,
+	"--trace-steps": true,
+	"--trace-range": true,
+}
+
+// Flags accepted by the `cover` command
+var coverFlags = map[string]bool{
+	"--html": true,
+}
+
+var linkerFlags = map[string]bool{
+	"-o": true,
+	"-O": false,
+}
+
+func compilerOptions(flags map[string][]string) compiler.Options {
+	_, object := flags["-c"]
+	_, optimize := flags["-O"]
+	return compiler.Options{IncludeDirs: flags["-I"], Object: object, Optimize: optimize}
+}
+
+// splitSpan splits the value of a flag like `<start>:<end>`, either being
+// possibly empty.
+func splitSpan(flag string, value string) (string, string) {
+	sep := strings.Index(value, ":")
+	if sep < 0 {
+		appLogger.Criticalf("Expected '<start>:<end>' after '%s', got '%s'.\n", flag, value)
+		os.Exit(1)
+	}
+	return value[:sep], value[sep+1:]
+}
+
+func runOptions(flags map[string][]string) vm.RunOptions {
+	options := vm.RunOptions{}
+	if len(flags["--profile"]) == 1 {
+		options.Profile = flags["--profile"][0]
+	}
+	if len(flags["--top"]) == 1 {
+		top, err := strconv.Atoi(flags["--top"][0])
+		if err != nil || top <= 0 {
+			appLogger.Criticalf("Expected a positive number after '--top', got '%s'.\n", flags["--top"][0])
+			os.Exit(1)
+		}
+		options.Top = top
+	}
+	if len(flags["--coverage"]) == 1 {
+		options.Coverage = flags["--coverage"][0]
+	}
+
+	if len(flags["--trace"]) == 1 {
+		options.Trace = flags["--trace"][0]
+	} else if len(flags["--trace-steps"])+len(flags["--trace-range"]) > 0 {
+		appLogger.Criticalf("Expected '--trace <trace_path>' along with '--trace-steps' and '--trace-range'.\n")
+		os.Exit(1)
+	}
+	if len(flags["--trace-steps"]) == 1 {
+		first, last := splitSpan("--trace-steps", flags["--trace-steps"][0])
+		step := func(value string) int64 {
+			if value == "" {
+				return 0
+			}
+			step, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || step < 0 {
+				appLogger.Criticalf("Expected a step number in '--trace-steps', got '%s'.\n", value)
+				os.Exit(1)
+			}
+			return step
+		}
+		options.TraceFilter.FirstStep, options.TraceFilter.LastStep = step(first), step(last)
+		if last != "" && options.TraceFilter.LastStep <= options.TraceFilter.FirstStep {
+			appLogger.Criticalf("Expected '--trace-steps' to end after it starts, got '%s'.\n", flags["--trace-steps"][0])
+			os.Exit(1)
+		}
+	}
+	if len(flags["--trace-range"]) == 1 {
+		options.TraceFilter.From, options.TraceFilter.To = splitSpan("--trace-range", flags["--trace-range"][0])
+	}
+	return options
+}
+
 func currentTimestamp() string {
 	nanoseconds := time.Now().UnixNano()
 	return strconv.FormatInt(nanoseconds, 10)
@@ -56,18 +185,98 @@ func main() {
 	// Dispatch into the correct routine
 	switch runMode := args[0]; runMode {
 	case "c", "compile":
-		if len(args) != 3 {
-			appLogger.Criticalf("Expected two files after 'compile': <source_path>, <object_path>\n")
+		files, flags := parseFlags(args[1:], compileCommandFlags, true)
+		if len(files) < 2 {
+			appLogger.Criticalf("Expected at least two files after 'compile': <source_path>..., <object_path>\n")
 			os.Exit(1)
 		}
-		compiler.Compile(args[1], args[2])
+		compiler.Compile(files[:len(files)-1], files[len(files)-1], compilerOptions(flags))
+
+	case "link":
+		files, flags := parseFlags(args[1:], linkerFlags, true)
+		if len(files) == 0 || len(flags["-o"]) != 1 {
+			appLogger.Criticalf("Expected object files and an output after 'link': <object_path>..., -o <binary_path>\n")
+			os.Exit(1)
+		}
+		compiler.Link(files, flags["-o"][0], compilerOptions(flags))
 
 	case "r", "run":
-		if len(args) < 2 {
-			appLogger.Criticalf("Expected one file after 'run': <object_path>\n")
+		files, flags := parseFlags(args[1:], runFlags, false)
+		repeated := false
+		for flag := range flags {
+			repeated = repeated || len(flags[flag]) > 1
+		}
+		if len(files) < 1 || repeated {
+			appLogger.Criticalf("Expected one file after 'run': [--profile <prof_path>] [--top <n>] [--coverage <cov_path>] [--trace <trace_path>] <object_path>\n")
+			os.Exit(1)
+		}
+		vm.Execute(files[0], files[1:], runOptions(flags))
+
+	case "cover":
+		files, flags := parseFlags(args[1:], coverFlags, true)
+		if len(files) == 0 || len(flags["--html"]) > 1 {
+			appLogger.Criticalf("Expected coverage files after 'cover': <cov_path>... [--html <html_path>]\n")
+			os.Exit(1)
+		}
+		htmlPath := ""
+		if len(flags["--html"]) == 1 {
+			htmlPath = flags["--html"][0]
+		}
+		vm.Cover(files, htmlPath)
+
+	case "lint":
+		files, flags := parseFlags(args[1:], compilerFlags, true)
+		if len(files) == 0 {
+			appLogger.Criticalf("Expected a compiled file or source files after 'lint': <path>...\n")
+			os.Exit(1)
+		}
+		if vm.Lint(files, compilerOptions(flags)) > 0 {
 			os.Exit(1)
 		}
-		vm.Execute(args[1], args[2:])
+
+	case "graph":
+		files, flags := parseFlags(args[1:], graphFlags, true)
+		if len(files) == 0 || len(flags["--format"]) > 1 {
+			appLogger.Criticalf("Expected a compiled file or source files after 'graph': <path>... [--format dot|json]\n")
+			os.Exit(1)
+		}
+		format := "dot"
+		if len(flags["--format"]) == 1 {
+			format = flags["--format"][0]
+		}
+		vm.Graph(files, compilerOptions(flags), format)
+
+	case "aot":
+		files, flags := parseFlags(args[1:], aotFlags, true)
+		if len(files) == 0 || len(flags["-o"]) != 1 || len(flags["--package"]) > 1 {
+			appLogger.Criticalf("Expected a compiled file or source files and an output after 'aot': <path>..., -o <go_path>\n")
+			os.Exit(1)
+		}
+		pkg := ""
+		if len(flags["--package"]) == 1 {
+			pkg = flags["--package"][0]
+		}
+		vm.TranslateToGo(files, compilerOptions(flags), flags["-o"][0], pkg)
+
+	case "emit-c":
+		files, flags := parseFlags(args[1:], emitCFlags, true)
+		if len(files) == 0 || len(flags["-o"]) != 1 {
+			appLogger.Criticalf("Expected a compiled file or source files and an output after 'emit-c': <path>..., -o <c_path>\n")
+			os.Exit(1)
+		}
+		vm.TranslateToC(files, compilerOptions(flags), flags["-o"][0])
+
+	case "emit-wasm":
+		files, flags := parseFlags(args[1:], emitWasmFlags, true)
+		if len(files) == 0 || len(flags["-o"]) != 1 || len(flags["--format"]) > 1 {
+			appLogger.Criticalf("Expected a compiled file or source files and an output after 'emit-wasm': <path>..., -o <wasm_path> [--format wasm|wat]\n")
+			os.Exit(1)
+		}
+		format := "wasm"
+		if len(flags["--format"]) == 1 {
+			format = flags["--format"][0]
+		}
+		vm.TranslateToWasm(files, compilerOptions(flags), flags["-o"][0], format)
 
 	case "d", "disassemble":
 		if len(args) != 2 {
@@ -84,6 +293,9 @@ func main() {
 		vm.Debug(args[1], args[2:])
 
 	case "cr":
+		files, flags := parseFlags(args[1:], compilerFlags, false)
+		args = append(args[:1], files...)
+
 		// For composite commands, if output directory is not given write to tmpdir
 		if len(args) == 2 {
 			args = append(args, path.Join(os.TempDir(), currentTimestamp()))
@@ -93,10 +305,13 @@ func main() {
 			appLogger.Criticalf("Expected two files after 'cr': <source_path>, <object_path>\n")
 			os.Exit(1)
 		}
-		compiler.Compile(args[1], args[2])
-		vm.Execute(args[2], args[3:])
+		compiler.Compile(args[1:2], args[2], compilerOptions(flags))
+		vm.Execute(args[2], args[3:], vm.RunOptions{})
 
 	case "cd":
+		files, flags := parseFlags(args[1:], compilerFlags, false)
+		args = append(args[:1], files...)
+
 		// For composite commands, if output directory is not given write to tmpdir
 		if len(args) == 2 {
 			args = append(args, path.Join(os.TempDir(), currentTimestamp()))
@@ -106,10 +321,13 @@ func main() {
 			appLogger.Criticalf("Expected two files after 'cd': <source_path>, <object_path>\n")
 			os.Exit(1)
 		}
-		compiler.Compile(args[1], args[2])
+		compiler.Compile(args[1:2], args[2], compilerOptions(flags))
 		vm.Disassemble(args[2])
 
 	case "cD":
+		files, flags := parseFlags(args[1:], compilerFlags, false)
+		args = append(args[:1], files...)
+
 		// For composite commands, if output directory is not given write to tmpdir
 		if len(args) == 2 {
 			args = append(args, path.Join(os.TempDir(), currentTimestamp()))
@@ -119,20 +337,53 @@ func main() {
 			appLogger.Criticalf("Expected two files after 'cD': <source_path>, <object_path>\n")
 			os.Exit(1)
 		}
-		compiler.Compile(args[1], args[2])
+		compiler.Compile(args[1:2], args[2], compilerOptions(flags))
 		vm.Debug(args[2], args[3:])
 
 	case "h", "help":
-		fmt.Println("gvm [logging flag] <command> [input file] [output file]")
+		fmt.Println("gvm [logging flag] <command> [flags] [input file] [output file]")
 		fmt.Println("Available commands:")
 		fmt.Println("  help (h)           Shows this message.")
-		fmt.Println("  compile (c)        Compiles a file.")
+		fmt.Println("  compile (c)        Compiles one or more files into a single one.")
+		fmt.Println("  link               Links object files into a single compiled file.")
 		fmt.Println("  run (r)            Runs a compiled file.")
+		fmt.Println("  cover              Annotates the source of a program with the coverage recorded by run.")
 		fmt.Println("  disassemble (d)    Disassembles and pretty prints a compiled file.")
+		fmt.Println("  lint               Warns about likely mistakes in a compiled file or in source files.")
+		fmt.Println("  graph              Prints the control flow and call graphs of a compiled file or of source files.")
+		fmt.Println("  aot                Translates a compiled file or source files into a Go program.")
+		fmt.Println("  emit-c             Translates a compiled file or source files into a C99 program.")
+		fmt.Println("  emit-wasm          Translates a compiled file or source files into a WebAssembly module.")
 		fmt.Println("  debug (D)          Runs a compiled file in debug mode.")
 		fmt.Println("  cd                 Compiles, disassembles and pretty prints a compiled file.")
 		fmt.Println("  cr                 Compiles a file and then runs it.")
 		fmt.Println("  cD                 Compiles a file and then runs it in debug mode.")
+		fmt.Println("Available compilation flags:")
+		fmt.Println("  -I <dir>           Adds a directory to search for included files.")
+		fmt.Println("  -c                 Produces an object file to be linked instead of a compiled file.")
+		fmt.Println("  -O                 Optimizes the compiled code.")
+		fmt.Println("Available linking flags:")
+		fmt.Println("  -o <file>          Sets the path of the linked file.")
+		fmt.Println("  -O                 Optimizes the code of the object files.")
+		fmt.Println("Available run flags:")
+		fmt.Println("  --profile <file>   Writes a pprof profile of the instructions run.")
+		fmt.Println("  --top <n>          Reports the n labels and instructions where most instructions ran, and the n most frequent pairs.")
+		fmt.Println("  --coverage <file>  Records the instructions and branches run, adding to the file if it exists.")
+		fmt.Println("  --trace <file>     Writes a JSON record of every instruction run, one per line.")
+		fmt.Println("  --trace-steps <n>:<m>  Only traces the steps from n up to m, either being optional.")
+		fmt.Println("  --trace-range <a>:<b>  Only traces the code from a label or position a up to b, either being optional.")
+		fmt.Println("Available cover flags:")
+		fmt.Println("  --html <file>      Writes the annotated source as a web page instead of text.")
+		fmt.Println("Available graph flags:")
+		fmt.Println("  --format <format>  Prints the graphs as 'dot', the default, or 'json'.")
+		fmt.Println("Available aot flags:")
+		fmt.Println("  -o <file>          Sets the path of the Go source file.")
+		fmt.Println("  --package <name>   Writes a package exporting Run instead of a program.")
+		fmt.Println("Available emit-c flags:")
+		fmt.Println("  -o <file>          Sets the path of the C source file.")
+		fmt.Println("Available emit-wasm flags:")
+		fmt.Println("  -o <file>          Sets the path of the module.")
+		fmt.Println("  --format <format>  Writes the module as 'wasm', the default binary format, or 'wat'.")
 		fmt.Println("Available logging flags:")
 		fmt.Println("  l                  Basic logging.")
 		fmt.Println("  L                  Verbose logging.")